@@ -37,7 +37,10 @@ const meHandler: RequestHandler = async (req, res) => {
 		// });
 
 		// http://localhost:8001/api/auth/me
-		const fetched_session = await fetchSession(token);
+		const fetched_session = await fetchSession(token, {
+			method: req.method,
+			path: req.baseUrl + req.path,
+		});
 		console.log(fetched_session);
 		const userObj = await getUserFromDB(fetched_session.user_id);
 		console.log(userObj);
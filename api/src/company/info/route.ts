@@ -23,7 +23,10 @@ const updateCompany: RequestHandler = async (req, res) => {
 		const sessionResponse = await import("../../utils/auth/fetchSession");
 		let sessionData;
 		try {
-			sessionData = await sessionResponse.fetchSession(token);
+			sessionData = await sessionResponse.fetchSession(token, {
+				method: req.method,
+				path: req.baseUrl + req.path,
+			});
 		} catch (err) {
 			res.status(401).json({
 				error: "API_INVALID_SESSION",
@@ -87,7 +90,10 @@ const postUpdateCompany: RequestHandler = async (req, res) => {
 		const sessionResponse = await import("../../utils/auth/fetchSession");
 		let sessionData;
 		try {
-			sessionData = await sessionResponse.fetchSession(token);
+			sessionData = await sessionResponse.fetchSession(token, {
+				method: req.method,
+				path: req.baseUrl + req.path,
+			});
 		} catch (err) {
 			res.status(401).json({
 				error: "API_INVALID_SESSION",
@@ -22,7 +22,10 @@ const getNextInvoiceNumber: RequestHandler = async (req, res) => {
 
 		let sessionData;
 		try {
-			sessionData = await fetchSession(token);
+			sessionData = await fetchSession(token, {
+				method: req.method,
+				path: req.baseUrl + req.path,
+			});
 		} catch (err) {
 			res.status(401).json({
 				error: "API_INVALID_SESSION",
@@ -21,7 +21,10 @@ invoicesRouter.get("/", async (req, res, next) => {
 
 		const token = authHeader.substring(7);
 
-		const sessionData = await fetchSession(token);
+		const sessionData = await fetchSession(token, {
+			method: req.method,
+			path: req.baseUrl + req.path,
+		});
 		if (!sessionData || !sessionData.user_id) {
 			res.status(401).json({ error: "Unauthorized: Invalid token" });
 			return;
@@ -61,7 +64,10 @@ invoicesRouter.post("/", async (req, res, next) => {
 
 		const token = authHeader.substring(7);
 
-		const sessionData = await fetchSession(token);
+		const sessionData = await fetchSession(token, {
+			method: req.method,
+			path: req.baseUrl + req.path,
+		});
 		if (!sessionData || !sessionData.user_id) {
 			res.status(401).json({ error: "Unauthorized: Invalid token" });
 			return;
@@ -101,7 +107,10 @@ invoicesRouter.delete("/:invoiceId", async (req, res, next) => {
 		}
 
 		const token = authHeader.substring(7);
-		const sessionData = await fetchSession(token);
+		const sessionData = await fetchSession(token, {
+			method: req.method,
+			path: req.baseUrl + req.path,
+		});
 		if (!sessionData || !sessionData.user_id) {
 			res.status(401).json({ error: "Unauthorized: Invalid token" });
 			return;
@@ -32,9 +32,22 @@ const loginHandler: RequestHandler = async (req, res) => {
 			const session = await createSession(
 				user.id,
 				user.username,
-				["member"]
+				["member"],
+				{ ip: req.ip, userAgent: req.get("user-agent") }
 			);
 
+			// With device binding the gateway hands the device secret to us
+			// instead of setting the cookie on this server-to-server call.
+			if (session.device_token) {
+				res.cookie("finura_device", session.device_token, {
+					httpOnly: true,
+					secure: req.secure,
+					sameSite: "strict",
+					path: "/",
+				});
+				delete session.device_token;
+			}
+
 			res.status(200).json({ session });
 		} else {
 			throw new Error("LOGIN_NOT_FOUND");
@@ -1,20 +1,36 @@
+// client describes the browser being logged in, so the gateway binds the
+// session to it rather than to this service.
+export interface SessionClient {
+	ip?: string;
+	userAgent?: string;
+}
+
 export async function createSession(
 	user_id: string,
 	username: string,
-	roles: string[]
+	roles: string[],
+	client: SessionClient = {}
 ) {
 	const redisServiceUrl =
 		process.env.REDIS_SERVICE_URL || "http://localhost:8001";
 	try {
+		// The gateway only accepts asserted identities from trusted callers:
+		// either a peer in LOGIN_TRUSTED_CIDRS or one presenting LOGIN_CALLER_KEY.
+		const headers: Record<string, string> = {
+			"Content-Type": "application/json",
+		};
+		if (process.env.REDIS_SERVICE_LOGIN_KEY) {
+			headers["X-Login-Key"] = process.env.REDIS_SERVICE_LOGIN_KEY;
+		}
 		const response = await fetch(redisServiceUrl + "/noauth/login", {
 			method: "POST",
-			headers: {
-				"Content-Type": "application/json",
-			},
+			headers,
 			body: JSON.stringify({
 				user_id,
 				username,
 				roles,
+				client_ip: client.ip,
+				user_agent: client.userAgent,
 			}),
 		});
 
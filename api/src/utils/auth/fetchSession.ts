@@ -1,4 +1,21 @@
-export async function fetchSession(token: string) {
+export interface SessionRequest {
+	method: string;
+	path: string;
+}
+
+// Tokens restricted to one resource (share links, scoped tokens) resolve to
+// that resource; they must only be honoured for a read of exactly that path.
+function allowsRequest(resource: string, request?: SessionRequest) {
+	if (!request) return false;
+	const path =
+		request.path.length > 1 ? request.path.replace(/\/+$/, "") : request.path;
+	return (
+		resource === path &&
+		(request.method === "GET" || request.method === "HEAD")
+	);
+}
+
+export async function fetchSession(token: string, request?: SessionRequest) {
 	const redisServiceUrl =
 		process.env.REDIS_SERVICE_URL || "http://localhost:8001";
 	try {
@@ -14,7 +31,11 @@ export async function fetchSession(token: string) {
 			throw new Error(`Failed to fetch session: ${response.statusText}`);
 		}
 
-		return await response.json();
+		const session = await response.json();
+		if (session.resource && !allowsRequest(session.resource, request)) {
+			throw new Error(`Token is restricted to ${session.resource}`);
+		}
+		return session;
 	} catch (error) {
 		console.error("Error fetching session:", error);
 		throw error;
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrAdminForbidden    = newAPIError(http.StatusForbidden, "admin.forbidden", "Administrator role required")
+	ErrAdminInvalidIP    = newAPIError(http.StatusBadRequest, "admin.invalid_ip", "Invalid IP address")
+	ErrAdminStoreFailure = newAPIError(http.StatusInternalServerError, "admin.store_failure", "Failed to access gateway state")
+)
+
+type SessionFilter struct {
+	UserID    string
+	Username  string
+	IPAddress string
+}
+
+type AdminSession struct {
+	SessionID string `json:"session_id"`
+	UserSession
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+type SessionListResponse struct {
+	Sessions []AdminSession `json:"sessions"`
+	Count    int            `json:"count"`
+}
+
+type RevokeResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+type IPBlock struct {
+	IP         string    `json:"ip"`
+	BlockedAt  time.Time `json:"blocked_at"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+}
+
+type BlockListResponse struct {
+	Blocks []IPBlock `json:"blocks"`
+	Count  int       `json:"count"`
+}
+
+type RateLimitWindow struct {
+	IP            string     `json:"ip"`
+	Limit         int        `json:"limit"`
+	WindowSeconds int        `json:"window_seconds"`
+	Requests      int        `json:"requests"`
+	Remaining     int        `json:"remaining"`
+	OldestRequest *time.Time `json:"oldest_request,omitempty"`
+	Blocked       bool       `json:"blocked"`
+	BlockTTL      int64      `json:"block_ttl_seconds,omitempty"`
+}
+
+type RateLimitListResponse struct {
+	Windows []RateLimitWindow `json:"windows"`
+}
+
+func (f SessionFilter) matches(session *UserSession) bool {
+	if f.UserID != "" && session.UserID != f.UserID {
+		return false
+	}
+	if f.Username != "" && !strings.EqualFold(session.Username, f.Username) {
+		return false
+	}
+	if f.IPAddress != "" && session.IPAddress != f.IPAddress {
+		return false
+	}
+	return true
+}
+
+func (sm *SessionManager) ListSessions(ctx context.Context, filter SessionFilter) ([]AdminSession, error) {
+	sessions := []AdminSession{}
+	err := scanKeys(ctx, sm.rdb, tenantKey(ctx, "session:*"), func(key string) error {
+		sessionID := sessionIDFromKey(key)
+		session, err := sm.loadSession(ctx, sessionID)
+		if err != nil {
+			return nil
+		}
+		if !filter.matches(session) {
+			return nil
+		}
+		ttl, err := sm.rdb.TTL(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get session ttl: %w", err)
+		}
+		sessions = append(sessions, AdminSession{
+			SessionID:   sessionID,
+			UserSession: *session,
+			TTLSeconds:  int64(ttl.Seconds()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteUserSessions removes every session belonging to userID together with
+// the user_session pointer used by Login.
+func (sm *SessionManager) DeleteUserSessions(ctx context.Context, userID string) (int, error) {
+	sessions, err := sm.ListSessions(ctx, SessionFilter{UserID: userID})
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		if err := sm.DeleteSession(ctx, session.SessionID); err != nil {
+			return 0, fmt.Errorf("failed to delete session: %w", err)
+		}
+	}
+	if err := sm.rdb.Del(ctx, userSessionKey(ctx, userID)).Err(); err != nil {
+		return 0, fmt.Errorf("failed to delete user session pointer: %w", err)
+	}
+	return len(sessions), nil
+}
+
+// PurgeSessions removes every session and user_session pointer.
+func (sm *SessionManager) PurgeSessions(ctx context.Context) (int, error) {
+	purged := 0
+	for _, pattern := range []string{"session:*", "user_session:*"} {
+		err := scanKeys(ctx, sm.rdb, tenantKey(ctx, pattern), func(key string) error {
+			if err := sm.rdb.Del(ctx, key).Err(); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", key, err)
+			}
+			if pattern == "session:*" {
+				purged++
+			}
+			return nil
+		})
+		if err != nil {
+			return purged, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+	}
+	sm.invalidate(ctx, sessionInvalidateAll)
+	return purged, nil
+}
+
+func (rl *RateLimiter) ListBlocks(ctx context.Context) ([]IPBlock, error) {
+	blocks := []IPBlock{}
+	err := scanKeys(ctx, rl.rdb, tenantKey(ctx, "ratelimit:block:*"), func(key string) error {
+		block := IPBlock{IP: ipFromBlockKey(key)}
+		if ts, err := rl.rdb.Get(ctx, key).Int64(); err == nil {
+			block.BlockedAt = time.Unix(ts, 0)
+		}
+		if ttl, err := rl.rdb.TTL(ctx, key).Result(); err == nil {
+			block.TTLSeconds = int64(ttl.Seconds())
+		}
+		blocks = append(blocks, block)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+func (rl *RateLimiter) UnblockIP(ctx context.Context, ip string) (bool, error) {
+	deleted, err := rl.rdb.Del(ctx, blockKey(ctx, ip)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to unblock IP: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("[SECURITY] IP %s unblocked", ip)
+	}
+	return deleted > 0, nil
+}
+
+// Inspect reports the current sliding window for ip without recording a
+// request, unlike CheckLimit.
+func (rl *RateLimiter) Inspect(ctx context.Context, ip string, limit int, window time.Duration) (*RateLimitWindow, error) {
+	key := rateLimitKey(ctx, ip)
+	windowStart := time.Now().Add(-window)
+
+	count, err := rl.rdb.ZCount(ctx, key, strconv.FormatInt(windowStart.UnixNano(), 10), "+inf").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count rate limit window: %w", err)
+	}
+
+	result := &RateLimitWindow{
+		IP:            ip,
+		Limit:         limit,
+		WindowSeconds: int(window.Seconds()),
+		Requests:      int(count),
+		Remaining:     limit - int(count),
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+
+	oldest, err := rl.rdb.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min:   strconv.FormatInt(windowStart.UnixNano(), 10),
+		Max:   "+inf",
+		Count: 1,
+	}).Result()
+	if err == nil && len(oldest) > 0 {
+		t := time.Unix(0, int64(oldest[0].Score))
+		result.OldestRequest = &t
+	}
+
+	blockTTL, err := rl.rdb.TTL(ctx, blockKey(ctx, ip)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check block status: %w", err)
+	}
+	if blockTTL > 0 {
+		result.Blocked = true
+		result.BlockTTL = int64(blockTTL.Seconds())
+	}
+	return result, nil
+}
+
+// redactedConfig renders the effective configuration with every field
+// tagged `secret:"true"`, at any depth, and every password embedded in a
+// URL replaced so it can be returned to operators.
+func redactedConfig(cfg *Config) map[string]interface{} {
+	return redactValue(reflect.ValueOf(cfg).Elem()).(map[string]interface{})
+}
+
+func redactValue(v reflect.Value) interface{} {
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case *net.IPNet:
+		if value == nil {
+			return nil
+		}
+		return value.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redactValue(v.Elem())
+	case reflect.Struct:
+		out := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			switch {
+			case !field.IsExported():
+			case field.Tag.Get("secret") == "true":
+				if v.Field(i).IsZero() {
+					out[field.Name] = ""
+				} else {
+					out[field.Name] = "[REDACTED]"
+				}
+			default:
+				out[field.Name] = redactValue(v.Field(i))
+			}
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = redactValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[fmt.Sprint(iter.Key().Interface())] = redactValue(iter.Value())
+		}
+		return out
+	case reflect.String:
+		if u, err := url.Parse(v.String()); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+	}
+	return v.Interface()
+}
+
+func (s *Server) hasAdminRole(session *UserSession) bool {
+	for _, role := range session.Roles {
+		for _, adminRole := range s.config.AdminRoles {
+			if strings.EqualFold(role, adminRole) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AdminAuthMiddleware accepts either the static X-Admin-Key credential or a
+// regular bearer token whose session carries one of the admin roles. Session
+// roles come from gateway credential records or from a trusted login caller
+// (see trustedLoginCaller), never from an anonymous client.
+func (s *Server) AdminAuthMiddleware(next http.Handler) http.Handler {
+	requireRole := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := r.Context().Value("session").(*UserSession)
+		if !ok {
+			writeError(w, r, ErrAPIKeySessionRequired)
+			return
+		}
+		// A down-scoped token of an administrator must not carry admin rights.
+		claims, _ := r.Context().Value("user").(*Claims)
+		if !s.hasAdminRole(session) || claims == nil || !scopeAllows(claims.Scopes, "admin:*") {
+			log.Printf("[ADMIN] User %s denied access to %s from IP %s", session.UserID, r.URL.Path, getClientIP(r))
+			writeError(w, r, ErrAdminForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	withSession := s.AuthMiddleware(requireRole)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-Admin-Key"); key != "" {
+			if s.config.AdminAPIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AdminAPIKey)) != 1 {
+				log.Printf("[ADMIN] Invalid admin key from IP %s for path %s", getClientIP(r), r.URL.Path)
+				writeError(w, r, ErrAuthTokenInvalid.WithDetail("invalid admin key"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		withSession.ServeHTTP(w, r)
+	})
+}
+
+func adminRouter(s *Server) http.Handler {
+	r := chi.NewRouter()
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+	r.Use(s.AdminAuthMiddleware)
+
+	r.Get("/sessions", s.AdminListSessions)
+	r.Delete("/sessions/{sessionID}", s.AdminRevokeSession)
+	r.Delete("/users/{userID}/sessions", s.AdminRevokeUserSessions)
+	r.Get("/users/{userID}/ratelimit", s.AdminUserRateLimit)
+	r.Put("/users/{userID}/credentials", s.AdminSetCredentials)
+	r.Get("/ratelimit/{ip}", s.AdminIPRateLimit)
+	r.Get("/blocks", s.AdminListBlocks)
+	r.Post("/blocks", s.AdminBlockIP)
+	r.Delete("/blocks/{ip}", s.AdminUnblockIP)
+	r.Get("/config", s.AdminConfig)
+	r.Get("/health", s.AdminHealth)
+	r.Post("/impersonate", s.AdminImpersonate)
+	r.Get("/apikeys", s.AdminListAPIKeys)
+	r.Post("/apikeys", s.AdminCreateAPIKey)
+	r.Post("/apikeys/{keyID}/rotate", s.AdminRotateAPIKey)
+	r.Delete("/apikeys/{keyID}", s.AdminRevokeAPIKey)
+	r.Get("/audit", s.AdminAuditEvents)
+	r.Get("/audit/verify", s.AdminAuditVerify)
+	return r
+}
+
+func (s *Server) AdminListSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := SessionFilter{
+		UserID:    q.Get("user_id"),
+		Username:  q.Get("username"),
+		IPAddress: q.Get("ip"),
+	}
+
+	sessions, err := s.sessionManager.ListSessions(r.Context(), filter)
+	if err != nil {
+		log.Printf("[ERROR] Failed to list sessions: %v", err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	writeJSON(w, http.StatusOK, SessionListResponse{Sessions: sessions, Count: len(sessions)})
+}
+
+func (s *Server) AdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "sessionID")
+	ctx := r.Context()
+
+	session, err := s.sessionManager.GetSession(ctx, sessionID)
+	if err != nil {
+		writeError(w, r, ErrSessionNotFound)
+		return
+	}
+	if err := s.sessionManager.DeleteSession(ctx, sessionID); err != nil {
+		log.Printf("[ERROR] Failed to revoke session %s: %v", sessionID, err)
+		writeError(w, r, ErrSessionDeleteFailed)
+		return
+	}
+
+	log.Printf("[ADMIN] Session %s revoked", sessionID)
+	s.auditRequest(r, AuditSessionRevoked, nil, http.StatusOK, fmt.Sprintf("session %s of user %s revoked by admin", sessionID, session.UserID))
+	s.publishEvent(ctx, Event{Type: EventSessionRevoked, UserID: session.UserID, Username: session.Username, SessionID: sessionID, Reason: "admin"})
+	writeJSON(w, http.StatusOK, RevokeResponse{Revoked: 1})
+}
+
+func (s *Server) AdminRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+
+	revoked, err := s.sessionManager.DeleteUserSessions(r.Context(), userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke sessions for user %s: %v", userID, err)
+		writeError(w, r, ErrSessionDeleteFailed)
+		return
+	}
+
+	log.Printf("[ADMIN] Force-logged out user %s (%d sessions)", userID, revoked)
+	s.auditRequest(r, AuditSessionRevoked, nil, http.StatusOK, fmt.Sprintf("%d sessions of user %s revoked by admin", revoked, userID))
+	if revoked > 0 {
+		s.publishEvent(r.Context(), Event{Type: EventSessionRevoked, UserID: userID, Reason: "admin", Data: map[string]string{
+			"count": strconv.Itoa(revoked),
+		}})
+	}
+	writeJSON(w, http.StatusOK, RevokeResponse{Revoked: revoked})
+}
+
+func (s *Server) AdminUserRateLimit(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	ctx := r.Context()
+
+	sessions, err := s.sessionManager.ListSessions(ctx, SessionFilter{UserID: userID})
+	if err != nil {
+		log.Printf("[ERROR] Failed to list sessions for user %s: %v", userID, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+
+	// Rate limits are tracked per client IP, so report the window for every
+	// address the user currently has a session from.
+	seen := make(map[string]bool)
+	windows := []RateLimitWindow{}
+	for _, session := range sessions {
+		if seen[session.IPAddress] {
+			continue
+		}
+		seen[session.IPAddress] = true
+		window, err := s.rateLimiter.Inspect(ctx, session.IPAddress, s.rateLimitFor(ctx), time.Minute)
+		if err != nil {
+			log.Printf("[ERROR] Failed to inspect rate limit for IP %s: %v", session.IPAddress, err)
+			writeError(w, r, ErrAdminStoreFailure)
+			return
+		}
+		windows = append(windows, *window)
+	}
+	writeJSON(w, http.StatusOK, RateLimitListResponse{Windows: windows})
+}
+
+func (s *Server) AdminIPRateLimit(w http.ResponseWriter, r *http.Request) {
+	ip := chi.URLParam(r, "ip")
+	if net.ParseIP(ip) == nil {
+		writeError(w, r, ErrAdminInvalidIP)
+		return
+	}
+
+	window, err := s.rateLimiter.Inspect(r.Context(), ip, s.rateLimitFor(r.Context()), time.Minute)
+	if err != nil {
+		log.Printf("[ERROR] Failed to inspect rate limit for IP %s: %v", ip, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	writeJSON(w, http.StatusOK, window)
+}
+
+func (s *Server) AdminListBlocks(w http.ResponseWriter, r *http.Request) {
+	blocks, err := s.rateLimiter.ListBlocks(r.Context())
+	if err != nil {
+		log.Printf("[ERROR] Failed to list IP blocks: %v", err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	writeJSON(w, http.StatusOK, BlockListResponse{Blocks: blocks, Count: len(blocks)})
+}
+
+func (s *Server) AdminBlockIP(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		IP              string `json:"ip"`
+		DurationSeconds int    `json:"duration_seconds"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if net.ParseIP(data.IP) == nil {
+		writeError(w, r, ErrAdminInvalidIP)
+		return
+	}
+
+	duration := s.settings().BlockDuration
+	if data.DurationSeconds > 0 {
+		duration = time.Duration(data.DurationSeconds) * time.Second
+	}
+	if err := s.rateLimiter.BlockIP(r.Context(), data.IP, duration); err != nil {
+		log.Printf("[ERROR] Failed to block IP %s: %v", data.IP, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	s.auditRequest(r, AuditIPBlocked, nil, http.StatusCreated, fmt.Sprintf("%s blocked by admin for %s", data.IP, duration))
+	s.publishEvent(r.Context(), Event{Type: EventIPBlocked, IP: data.IP, Reason: "admin", Data: map[string]string{
+		"duration_seconds": strconv.Itoa(int(duration.Seconds())),
+	}})
+
+	writeJSON(w, http.StatusCreated, IPBlock{
+		IP:         data.IP,
+		BlockedAt:  time.Now(),
+		TTLSeconds: int64(duration.Seconds()),
+	})
+}
+
+func (s *Server) AdminUnblockIP(w http.ResponseWriter, r *http.Request) {
+	ip := chi.URLParam(r, "ip")
+	if net.ParseIP(ip) == nil {
+		writeError(w, r, ErrAdminInvalidIP)
+		return
+	}
+
+	removed, err := s.rateLimiter.UnblockIP(r.Context(), ip)
+	if err != nil {
+		log.Printf("[ERROR] Failed to unblock IP %s: %v", ip, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	if !removed {
+		writeError(w, r, ErrRequestNotFound.WithDetail("IP is not blocked"))
+		return
+	}
+	log.Printf("[ADMIN] IP %s unblocked", ip)
+	s.auditRequest(r, AuditIPUnblocked, nil, http.StatusOK, ip+" unblocked by admin")
+	writeJSON(w, http.StatusOK, MessageResponse{Message: "IP unblocked"})
+}
+
+func (s *Server) AdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, redactedConfig(s.settings()))
+}
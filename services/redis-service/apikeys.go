@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	apiKeyHeader   = "X-API-Key"
+	apiKeyIDPrefix = "ak_"
+
+	grantClientCredentials = "client_credentials"
+)
+
+var (
+	ErrAPIKeyInvalid         = newAPIError(http.StatusUnauthorized, "auth.api_key_invalid", "Invalid, expired or revoked API key")
+	ErrAPIKeyNotFound        = newAPIError(http.StatusNotFound, "apikey.not_found", "API key not found")
+	ErrAPIKeySessionRequired = newAPIError(http.StatusForbidden, "auth.session_required", "Endpoint requires a user session")
+	ErrClientInvalid         = newAPIError(http.StatusUnauthorized, "auth.invalid_client", "Invalid client credentials")
+	ErrGrantUnsupported      = newAPIError(http.StatusBadRequest, "auth.unsupported_grant_type", "Unsupported grant type")
+)
+
+// APIKey is a credential for services and integrations calling /api without
+// a human login. The key handed out once at creation is "<ID>.<secret>".
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	RateLimit int        `json:"rate_limit,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// apiKeyRecord is what is stored in Redis. Secrets are 256 random bits, so a
+// plain SHA-256 is enough; a slow password hash would only cost latency.
+// After a rotation the previous secret keeps working until PreviousExpiresAt.
+type apiKeyRecord struct {
+	APIKey
+	SecretHash        string     `json:"secret_hash"`
+	PreviousHash      string     `json:"previous_hash,omitempty"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+}
+
+type APIKeyStore struct {
+	rdb redis.UniversalClient
+}
+
+type APIKeyCreatedResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type APIKeyListResponse struct {
+	APIKeys []APIKey `json:"api_keys"`
+	Count   int      `json:"count"`
+}
+
+type MachineTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+func NewAPIKeyStore(rdb redis.UniversalClient) *APIKeyStore {
+	return &APIKeyStore{rdb: rdb}
+}
+
+func apiKeyKey(ctx context.Context, id string) string {
+	return tenantKey(ctx, "apikey:"+id)
+}
+
+func apiKeyRateLimitKey(ctx context.Context, id string) string {
+	return tenantKey(ctx, "ratelimit:apikey:{"+id+"}")
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// identity is the machine identity AuthMiddleware puts in the request
+// context in place of a user's claims.
+func (k *APIKey) identity(tenantID string) *Claims {
+	return &Claims{
+		TenantID: tenantID,
+		UserID:   "apikey:" + k.ID,
+		Username: k.Name,
+		KeyID:    k.ID,
+		Scopes:   k.Scopes,
+	}
+}
+
+func (ks *APIKeyStore) save(ctx context.Context, record *apiKeyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key: %w", err)
+	}
+	var ttl time.Duration
+	if record.ExpiresAt != nil {
+		ttl = time.Until(*record.ExpiresAt)
+	}
+	if err := ks.rdb.Set(ctx, apiKeyKey(ctx, record.ID), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store api key: %w", err)
+	}
+	return nil
+}
+
+func (ks *APIKeyStore) load(ctx context.Context, id string) (*apiKeyRecord, error) {
+	data, err := ks.rdb.Get(ctx, apiKeyKey(ctx, id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	var record apiKeyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api key: %w", err)
+	}
+	if record.expired(time.Now()) {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Create stores key under a new ID and returns the full key to hand out.
+func (ks *APIKeyStore) Create(ctx context.Context, key *APIKey) (string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate api key id: %w", err)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	key.ID = apiKeyIDPrefix + id
+	key.CreatedAt = time.Now()
+	if err := ks.save(ctx, &apiKeyRecord{APIKey: *key, SecretHash: hashAPIKeySecret(secret)}); err != nil {
+		return "", err
+	}
+	return key.ID + "." + secret, nil
+}
+
+// Get returns the key with id, or nil if it does not exist or has expired.
+func (ks *APIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	record, err := ks.load(ctx, id)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return &record.APIKey, nil
+}
+
+func (ks *APIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := scanKeys(ctx, ks.rdb, tenantKey(ctx, "apikey:*"), func(key string) error {
+		_, key = splitTenantKey(key)
+		record, err := ks.load(ctx, strings.TrimPrefix(key, "apikey:"))
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			keys = append(keys, record.APIKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Rotate replaces the secret of key id. The old secret stays valid for
+// grace so callers can roll the new one out without downtime.
+func (ks *APIKeyStore) Rotate(ctx context.Context, id string, grace time.Duration) (*APIKey, string, error) {
+	record, err := ks.load(ctx, id)
+	if err != nil || record == nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+
+	now := time.Now()
+	record.PreviousHash, record.PreviousExpiresAt = "", nil
+	if grace > 0 {
+		previousExpiresAt := now.Add(grace)
+		record.PreviousHash = record.SecretHash
+		record.PreviousExpiresAt = &previousExpiresAt
+	}
+	record.SecretHash = hashAPIKeySecret(secret)
+	record.RotatedAt = &now
+	if err := ks.save(ctx, record); err != nil {
+		return nil, "", err
+	}
+	return &record.APIKey, record.ID + "." + secret, nil
+}
+
+func (ks *APIKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	deleted, err := ks.rdb.Del(ctx, apiKeyKey(ctx, id)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	return deleted == 1, nil
+}
+
+// Verify returns the key matching a presented "<ID>.<secret>", or nil if
+// there is none.
+func (ks *APIKeyStore) Verify(ctx context.Context, presented string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok || !strings.HasPrefix(id, apiKeyIDPrefix) || secret == "" {
+		return nil, nil
+	}
+	record, err := ks.load(ctx, id)
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	hash := []byte(hashAPIKeySecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(record.SecretHash)) == 1 {
+		return &record.APIKey, nil
+	}
+	if record.PreviousHash != "" && record.PreviousExpiresAt != nil && time.Now().Before(*record.PreviousExpiresAt) &&
+		subtle.ConstantTimeCompare(hash, []byte(record.PreviousHash)) == 1 {
+		return &record.APIKey, nil
+	}
+	return nil, nil
+}
+
+// authenticateMachine completes AuthMiddleware for an API key, presented
+// directly in X-API-Key or exchanged for a machine token. There is no
+// session: the key is looked up on every request, so revocation and expiry
+// take effect immediately.
+func (s *Server) authenticateMachine(w http.ResponseWriter, r *http.Request, next http.Handler, presented string, token *Claims) {
+	ctx := r.Context()
+	ip := getClientIP(r)
+
+	var key *APIKey
+	var err error
+	if token == nil {
+		key, err = s.apiKeys.Verify(ctx, presented)
+	} else {
+		key, err = s.apiKeys.Get(ctx, token.KeyID)
+	}
+	if err != nil {
+		log.Printf("[AUTH] API key lookup failed from IP %s for path %s: %v", ip, r.URL.Path, err)
+		if redisFailure(err) {
+			writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+			return
+		}
+		writeError(w, r, ErrInternal)
+		return
+	}
+	if key == nil {
+		log.Printf("[AUTH] Invalid API key from IP %s for path %s", ip, r.URL.Path)
+		s.auditAuthFailure(r, token, ErrAPIKeyInvalid)
+		writeError(w, r, ErrAPIKeyInvalid)
+		return
+	}
+
+	claims := key.identity(tenantID(ctx))
+	if token != nil {
+		claims.Scopes = token.Scopes
+	}
+
+	if key.RateLimit > 0 {
+		result, err := s.rateLimiter.CheckLimit(ctx, apiKeyRateLimitKey(ctx, key.ID), key.RateLimit, time.Minute)
+		if err != nil {
+			// The per-IP limit has already been applied, so a failed check
+			// here lets the request through rather than rejecting it.
+			log.Printf("[WARN] Rate limit check failed for API key %s: %v", key.ID, err)
+		} else {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(key.RateLimit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetTime.Unix(), 10))
+			if !result.Allowed {
+				log.Printf("[RATE_LIMITED] API key %s exceeded rate limit (%d requests/minute) for path %s", key.ID, key.RateLimit, r.URL.Path)
+				writeRetryableError(w, r, ErrRateLimitExceeded, result.RetryAfter.Seconds())
+				return
+			}
+		}
+	}
+
+	log.Printf("[AUTH] Successful authentication for API key %s (%s) from IP %s accessing %s", key.ID, key.Name, ip, r.URL.Path)
+	next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "user", claims)))
+}
+
+// RequireSession rejects machine identities on endpoints that act on the
+// caller's session.
+func (s *Server) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value("session").(*UserSession); !ok {
+			writeError(w, r, ErrAPIKeySessionRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) createMachineJWT(tenantID string, key *APIKey, scopes []string, ttl time.Duration) (string, error) {
+	claims := key.identity(tenantID)
+	claims.Scopes = scopes
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+	}
+	return s.keys.Sign(claims)
+}
+
+// MachineToken implements the OAuth 2.0 client credentials grant: the key ID
+// is the client ID and the secret the client secret, sent either with HTTP
+// Basic authentication or in the body. The body is form-encoded as in RFC
+// 6749, or JSON. An optional space-separated scope narrows the token below
+// the key's own scopes.
+func (s *Server) MachineToken(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		GrantType    string `json:"grant_type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		Scope        string `json:"scope"`
+	}
+	if contentTypeAllowed(r.Header.Get("Content-Type"), formContentTypes) {
+		form, err := s.decodeFormBody(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		data.GrantType = form.Get("grant_type")
+		data.ClientID = form.Get("client_id")
+		data.ClientSecret = form.Get("client_secret")
+		data.Scope = form.Get("scope")
+	} else if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if data.GrantType != grantClientCredentials {
+		writeError(w, r, ErrGrantUnsupported)
+		return
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		data.ClientID, data.ClientSecret = id, secret
+	}
+
+	ctx := r.Context()
+	key, err := s.apiKeys.Verify(ctx, data.ClientID+"."+data.ClientSecret)
+	if err != nil {
+		log.Printf("[ERROR] Failed to verify client %s: %v", data.ClientID, err)
+		if redisFailure(err) {
+			writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+			return
+		}
+		writeError(w, r, ErrInternal)
+		return
+	}
+	if key == nil {
+		log.Printf("[AUTH] Invalid client credentials for %q from IP %s", data.ClientID, getClientIP(r))
+		s.auditRequest(r, AuditAuthFailure, &Claims{UserID: "apikey:" + data.ClientID}, ErrClientInvalid.Status, "invalid client credentials")
+		writeError(w, r, ErrClientInvalid)
+		return
+	}
+
+	scopes := key.Scopes
+	if data.Scope != "" {
+		scopes = strings.Fields(data.Scope)
+		for _, scope := range scopes {
+			if !scopeAllows(key.Scopes, scope) {
+				writeError(w, r, ErrScopeForbidden.WithDetail("key does not grant "+scope))
+				return
+			}
+		}
+	}
+
+	ttl := s.config.MachineTokenTTL
+	token, err := s.createMachineJWT(tenantID(ctx), key, scopes, ttl)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create machine token for API key %s: %v", key.ID, err)
+		writeError(w, r, ErrTokenCreateFailed)
+		return
+	}
+	s.auditRequest(r, AuditMachineToken, key.identity(tenantID(ctx)), http.StatusOK, "scopes "+strings.Join(scopes, " "))
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, MachineTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+func (s *Server) AdminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		RateLimit        int      `json:"rate_limit"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if data.Name == "" || len(data.Scopes) == 0 {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("name and scopes are required"))
+		return
+	}
+	for _, scope := range data.Scopes {
+		if !validScope(scope) {
+			writeError(w, r, ErrRequestInvalidField.WithDetail(fmt.Sprintf("invalid scope %q", scope)))
+			return
+		}
+	}
+	if data.RateLimit < 0 || data.ExpiresInSeconds < 0 {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("rate_limit and expires_in_seconds must not be negative"))
+		return
+	}
+
+	key := &APIKey{Name: data.Name, Scopes: data.Scopes, RateLimit: data.RateLimit}
+	if data.ExpiresInSeconds > 0 {
+		expiresAt := time.Now().Add(time.Duration(data.ExpiresInSeconds) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+	secret, err := s.apiKeys.Create(r.Context(), key)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create API key %q: %v", data.Name, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	log.Printf("[ADMIN] API key %s (%s) created with scopes %v", key.ID, key.Name, key.Scopes)
+	s.auditRequest(r, AuditAPIKeyCreated, nil, http.StatusCreated, fmt.Sprintf("api key %s (%s) created", key.ID, key.Name))
+
+	writeJSON(w, http.StatusCreated, APIKeyCreatedResponse{APIKey: *key, Key: secret})
+}
+
+func (s *Server) AdminListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.apiKeys.List(r.Context())
+	if err != nil {
+		log.Printf("[ERROR] Failed to list API keys: %v", err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	writeJSON(w, http.StatusOK, APIKeyListResponse{APIKeys: keys, Count: len(keys)})
+}
+
+func (s *Server) AdminRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyID")
+	var data struct {
+		GraceSeconds int `json:"grace_seconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := s.decodeJSONBody(w, r, &data); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if data.GraceSeconds < 0 {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("grace_seconds must not be negative"))
+		return
+	}
+
+	grace := time.Duration(data.GraceSeconds) * time.Second
+	key, secret, err := s.apiKeys.Rotate(r.Context(), keyID, grace)
+	if err != nil {
+		log.Printf("[ERROR] Failed to rotate API key %s: %v", keyID, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	if key == nil {
+		writeError(w, r, ErrAPIKeyNotFound)
+		return
+	}
+	log.Printf("[ADMIN] API key %s rotated, previous secret valid for %s", key.ID, grace)
+	s.auditRequest(r, AuditAPIKeyRotated, nil, http.StatusOK, fmt.Sprintf("api key %s rotated, previous secret valid for %s", key.ID, grace))
+
+	writeJSON(w, http.StatusOK, APIKeyCreatedResponse{APIKey: *key, Key: secret})
+}
+
+func (s *Server) AdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyID")
+
+	revoked, err := s.apiKeys.Revoke(r.Context(), keyID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke API key %s: %v", keyID, err)
+		writeError(w, r, ErrAdminStoreFailure)
+		return
+	}
+	if !revoked {
+		writeError(w, r, ErrAPIKeyNotFound)
+		return
+	}
+	log.Printf("[ADMIN] API key %s revoked", keyID)
+	s.auditRequest(r, AuditAPIKeyRevoked, nil, http.StatusOK, fmt.Sprintf("api key %s revoked", keyID))
+
+	writeJSON(w, http.StatusOK, RevokeResponse{Revoked: 1})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAPIKeyServer(t *testing.T) *Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+	s, _ := newTestServer(t, map[string]string{"PROXY_TARGET_URL": upstream.URL})
+	return s
+}
+
+func createAPIKey(t *testing.T, s *Server, key *APIKey) string {
+	t.Helper()
+	full, err := s.apiKeys.Create(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return full
+}
+
+func apiKeyRequest(s *Server, target, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set(apiKeyHeader, key)
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func tokenRequest(s *Server, contentType, body string, basic ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/noauth/token", strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", contentType)
+	if len(basic) == 2 {
+		r.SetBasicAuth(basic[0], basic[1])
+	}
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestMachineTokenGrant(t *testing.T) {
+	s := newAPIKeyServer(t)
+	key := createAPIKey(t, s, &APIKey{Name: "billing", Scopes: []string{"invoices:read", "invoices:write"}})
+	id, secret, _ := strings.Cut(key, ".")
+	form := url.Values{"grant_type": {grantClientCredentials}, "client_id": {id}, "client_secret": {secret}, "scope": {"invoices:read"}}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		basic       []string
+	}{
+		{"form body", "application/x-www-form-urlencoded", form.Encode(), nil},
+		{"JSON body", "application/json", `{"grant_type":"client_credentials","client_id":"` + id + `","client_secret":"` + secret + `","scope":"invoices:read"}`, nil},
+		{"basic auth", "application/x-www-form-urlencoded", "grant_type=client_credentials&scope=invoices%3Aread", []string{id, secret}},
+	} {
+		w := tokenRequest(s, tc.contentType, tc.body, tc.basic...)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d: %s", tc.name, w.Code, w.Body)
+			continue
+		}
+		var response MachineTokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Scope != "invoices:read" || response.TokenType != "Bearer" {
+			t.Errorf("%s: unexpected response %+v", tc.name, response)
+		}
+		if w := serveRequest(s, http.MethodGet, "/api/invoices", response.AccessToken, ""); w.Code != http.StatusOK {
+			t.Errorf("%s: machine token rejected: got status %d: %s", tc.name, w.Code, w.Body)
+		}
+	}
+
+	form.Set("client_secret", "wrong")
+	if w := tokenRequest(s, "application/x-www-form-urlencoded", form.Encode()); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.invalid_client") {
+		t.Errorf("wrong secret: got status %d: %s", w.Code, w.Body)
+	}
+	form.Set("grant_type", "password")
+	if w := tokenRequest(s, "application/x-www-form-urlencoded", form.Encode()); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "auth.unsupported_grant_type") {
+		t.Errorf("unsupported grant: got status %d: %s", w.Code, w.Body)
+	}
+	if w := tokenRequest(s, "text/plain", form.Encode()); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("plain text body: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyHeader(t *testing.T) {
+	s := newAPIKeyServer(t)
+	key := createAPIKey(t, s, &APIKey{Name: "billing", Scopes: []string{"invoices:read"}})
+
+	if w := apiKeyRequest(s, "/api/invoices", key); w.Code != http.StatusOK {
+		t.Errorf("valid key: got status %d: %s", w.Code, w.Body)
+	}
+	if w := apiKeyRequest(s, "/api/users/u1", key); w.Code != http.StatusForbidden {
+		t.Errorf("path outside the key's scopes: got status %d: %s", w.Code, w.Body)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", key+"x"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.api_key_invalid") {
+		t.Errorf("wrong secret: got status %d: %s", w.Code, w.Body)
+	}
+	reader := createAPIKey(t, s, &APIKey{Name: "sessions", Scopes: []string{"session:read"}})
+	if w := apiKeyRequest(s, "/api/webauthn/credentials", reader); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "auth.session_required") {
+		t.Errorf("session endpoint with a key: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	s := newAPIKeyServer(t)
+	ctx := context.Background()
+	old := createAPIKey(t, s, &APIKey{Name: "billing", Scopes: []string{"invoices:read"}})
+	id, _, _ := strings.Cut(old, ".")
+
+	_, rotated, err := s.apiKeys.Rotate(ctx, id, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]string{"new secret": rotated, "old secret during grace": old} {
+		if w := apiKeyRequest(s, "/api/invoices", key); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d: %s", name, w.Code, w.Body)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	if w := apiKeyRequest(s, "/api/invoices", old); w.Code != http.StatusUnauthorized {
+		t.Errorf("old secret after grace: got status %d: %s", w.Code, w.Body)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", rotated); w.Code != http.StatusOK {
+		t.Errorf("new secret after grace: got status %d: %s", w.Code, w.Body)
+	}
+
+	_, latest, err := s.apiKeys.Rotate(ctx, id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", rotated); w.Code != http.StatusUnauthorized {
+		t.Errorf("previous secret without grace: got status %d: %s", w.Code, w.Body)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", latest); w.Code != http.StatusOK {
+		t.Errorf("latest secret: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyRevocation(t *testing.T) {
+	s := newAPIKeyServer(t)
+	key := createAPIKey(t, s, &APIKey{Name: "billing", Scopes: []string{"invoices:read"}})
+	id, secret, _ := strings.Cut(key, ".")
+
+	w := tokenRequest(s, "application/x-www-form-urlencoded", "grant_type=client_credentials", id, secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token grant: got status %d: %s", w.Code, w.Body)
+	}
+	var response MachineTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, err := s.apiKeys.Revoke(context.Background(), id); err != nil || !revoked {
+		t.Fatalf("revoke: %v, err %v", revoked, err)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", key); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.api_key_invalid") {
+		t.Errorf("revoked key: got status %d: %s", w.Code, w.Body)
+	}
+	if w := serveRequest(s, http.MethodGet, "/api/invoices", response.AccessToken, ""); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.api_key_invalid") {
+		t.Errorf("machine token of a revoked key: got status %d: %s", w.Code, w.Body)
+	}
+	if w := tokenRequest(s, "application/x-www-form-urlencoded", "grant_type=client_credentials", id, secret); w.Code != http.StatusUnauthorized {
+		t.Errorf("token grant for a revoked key: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	s := newAPIKeyServer(t)
+	limited := createAPIKey(t, s, &APIKey{Name: "billing", Scopes: []string{"invoices:read"}, RateLimit: 2})
+	other := createAPIKey(t, s, &APIKey{Name: "reports", Scopes: []string{"invoices:read"}, RateLimit: 2})
+
+	// CheckLimit compares the requests already in the window with the limit,
+	// so like the per-IP limit it admits limit+1 requests per window.
+	for i := 0; i < 3; i++ {
+		w := apiKeyRequest(s, "/api/invoices", limited)
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Fatalf("request %d within the key limit: got status %d: %s", i, w.Code, w.Body)
+		}
+	}
+	w := apiKeyRequest(s, "/api/invoices", limited)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the key limit: got status %d: %s", w.Code, w.Body)
+	}
+	if w := apiKeyRequest(s, "/api/invoices", other); w.Code != http.StatusOK {
+		t.Errorf("another key from the same IP: got status %d: %s", w.Code, w.Body)
+	}
+}
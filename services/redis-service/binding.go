@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	BindingIP        = "ip"
+	BindingSubnet    = "subnet"
+	BindingUserAgent = "user_agent"
+	BindingDevice    = "device"
+
+	BindingActionLog    = "log"
+	BindingActionReject = "reject"
+	BindingActionReauth = "reauth"
+
+	deviceCookieName = "finura_device"
+)
+
+var (
+	ErrSessionBindingMismatch = newAPIError(http.StatusUnauthorized, "session.binding_mismatch", "Request does not match the client the session was issued to")
+	ErrSessionReauthRequired  = newAPIError(http.StatusUnauthorized, "session.reauth_required", "Session was ended for security reasons, please log in again")
+)
+
+// ClientFingerprint is what a session gets bound to at login. Empty fields
+// are never checked, so sessions issued without them (for example through
+// the CLI) stay usable.
+type ClientFingerprint struct {
+	IP            string
+	UserAgentHash string
+	DeviceHash    string
+}
+
+func parseBindingConfig(policies []string, action string) ([]string, string, error) {
+	for _, policy := range policies {
+		switch policy {
+		case BindingIP, BindingSubnet, BindingUserAgent, BindingDevice:
+		default:
+			return nil, "", fmt.Errorf("unknown SESSION_BINDING policy %q", policy)
+		}
+	}
+	switch action {
+	case BindingActionLog, BindingActionReject, BindingActionReauth:
+	default:
+		return nil, "", fmt.Errorf("unknown SESSION_BINDING_ACTION %q", action)
+	}
+	return policies, action, nil
+}
+
+func hashFingerprint(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) bindingEnabled(policy string) bool {
+	for _, p := range s.config.SessionBinding {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprintLogin captures the client fingerprint for a new session. When
+// device binding is enabled it also returns a fresh device secret, which the
+// caller must hand to the client in the device cookie.
+func (s *Server) fingerprintLogin(r *http.Request) (ClientFingerprint, string) {
+	client := ClientFingerprint{
+		IP:            getClientIP(r),
+		UserAgentHash: hashFingerprint(r.UserAgent()),
+	}
+	if !s.bindingEnabled(BindingDevice) {
+		return client, ""
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+	client.DeviceHash = hashFingerprint(secret)
+	return client, secret
+}
+
+// loginOnBehalfOf returns r as seen from the end user a trusted caller is
+// logging in, so the session is bound to the user's browser rather than to
+// the caller.
+func loginOnBehalfOf(r *http.Request, clientIP, userAgent string) *http.Request {
+	ctx := context.WithValue(r.Context(), "login_on_behalf", true)
+	if clientIP != "" {
+		ctx = context.WithValue(ctx, "client_ip", clientIP)
+	}
+	r = r.Clone(ctx)
+	if userAgent != "" {
+		r.Header.Set("User-Agent", userAgent)
+	}
+	return r
+}
+
+func (s *Server) setDeviceCookie(w http.ResponseWriter, r *http.Request, secret string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(s.config.SessionMaxLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// isSecureRequest reports whether the client reached the gateway over HTTPS,
+// as resolved by ClientIPMiddleware, or over TLS for requests that did not
+// pass through it.
+func isSecureRequest(r *http.Request) bool {
+	if secure, ok := r.Context().Value("secure_request").(bool); ok {
+		return secure
+	}
+	return r.TLS != nil
+}
+
+// resolveSecureRequest only believes X-Forwarded-Proto when the peer is one
+// of TRUSTED_PROXIES, like resolveClientIP, so a client cannot turn on
+// Secure cookies or HSTS for a plain HTTP connection.
+func (s *Server) resolveSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return ipInNetworks(peerIP(r), s.settings().TrustedProxies) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// sameSubnet compares two addresses by network prefix, which tolerates
+// address changes within a provider's pool (mobile carriers, DHCP).
+func (s *Server) sameSubnet(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	bits, prefix := 128, s.config.SessionBindingIPv6Prefix
+	if ipA.To4() != nil {
+		ipA, ipB = ipA.To4(), ipB.To4()
+		if ipB == nil {
+			return false
+		}
+		bits, prefix = 32, s.config.SessionBindingIPv4Prefix
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// bindingMismatches returns the binding policies the request violates.
+func (s *Server) bindingMismatches(r *http.Request, session *UserSession) []string {
+	var mismatches []string
+	ip := getClientIP(r)
+	for _, policy := range s.config.SessionBinding {
+		switch policy {
+		case BindingIP:
+			if session.IPAddress != "" && ip != session.IPAddress {
+				mismatches = append(mismatches, policy)
+			}
+		case BindingSubnet:
+			if session.IPAddress != "" && !s.sameSubnet(ip, session.IPAddress) {
+				mismatches = append(mismatches, policy)
+			}
+		case BindingUserAgent:
+			if session.UserAgentHash != "" && hashFingerprint(r.UserAgent()) != session.UserAgentHash {
+				mismatches = append(mismatches, policy)
+			}
+		case BindingDevice:
+			if session.DeviceHash == "" {
+				continue
+			}
+			cookie, err := r.Cookie(deviceCookieName)
+			if err != nil || subtle.ConstantTimeCompare([]byte(hashFingerprint(cookie.Value)), []byte(session.DeviceHash)) != 1 {
+				mismatches = append(mismatches, policy)
+			}
+		}
+	}
+	return mismatches
+}
+
+// bindingExempt reports whether the request is the upstream resolving a
+// token it was sent. It calls from its own address and user agent without
+// the device cookie, and the user's request it is serving was already
+// checked when the gateway proxied it.
+func (s *Server) bindingExempt(r *http.Request) bool {
+	return r.URL.Path == sessionGetPath && s.trustedLoginCaller(r)
+}
+
+// enforceBinding checks the request against the session's fingerprint and
+// applies SessionBindingAction. Every mismatch is recorded as a security
+// event; the returned error is nil when the request may proceed.
+func (s *Server) enforceBinding(r *http.Request, claims *Claims, session *UserSession) *APIError {
+	if s.bindingExempt(r) {
+		return nil
+	}
+	mismatches := s.bindingMismatches(r, session)
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	ip := getClientIP(r)
+	detail := strings.Join(mismatches, ",")
+	log.Printf("[SECURITY] Session %s of user %s used from %s does not match binding (%s)", claims.SessionID, claims.UserID, ip, detail)
+	s.auditRequest(r, AuditBindingMismatch, claims, 0, detail)
+	s.publishEvent(r.Context(), Event{
+		Type:      EventBindingMismatch,
+		UserID:    claims.UserID,
+		Username:  claims.Username,
+		SessionID: claims.SessionID,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Reason:    s.config.SessionBindingAction,
+		Data:      map[string]string{"mismatches": detail},
+	})
+
+	switch s.config.SessionBindingAction {
+	case BindingActionReject:
+		return ErrSessionBindingMismatch
+	case BindingActionReauth:
+		if err := s.sessionManager.DeleteSession(r.Context(), claims.SessionID); err != nil {
+			log.Printf("[ERROR] Failed to end session %s after binding mismatch: %v", claims.SessionID, err)
+		}
+		s.publishEvent(r.Context(), Event{
+			Type:      EventSessionRevoked,
+			UserID:    claims.UserID,
+			Username:  claims.Username,
+			SessionID: claims.SessionID,
+			IP:        ip,
+			Reason:    "binding_mismatch",
+		})
+		return ErrSessionReauthRequired
+	}
+	return nil
+}
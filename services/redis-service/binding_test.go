@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"})
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    string
+		xri    string
+		want   string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"spoofed header from untrusted peer", "203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"client prepends a fake hop", "10.0.0.2:5000", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:5000", "198.51.100.1, 10.0.0.3", "", "198.51.100.1"},
+		{"real ip from trusted proxy", "10.0.0.2:5000", "", "198.51.100.9", "198.51.100.9"},
+		{"ipv6 peer", "[2001:db8::1]:5000", "198.51.100.1", "", "2001:db8::1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.xri != "" {
+			r.Header.Set("X-Real-IP", tc.xri)
+		}
+		if got := s.resolveClientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func postLogin(s *Server, remote string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/noauth/login", strings.NewReader(body))
+	r.RemoteAddr = remote
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestLoginRequiresTrustedCaller(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"LOGIN_CALLER_KEY": "caller-key"})
+	body := `{"user_id":"u1","username":"alice","roles":["admin"]}`
+
+	if w := postLogin(s, "203.0.113.7:5000", nil, body); w.Code != http.StatusForbidden {
+		t.Fatalf("untrusted caller: got status %d, want 403: %s", w.Code, w.Body)
+	}
+	if w := postLogin(s, "203.0.113.7:5000", map[string]string{loginCallerKeyHeader: "wrong"}, body); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong caller key: got status %d, want 403", w.Code)
+	}
+	if w := postLogin(s, "203.0.113.7:5000", map[string]string{loginCallerKeyHeader: "caller-key"}, body); w.Code != http.StatusOK {
+		t.Fatalf("caller key: got status %d: %s", w.Code, w.Body)
+	}
+	if w := postLogin(s, "127.0.0.1:5000", nil, body); w.Code != http.StatusOK {
+		t.Fatalf("loopback caller: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginOnBehalfOfClient(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"SESSION_BINDING": "ip,user_agent,device"})
+	body := `{"user_id":"u1","username":"alice","roles":["member"],"client_ip":"198.51.100.4","user_agent":"Browser/1.0"}`
+
+	if w := postLogin(s, "203.0.113.7:5000", nil, body); w.Code != http.StatusForbidden {
+		t.Fatalf("untrusted caller setting fingerprint: got status %d, want 403", w.Code)
+	}
+
+	w := postLogin(s, "127.0.0.1:5000", map[string]string{"User-Agent": "node"}, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("device cookie was set for the caller: %v", cookies)
+	}
+	var response LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.DeviceToken == "" {
+		t.Error("device token was not returned to the caller")
+	}
+
+	session, err := s.sessionManager.GetSession(context.Background(), response.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.IPAddress != "198.51.100.4" {
+		t.Errorf("session bound to %s, want the client address", session.IPAddress)
+	}
+	if session.UserAgentHash != hashFingerprint("Browser/1.0") {
+		t.Error("session bound to the caller's user agent")
+	}
+	if session.DeviceHash != hashFingerprint(response.DeviceToken) {
+		t.Error("session not bound to the returned device token")
+	}
+}
+
+// TestSessionGetSkipsBindingForUpstream covers the upstream resolving a
+// user's token server to server, from its own address and user agent and
+// without the device cookie.
+func TestSessionGetSkipsBindingForUpstream(t *testing.T) {
+	for _, action := range []string{BindingActionReject, BindingActionReauth} {
+		s, _ := newTestServer(t, map[string]string{
+			"SESSION_BINDING":        "ip,user_agent,device",
+			"SESSION_BINDING_ACTION": action,
+		})
+		body := `{"user_id":"u1","username":"alice","roles":["member"],"client_ip":"198.51.100.4","user_agent":"Browser/1.0"}`
+		w := postLogin(s, "127.0.0.1:5000", nil, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: login: got status %d: %s", action, w.Code, w.Body)
+		}
+		var login LoginResponse
+		if err := json.NewDecoder(w.Body).Decode(&login); err != nil {
+			t.Fatal(err)
+		}
+
+		lookup := func(remote string) int {
+			r := httptest.NewRequest(http.MethodPost, sessionGetPath, nil)
+			r.RemoteAddr = remote
+			r.Header.Set("Authorization", "Bearer "+login.Token)
+			r.Header.Set("User-Agent", "node")
+			w := httptest.NewRecorder()
+			s.Routes().ServeHTTP(w, r)
+			return w.Code
+		}
+		if code := lookup("127.0.0.1:40000"); code != http.StatusOK {
+			t.Errorf("%s: upstream session lookup: got status %d, want 200", action, code)
+		}
+		if _, err := s.sessionManager.GetSession(context.Background(), login.SessionID); err != nil {
+			t.Fatalf("%s: session ended by the upstream lookup: %v", action, err)
+		}
+		if code := lookup("203.0.113.9:40000"); code != http.StatusUnauthorized {
+			t.Errorf("%s: lookup from an untrusted peer: got status %d, want 401", action, code)
+		}
+	}
+}
+
+func TestForwardedProtoOnlyFromTrustedProxies(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"})
+	for _, tc := range []struct {
+		remote string
+		proto  string
+		want   bool
+	}{
+		{"203.0.113.7:5000", "https", false},
+		{"10.0.0.2:5000", "https", true},
+		{"10.0.0.2:5000", "http", false},
+		{"10.0.0.2:5000", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/noauth/missing", nil)
+		r.RemoteAddr = tc.remote
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		w := httptest.NewRecorder()
+		s.Routes().ServeHTTP(w, r)
+		if got := w.Header().Get("Strict-Transport-Security") != ""; got != tc.want {
+			t.Errorf("%s from %s: HSTS sent %v, want %v", tc.proto, tc.remote, got, tc.want)
+		}
+		if got := s.resolveSecureRequest(r); got != tc.want {
+			t.Errorf("%s from %s: secure %v, want %v", tc.proto, tc.remote, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrRedisUnavailable = errors.New("redis unavailable: circuit open")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// redisFailure reports whether err means Redis could not be reached, as
+// opposed to a reply such as redis.Nil or WRONGTYPE or a decoding problem.
+func redisFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrRedisUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrPoolTimeout) ||
+		errors.Is(err, redis.ErrPoolExhausted) ||
+		errors.As(err, &netErr)
+}
+
+// CircuitBreaker is a go-redis hook that stops sending commands after
+// Threshold consecutive failures. While open, commands fail immediately with
+// ErrRedisUnavailable so callers can degrade without waiting on timeouts;
+// after Cooldown a single probe is let through to test for recovery.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	trips    atomic.Uint64
+	rejected atomic.Uint64
+}
+
+type BreakerStats struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	Trips               uint64     `json:"trips"`
+	Rejected            uint64     `json:"rejected"`
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// allow reports whether a command may be sent and whether it is the single
+// recovery probe of a half-open circuit.
+func (cb *CircuitBreaker) allow() (bool, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			cb.rejected.Add(1)
+			return false, ErrRedisUnavailable
+		}
+		cb.state = BreakerHalfOpen
+		cb.probing = true
+		return true, nil
+	case BreakerHalfOpen:
+		if cb.probing {
+			cb.rejected.Add(1)
+			return false, ErrRedisUnavailable
+		}
+		cb.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (cb *CircuitBreaker) record(ctx context.Context, err error, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing = false
+	}
+	// A caller giving up, or its own deadline passing, says nothing about
+	// Redis either way. go-redis reports its dial, read, write and pool
+	// timeouts as network errors or redis.ErrPoolTimeout instead.
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	// Commands sent before the circuit opened finish on their own schedule;
+	// only the probe decides whether it closes again.
+	if cb.state != BreakerClosed && !probe {
+		return
+	}
+	failed := redisFailure(err)
+
+	if !failed {
+		if cb.state != BreakerClosed {
+			log.Printf("[REDIS] Circuit closed, Redis reachable again")
+		}
+		cb.state = BreakerClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		if cb.state == BreakerClosed {
+			cb.trips.Add(1)
+			log.Printf("[REDIS] Circuit open after %d consecutive failures, running degraded: %v", cb.failures, err)
+		}
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// Degraded reports whether Redis is currently considered unavailable.
+func (cb *CircuitBreaker) Degraded() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state != BreakerClosed
+}
+
+// RetryAfter is how long until the next recovery probe.
+func (cb *CircuitBreaker) RetryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != BreakerOpen {
+		return time.Second
+	}
+	if remaining := cb.cooldown - time.Since(cb.openedAt); remaining > time.Second {
+		return remaining
+	}
+	return time.Second
+}
+
+func (cb *CircuitBreaker) Stats() BreakerStats {
+	cb.mu.Lock()
+	stats := BreakerStats{State: cb.state, ConsecutiveFailures: cb.failures}
+	if cb.state != BreakerClosed {
+		openedAt := cb.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	cb.mu.Unlock()
+	stats.Trips = cb.trips.Load()
+	stats.Rejected = cb.rejected.Load()
+	return stats
+}
+
+func (cb *CircuitBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (cb *CircuitBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		probe, err := cb.allow()
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		err = next(ctx, cmd)
+		cb.record(ctx, err, probe)
+		return err
+	}
+}
+
+func (cb *CircuitBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		probe, err := cb.allow()
+		if err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		err = next(ctx, cmds)
+		cb.record(ctx, err, probe)
+		return err
+	}
+}
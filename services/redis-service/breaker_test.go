@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerTripsAndRecovers(t *testing.T) {
+	fake := newFakeRedis()
+	cb := NewCircuitBreaker(3, 50*time.Millisecond)
+	rdb := fake.client(cb)
+	ctx := context.Background()
+
+	fake.down = true
+	for i := 0; i < 3; i++ {
+		if err := rdb.Ping(ctx).Err(); !errors.Is(err, errFakeDown) {
+			t.Fatalf("command %d before tripping: got %v", i, err)
+		}
+	}
+	if stats := cb.Stats(); stats.State != BreakerOpen || stats.Trips != 1 {
+		t.Fatalf("after 3 failures: %+v", stats)
+	}
+
+	fake.down = false
+	if err := rdb.Ping(ctx).Err(); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("open circuit during cooldown: got %v", err)
+	}
+	if cb.Stats().Rejected != 1 {
+		t.Errorf("rejected count: %+v", cb.Stats())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	fake.down = true
+	if err := rdb.Ping(ctx).Err(); !errors.Is(err, errFakeDown) {
+		t.Fatalf("probe after cooldown: got %v", err)
+	}
+	if stats := cb.Stats(); stats.State != BreakerOpen || stats.Trips != 1 {
+		t.Fatalf("failed probe did not reopen the circuit: %+v", stats)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	fake.down = false
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Fatalf("successful probe: %v", err)
+	}
+	if stats := cb.Stats(); stats.State != BreakerClosed || stats.ConsecutiveFailures != 0 {
+		t.Fatalf("successful probe did not close the circuit: %+v", stats)
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Millisecond)
+	ctx := context.Background()
+	cb.record(ctx, errFakeDown, false)
+	time.Sleep(5 * time.Millisecond)
+
+	probe, err := cb.allow()
+	if err != nil || !probe {
+		t.Fatalf("first command after cooldown: probe %v, err %v", probe, err)
+	}
+	if _, err := cb.allow(); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("second command while probing: got %v", err)
+	}
+
+	// A command sent before the circuit opened finishes while the probe is
+	// still outstanding.
+	cb.record(ctx, nil, false)
+	if _, err := cb.allow(); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("stale completion let a second probe through: got %v", err)
+	}
+	if cb.Stats().State != BreakerHalfOpen {
+		t.Fatalf("stale completion changed the state: %+v", cb.Stats())
+	}
+
+	cb.record(ctx, nil, true)
+	if cb.Stats().State != BreakerClosed {
+		t.Fatalf("probe success did not close the circuit: %+v", cb.Stats())
+	}
+}
+
+func TestBreakerIgnoresCallerDeadlines(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		cb.record(expired, context.DeadlineExceeded, false)
+		cb.record(context.Background(), context.Canceled, false)
+	}
+	if stats := cb.Stats(); stats.State != BreakerClosed || stats.ConsecutiveFailures != 0 {
+		t.Fatalf("caller deadlines counted as Redis failures: %+v", stats)
+	}
+
+	cb.record(context.Background(), errFakeDown, false)
+	cb.record(context.Background(), errFakeDown, false)
+	if cb.Stats().State != BreakerOpen {
+		t.Fatalf("network timeouts did not trip the circuit: %+v", cb.Stats())
+	}
+}
+
+func TestDegradedRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   []int
+	}{
+		{DegradedRateLimitLocal, []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests}},
+		{DegradedRateLimitOpen, []int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}},
+		{DegradedRateLimitClosed, []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}},
+	} {
+		s, fake := newTestServer(t, map[string]string{
+			"DEGRADED_RATE_LIMIT":     tc.policy,
+			"MAX_REQUESTS_PER_MINUTE": "2",
+			"REDIS_BREAKER_THRESHOLD": "1",
+		})
+		rdb := fake.client(s.breaker)
+		s.rdb, s.rateLimiter = rdb, NewRateLimiter(rdb)
+		fake.down = true
+
+		for i, want := range tc.want {
+			r := httptest.NewRequest(http.MethodGet, "/noauth/missing", nil)
+			r.RemoteAddr = "203.0.113.7:5000"
+			w := httptest.NewRecorder()
+			s.Routes().ServeHTTP(w, r)
+			if w.Code != want {
+				t.Errorf("%s: request %d: got status %d, want %d: %s", tc.policy, i, w.Code, want, w.Body)
+			}
+			if want == http.StatusServiceUnavailable && (w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "store.unavailable")) {
+				t.Errorf("%s: request %d: missing Retry-After or error code: %s", tc.policy, i, w.Body)
+			}
+		}
+		if !s.breaker.Degraded() {
+			t.Errorf("%s: breaker did not open", tc.policy)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// WebAuthn encodes attestation objects and public keys in CBOR (RFC 8949).
+// Only the subset authenticators produce is decoded: definite lengths,
+// integers, byte and text strings, arrays, maps and simple values.
+
+const (
+	cborMaxDepth = 16
+
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseCurve     = -1
+	coseX         = -2
+	coseY         = -3
+	coseRSAN      = -1
+	coseRSAE      = -2
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes the first item of data and returns it with the bytes
+// that follow it. Integers decode to int64, maps to map[interface{}]interface{}.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(data) < 1 {
+			return nil, nil, errCBORTruncated
+		}
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25:
+		if len(data) < 2 {
+			return nil, nil, errCBORTruncated
+		}
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26:
+		if len(data) < 4 {
+			return nil, nil, errCBORTruncated
+		}
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27:
+		if len(data) < 8 {
+			return nil, nil, errCBORTruncated
+		}
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		b := make([]byte, arg)
+		copy(b, data[:arg])
+		if major == 3 {
+			return string(b), data[arg:], nil
+		}
+		return b, data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, data = append(items, item), rest
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key")
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], data = value, rest
+		}
+		return m, data, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// coseKey is a credential public key as registered by an authenticator.
+type coseKey struct {
+	Algorithm int64
+	PublicKey crypto.PublicKey
+}
+
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	item, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("cose: key is not a map")
+	}
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseAlgorithm)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == coseAlgES256:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("cose: invalid P-256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("cose: point is not on the curve")
+		}
+		return &coseKey{Algorithm: alg, PublicKey: key}, nil
+	case kty == coseKtyOKP && alg == coseAlgEdDSA:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("cose: invalid Ed25519 key")
+		}
+		return &coseKey{Algorithm: alg, PublicKey: ed25519.PublicKey(x)}, nil
+	case kty == coseKtyRSA && alg == coseAlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("cose: invalid RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &coseKey{Algorithm: alg, PublicKey: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+	}
+	return nil, fmt.Errorf("cose: unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// verify checks sig over signed with the algorithm the key was registered
+// for.
+func (k *coseKey) verify(signed, sig []byte) bool {
+	switch pub := k.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBORTruncated(t *testing.T) {
+	a := newSoftAuthenticator(t, "u1")
+	for name, data := range map[string][]byte{
+		"attestation object": a.attestationObject(),
+		"cose key":           a.coseKey(),
+	} {
+		if _, rest, err := decodeCBOR(data); err != nil || len(rest) != 0 {
+			t.Fatalf("%s: full encoding does not decode: %v", name, err)
+		}
+		for n := 0; n < len(data); n++ {
+			if _, _, err := decodeCBOR(data[:n]); err == nil {
+				t.Errorf("%s truncated to %d of %d bytes decoded without error", name, n, len(data))
+			}
+		}
+	}
+
+	key := a.coseKey()
+	for n := 0; n < len(key); n++ {
+		if _, err := parseCOSEKey(key[:n]); err == nil {
+			t.Errorf("cose key truncated to %d of %d bytes parsed", n, len(key))
+		}
+	}
+
+	s := &Server{config: &Config{WebAuthnRPID: "localhost"}}
+	authData := a.authData(true)
+	if _, err := s.parseAuthenticatorData(authData); err != nil {
+		t.Fatalf("full authenticator data does not parse: %v", err)
+	}
+	for n := 0; n < len(authData); n++ {
+		if _, err := s.parseAuthenticatorData(authData[:n]); err == nil {
+			t.Errorf("authenticator data truncated to %d of %d bytes parsed", n, len(authData))
+		}
+	}
+}
+
+func TestDecodeCBORRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"byte string longer than the input", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"array longer than the input", []byte{0x9a, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"map longer than the input", []byte{0xba, 0xff, 0xff, 0xff, 0xff, 0x01, 0x01}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"negative overflow", []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"tag", []byte{0xc0, 0x60}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"byte string map key", []byte{0xa1, 0x41, 0x00, 0x00}},
+		{"nested too deeply", append(bytes.Repeat([]byte{0x81}, cborMaxDepth+2), 0x00)},
+	} {
+		if _, _, err := decodeCBOR(tc.data); err == nil {
+			t.Errorf("%s: decoded without error", tc.name)
+		}
+	}
+}
+
+func TestParseCOSEKeyRejects(t *testing.T) {
+	a := newSoftAuthenticator(t, "u1")
+	x := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	for _, tc := range []struct {
+		name string
+		key  []cborPair
+	}{
+		{"not a map", nil},
+		{"point not on the curve", []cborPair{{coseKeyType, coseKtyEC2}, {coseAlgorithm, coseAlgES256}, {coseCurve, coseCurveP256}, {coseX, x}, {coseY, x}}},
+		{"short coordinate", []cborPair{{coseKeyType, coseKtyEC2}, {coseAlgorithm, coseAlgES256}, {coseCurve, coseCurveP256}, {coseX, x[:31]}, {coseY, x}}},
+		{"wrong curve", []cborPair{{coseKeyType, coseKtyEC2}, {coseAlgorithm, coseAlgES256}, {coseCurve, 2}, {coseX, x}, {coseY, x}}},
+		{"algorithm of another key type", []cborPair{{coseKeyType, coseKtyEC2}, {coseAlgorithm, coseAlgEdDSA}, {coseCurve, coseCurveEd25519}, {coseX, x}}},
+		{"short RSA modulus", []cborPair{{coseKeyType, coseKtyRSA}, {coseAlgorithm, coseAlgRS256}, {coseRSAN, x}, {coseRSAE, []byte{1, 0, 1}}}},
+	} {
+		data := appendCBOR(nil, "key")
+		if tc.key != nil {
+			data = appendCBOR(nil, tc.key)
+		}
+		if _, err := parseCOSEKey(data); err == nil {
+			t.Errorf("%s: parsed without error", tc.name)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	a := newSoftAuthenticator(f, "u1")
+	f.Add(a.attestationObject())
+	f.Add(a.coseKey())
+	f.Add([]byte{0x9f, 0x01, 0xff})
+	f.Add(bytes.Repeat([]byte{0xa1, 0x01}, 20))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, rest, err := decodeCBOR(data)
+		if err == nil && (len(rest) >= len(data) || !bytes.HasSuffix(data, rest)) {
+			t.Fatalf("decoded item left %d of %d bytes that are not a suffix", len(rest), len(data))
+		}
+		if key, err := parseCOSEKey(data); err == nil && key.PublicKey == nil {
+			t.Fatal("parsed a COSE key without a public key")
+		}
+	})
+}
+
+func FuzzParseAuthenticatorData(f *testing.F) {
+	a := newSoftAuthenticator(f, "u1")
+	f.Add(a.authData(true))
+	f.Add(a.authData(false))
+	s := &Server{config: &Config{WebAuthnRPID: "localhost"}}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		ad, err := s.parseAuthenticatorData(raw)
+		if err != nil {
+			return
+		}
+		if ad.flags&authDataAttested != 0 && (len(ad.credentialID) == 0 || !strings.Contains(string(raw), string(ad.publicKey))) {
+			t.Fatal("attested data parsed without a credential taken from the input")
+		}
+	})
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const cliName = "finura-gateway"
+
+const cliUsage = `Usage: finura-gateway [--config FILE] [--set KEY=VALUE]... [--tenant ID] <command> [arguments]
+
+Commands:
+  serve                               start the gateway (default)
+  sessions list [--user ID] [--username NAME] [--ip IP] [--json]
+  sessions revoke <session-id>... | --user ID
+  sessions purge --yes                remove every session
+  blocks list [--json]
+  blocks add <ip> [--duration 5m]
+  blocks remove <ip>
+  token mint --user ID --username NAME [--roles a,b]
+  token inspect <token>               decode a token without verifying it
+  token verify <token>                verify signature, expiry and session
+  config check                        validate configuration and connectivity
+  config print                        show the effective configuration, secrets redacted
+  keys list
+  keys rotate [--retain 720h]         create a new signing key
+  audit verify                        check the audit hash chain
+
+Settings are read from built-in defaults, then the YAML or TOML file
+named by --config or CONFIG_FILE, then the environment, then --set
+overrides.
+With TENANT_MODE enabled, --tenant selects whose sessions, blocks and
+tokens a command works on.
+`
+
+var errUsage = errors.New("invalid usage")
+
+type cliCommand func(ctx context.Context, args []string, out io.Writer) error
+
+// runCLI dispatches the operator subcommands. Every command except `serve`
+// and `config check` works directly against Redis, so it can be used while
+// the gateway itself is stopped.
+func runCLI(args []string) int {
+	args, err := parseGlobalFlags(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cliName, err)
+		return 2
+	}
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	commands := map[string]map[string]cliCommand{
+		"sessions": {"list": cliSessionsList, "revoke": cliSessionsRevoke, "purge": cliSessionsPurge},
+		"blocks":   {"list": cliBlocksList, "add": cliBlocksAdd, "remove": cliBlocksRemove},
+		"token":    {"mint": cliTokenMint, "inspect": cliTokenInspect, "verify": cliTokenVerify},
+		"config":   {"check": cliConfigCheck, "print": cliConfigPrint},
+		"keys":     {"list": cliKeysList, "rotate": cliKeysRotate},
+		"audit":    {"verify": cliAuditVerify},
+	}
+	// Signing keys, the audit chain and configuration are shared by all tenants.
+	tenantScoped := map[string]bool{"sessions": true, "blocks": true, "token": true}
+
+	switch args[0] {
+	case "serve":
+		err = cliServe()
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		group, ok := commands[args[0]]
+		if !ok || len(args) < 2 {
+			err = errUsage
+			break
+		}
+		cmd, ok := group[args[1]]
+		if !ok {
+			err = errUsage
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if tenantScoped[args[0]] {
+			if ctx, err = cliTenantContext(ctx); err != nil {
+				break
+			}
+		}
+		err = cmd(ctx, args[2:], os.Stdout)
+	}
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cliName, err)
+		return 1
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cliName+" "+name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// cliTenantContext scopes ctx to the tenant named by --tenant, which is
+// required exactly when multi-tenancy is on.
+func cliTenantContext(ctx context.Context) (context.Context, error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return ctx, err
+	}
+	registry := NewTenantRegistry(cfg)
+	if !registry.Enabled() {
+		if configFlags.tenant != "" {
+			return ctx, errors.New("--tenant given but TENANT_MODE is off")
+		}
+		return ctx, nil
+	}
+	if configFlags.tenant == "" {
+		return ctx, fmt.Errorf("--tenant is required when TENANT_MODE is %s", cfg.TenantMode)
+	}
+	tenant, ok := registry.Lookup(configFlags.tenant)
+	if !ok {
+		return ctx, fmt.Errorf("unknown tenant %q", configFlags.tenant)
+	}
+	return withTenant(ctx, tenant), nil
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cliServe() error {
+	server, err := NewServer()
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+	return server.Serve()
+}
+
+func cliSessionsList(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("sessions list")
+	var filter SessionFilter
+	fs.StringVar(&filter.UserID, "user", "", "filter by user ID")
+	fs.StringVar(&filter.Username, "username", "", "filter by username")
+	fs.StringVar(&filter.IPAddress, "ip", "", "filter by IP address")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	sessions, err := server.sessionManager.ListSessions(ctx, filter)
+	if err != nil {
+		return err
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+
+	if *asJSON {
+		return printJSON(out, SessionListResponse{Sessions: sessions, Count: len(sessions)})
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tUSER\tUSERNAME\tIP\tROLES\tLAST SEEN\tTTL")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.SessionID, s.UserID, s.Username, s.IPAddress, strings.Join(s.Roles, ","),
+			s.LastSeen.Format(time.RFC3339), time.Duration(s.TTLSeconds)*time.Second)
+	}
+	return tw.Flush()
+}
+
+func cliSessionsRevoke(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("sessions revoke")
+	userID := fs.String("user", "", "revoke every session of this user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" && fs.NArg() == 0 {
+		return errUsage
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.audit.Close()
+
+	if *userID != "" {
+		revoked, err := server.sessionManager.DeleteUserSessions(ctx, *userID)
+		if err != nil {
+			return err
+		}
+		server.audit.Record(ctx, AuditEvent{
+			Type:   AuditSessionRevoked,
+			UserID: *userID,
+			Detail: fmt.Sprintf("%d sessions of user %s revoked via CLI", revoked, *userID),
+		})
+		fmt.Fprintf(out, "Revoked %d session(s) of user %s\n", revoked, *userID)
+		return nil
+	}
+
+	for _, sessionID := range fs.Args() {
+		session, err := server.sessionManager.GetSession(ctx, sessionID)
+		if err != nil {
+			return fmt.Errorf("session %s: %w", sessionID, err)
+		}
+		if err := server.sessionManager.DeleteSession(ctx, sessionID); err != nil {
+			return err
+		}
+		server.audit.Record(ctx, AuditEvent{
+			Type:      AuditSessionRevoked,
+			UserID:    session.UserID,
+			Username:  session.Username,
+			SessionID: sessionID,
+			Detail:    fmt.Sprintf("session %s of user %s revoked via CLI", sessionID, session.UserID),
+		})
+		fmt.Fprintf(out, "Revoked session %s\n", sessionID)
+	}
+	return nil
+}
+
+func cliSessionsPurge(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("sessions purge")
+	yes := fs.Bool("yes", false, "confirm removing every session")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("refusing to purge all sessions without --yes")
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	purged, err := server.sessionManager.PurgeSessions(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Purged %d session(s)\n", purged)
+	return nil
+}
+
+func cliBlocksList(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("blocks list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	blocks, err := server.rateLimiter.ListBlocks(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(out, BlockListResponse{Blocks: blocks, Count: len(blocks)})
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tBLOCKED AT\tTTL")
+	for _, b := range blocks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", b.IP, b.BlockedAt.Format(time.RFC3339), time.Duration(b.TTLSeconds)*time.Second)
+	}
+	return tw.Flush()
+}
+
+func cliBlocksAdd(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("blocks add")
+	duration := fs.Duration("duration", 0, "block duration (defaults to BLOCK_DURATION_MINUTES)")
+	if err := parseInterspersed(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || net.ParseIP(fs.Arg(0)) == nil {
+		return errUsage
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.audit.Close()
+	if *duration <= 0 {
+		*duration = server.settings().BlockDuration
+	}
+	if err := server.rateLimiter.BlockIP(ctx, fs.Arg(0), *duration); err != nil {
+		return err
+	}
+	server.audit.Record(ctx, AuditEvent{
+		Type:   AuditIPBlocked,
+		IP:     fs.Arg(0),
+		Detail: fmt.Sprintf("blocked via CLI for %s", *duration),
+	})
+	fmt.Fprintf(out, "Blocked %s for %s\n", fs.Arg(0), *duration)
+	return nil
+}
+
+func cliBlocksRemove(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) != 1 || net.ParseIP(args[0]) == nil {
+		return errUsage
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.audit.Close()
+	removed, err := server.rateLimiter.UnblockIP(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%s is not blocked", args[0])
+	}
+	server.audit.Record(ctx, AuditEvent{
+		Type:   AuditIPUnblocked,
+		IP:     args[0],
+		Detail: args[0] + " unblocked via CLI",
+	})
+	fmt.Fprintf(out, "Unblocked %s\n", args[0])
+	return nil
+}
+
+// cliTokenMint creates a real session for the given user, replacing the
+// test token the gateway used to print on every start.
+func cliTokenMint(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("token mint")
+	userID := fs.String("user", "", "user ID")
+	username := fs.String("username", "", "username")
+	roles := fs.String("roles", "user", "comma-separated roles")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" || *username == "" {
+		return errUsage
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	defer server.events.Close()
+	defer server.audit.Close()
+	response, err := server.issueSession(ctx, *userID, *username, strings.Split(*roles, ","), ClientFingerprint{IP: "127.0.0.1"})
+	if err != nil {
+		return err
+	}
+	return printJSON(out, response)
+}
+
+func cliTokenInspect(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	parts := strings.Split(args[0], ".")
+	if len(parts) != 3 {
+		return errors.New("token must have three dot-separated parts")
+	}
+	decoded := make(map[string]interface{})
+	for i, name := range []string{"header", "claims"} {
+		raw, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		decoded[name] = v
+	}
+	return printJSON(out, decoded)
+}
+
+func cliTokenVerify(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(args[0], claims, server.keys.KeyFunc)
+	if err != nil || !token.Valid {
+		return fmt.Errorf("token invalid: %v", err)
+	}
+
+	if tenant, _ := claims["tenant_id"].(string); tenant != tenantID(ctx) {
+		return fmt.Errorf("signature valid but token was issued for tenant %q", tenant)
+	}
+	sessionID, _ := claims["session_id"].(string)
+	userID, _ := claims["user_id"].(string)
+	session, err := server.sessionManager.GetSession(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("signature valid but session %s is not usable: %w", sessionID, err)
+	}
+	if session.UserID != userID {
+		return fmt.Errorf("signature valid but session %s belongs to another user", sessionID)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = envKeyID
+	}
+	fmt.Fprintf(out, "Token valid: user %s (%s), session %s, key %s\n", userID, session.Username, sessionID, kid)
+	return nil
+}
+
+func cliConfigCheck(ctx context.Context, args []string, out io.Writer) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	if len(cfg.JWTSecret) < 32 {
+		problems = append(problems, "JWT_SECRET should be at least 32 characters")
+	}
+
+	rdb, err := newRedisClient(cfg)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		defer rdb.Close()
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			problems = append(problems, fmt.Sprintf("Redis (%s) unreachable: %v", redisDescription(cfg), err))
+		}
+	}
+
+	if err := printJSON(out, redactedConfig(cfg)); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(out, "[FAIL] %s\n", p)
+		}
+		return fmt.Errorf("%d configuration problem(s) found", len(problems))
+	}
+	fmt.Fprintln(out, "[OK] configuration valid")
+	return nil
+}
+
+func cliConfigPrint(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	return printJSON(out, redactedConfig(cfg))
+}
+
+func cliKeysList(ctx context.Context, args []string, out io.Writer) error {
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	keys, err := server.keys.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Current })
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KID\tCURRENT\tEXPIRES IN")
+	for _, k := range keys {
+		expires := "never"
+		if !k.Persistent {
+			expires = k.TTL.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\n", k.KID, k.Current, expires)
+	}
+	return tw.Flush()
+}
+
+func cliKeysRotate(ctx context.Context, args []string, out io.Writer) error {
+	fs := newFlagSet("keys rotate")
+	retain := fs.Duration("retain", refreshTokenTTL, "how long the previous key keeps verifying tokens")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	kid, err := server.keys.Rotate(ctx, *retain)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "New signing key %s is now current; running gateways pick it up within %s\n", kid, keyRefreshInterval)
+	return nil
+}
+
+func cliAuditVerify(ctx context.Context, args []string, out io.Writer) error {
+	server, err := NewServer()
+	if err != nil {
+		return err
+	}
+	result, err := server.audit.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(out, result); err != nil {
+		return err
+	}
+	if !result.Valid {
+		return errors.New("audit chain is broken")
+	}
+	return nil
+}
+
+// parseInterspersed lets flags follow positional arguments, e.g.
+// `blocks add 10.0.0.1 --duration 1h`.
+func parseInterspersed(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return fs.Parse(positional)
+}
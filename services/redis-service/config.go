@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const configWatchInterval = 5 * time.Second
+
+// configFlags holds the global command-line options, the highest-precedence
+// configuration layer. They are set by runCLI before any command runs.
+var configFlags struct {
+	file      string
+	overrides map[string]string
+	tenant    string
+}
+
+// configLoader resolves settings from, in increasing precedence, built-in
+// defaults, the config file, the environment and command-line overrides.
+// Settings are addressed by their environment variable name; the config
+// file, YAML or TOML by extension, uses the same names in lower case,
+// optionally nested on "_".
+type configLoader struct {
+	file      map[string]string
+	overrides map[string]string
+	used      map[string]bool
+	errs      []error
+}
+
+func newConfigLoader(file string, overrides map[string]string) (*configLoader, error) {
+	l := &configLoader{file: map[string]string{}, overrides: overrides, used: map[string]bool{}}
+	if file == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(path.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	flattenConfig("", doc, l.file)
+	return l, nil
+}
+
+func flattenConfig(prefix string, doc map[string]interface{}, out map[string]string) {
+	for key, value := range doc {
+		name := strings.ToUpper(key)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(name, v, out)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[name] = strings.Join(items, ",")
+		case nil:
+			out[name] = ""
+		default:
+			out[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+func (l *configLoader) lookup(key string) (string, bool) {
+	l.used[key] = true
+	if v, ok := l.overrides[key]; ok {
+		return v, true
+	}
+	if v := os.Getenv(key); v != "" {
+		return v, true
+	}
+	if v, ok := l.file[key]; ok && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+func (l *configLoader) str(key, def string) string {
+	if v, ok := l.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// secret reads key directly or, failing that, from the file named by
+// key_FILE, which is how container orchestrators mount secrets.
+func (l *configLoader) secret(key string) string {
+	if v, ok := l.lookup(key); ok {
+		return v
+	}
+	file, ok := l.lookup(key + "_FILE")
+	if !ok {
+		return ""
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s_FILE: %w", key, err))
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (l *configLoader) int(key string, def int) int {
+	v, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not an integer", key, v))
+		return def
+	}
+	return n
+}
+
+func (l *configLoader) bool(key string, def bool) bool {
+	v, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not a boolean", key, v))
+		return def
+	}
+	return b
+}
+
+func (l *configLoader) list(key string, def []string) []string {
+	v, ok := l.lookup(key)
+	if !ok {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// check records err against key, for values that need more than type
+// conversion to parse.
+func (l *configLoader) check(key string, err error) {
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+// unknown reports file settings and overrides that no part of LoadConfig
+// asked for, which are almost always typos.
+func (l *configLoader) unknown() []error {
+	var errs []error
+	for _, layer := range []struct {
+		name   string
+		values map[string]string
+	}{{"config file", l.file}, {"--set", l.overrides}} {
+		keys := make([]string, 0, len(layer.values))
+		for key := range layer.values {
+			if !l.used[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", layer.name, strings.ToLower(key)))
+		}
+	}
+	return errs
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// validate checks the loaded configuration as a whole and reports every
+// problem at once.
+func (c *Config) validate() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.JWTSecret == "" {
+		fail("JWT_SECRET (or JWT_SECRET_FILE) is required")
+	}
+	if !validPort(c.AccessPort) {
+		fail("ACCESS_PORT: %q is not a valid port", c.AccessPort)
+	}
+	if !validPort(c.RedisPort) {
+		fail("REDIS_PORT: %q is not a valid port", c.RedisPort)
+	}
+	switch c.RedisMode {
+	case RedisModeStandalone:
+	case RedisModeSentinel:
+		if c.RedisSentinelMaster == "" {
+			fail("REDIS_SENTINEL_MASTER is required in sentinel mode")
+		}
+	case RedisModeCluster:
+		if c.RedisDB != 0 {
+			fail("REDIS_DB must be 0 in cluster mode")
+		}
+	default:
+		fail("REDIS_MODE: unknown mode %q", c.RedisMode)
+	}
+	switch c.DegradedRateLimit {
+	case DegradedRateLimitLocal, DegradedRateLimitOpen, DegradedRateLimitClosed:
+	default:
+		fail("DEGRADED_RATE_LIMIT: unknown policy %q", c.DegradedRateLimit)
+	}
+	if c.DegradedSessionStale < 0 {
+		fail("DEGRADED_SESSION_STALE_SECONDS must not be negative")
+	}
+	if (c.RedisTLSCertFile == "") != (c.RedisTLSKeyFile == "") {
+		fail("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if c.TLSRedirectPort != "" && !validPort(c.TLSRedirectPort) {
+		fail("TLS_REDIRECT_PORT: %q is not a valid port", c.TLSRedirectPort)
+	}
+	if u, err := url.Parse(c.ProxyTargetURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("PROXY_TARGET_URL: %q is not an absolute http(s) URL", c.ProxyTargetURL)
+	}
+	for _, setting := range []struct {
+		key   string
+		value int64
+	}{
+		{"REDIS_POOL_SIZE", int64(c.RedisPoolSize)},
+		{"REDIS_DIAL_TIMEOUT_MS", int64(c.RedisDialTimeout)},
+		{"REDIS_READ_TIMEOUT_MS", int64(c.RedisReadTimeout)},
+		{"REDIS_WRITE_TIMEOUT_MS", int64(c.RedisWriteTimeout)},
+		{"REDIS_POOL_TIMEOUT_MS", int64(c.RedisPoolTimeout)},
+		{"REDIS_BREAKER_THRESHOLD", int64(c.RedisBreakerThreshold)},
+		{"REDIS_BREAKER_COOLDOWN_SECONDS", int64(c.RedisBreakerCooldown)},
+		{"MAX_REQUESTS_PER_MINUTE", int64(c.MaxRequestsPerMinute)},
+		{"BLOCK_DURATION_MINUTES", int64(c.BlockDuration)},
+		{"SESSION_TTL_HOURS", int64(c.SessionTTL)},
+		{"SESSION_IDLE_TIMEOUT_MINUTES", int64(c.SessionIdleTimeout)},
+		{"SESSION_MAX_LIFETIME_HOURS", int64(c.SessionMaxLifetime)},
+		{"SESSION_SWEEP_INTERVAL_SECONDS", int64(c.SessionSweepInterval)},
+		{"SESSION_BACKUP_SWEEP_INTERVAL_SECONDS", int64(c.SessionBackupSweepInterval)},
+		{"REQUEST_TIMEOUT_SECONDS", int64(c.RequestTimeout)},
+		{"MACHINE_TOKEN_TTL_MINUTES", int64(c.MachineTokenTTL)},
+		{"SCOPED_TOKEN_MAX_TTL_HOURS", int64(c.ScopedTokenMaxTTL)},
+		{"SHARE_LINK_MAX_TTL_HOURS", int64(c.ShareLinkMaxTTL)},
+		{"IMPERSONATION_MAX_LIFETIME_MINUTES", int64(c.ImpersonationMaxLifetime)},
+		{"PASSWORD_MIN_LENGTH", int64(c.PasswordMinLength)},
+		{"PASSWORD_RESET_TTL_MINUTES", int64(c.PasswordResetTTL)},
+		{"EMAIL_VERIFY_TTL_HOURS", int64(c.EmailVerifyTTL)},
+		{"WEBAUTHN_CHALLENGE_TTL_SECONDS", int64(c.WebAuthnChallengeTTL)},
+		{"MAX_BODY_BYTES", c.MaxBodyBytes},
+		{"MAX_AUTH_BODY_BYTES", c.MaxAuthBodyBytes},
+		{"MAX_UPLOAD_BYTES", c.MaxUploadBytes},
+		{"MAX_JSON_DEPTH", int64(c.MaxJSONDepth)},
+	} {
+		if setting.value <= 0 {
+			fail("%s must be positive", setting.key)
+		}
+	}
+	if c.AuditStreamMaxLen < 0 {
+		fail("AUDIT_STREAM_MAXLEN must not be negative")
+	}
+	if c.SessionIdleTimeout > c.SessionMaxLifetime {
+		fail("SESSION_IDLE_TIMEOUT_MINUTES must not exceed SESSION_MAX_LIFETIME_HOURS")
+	}
+	if c.SessionTouchInterval >= c.SessionIdleTimeout {
+		fail("SESSION_TOUCH_INTERVAL_SECONDS must be shorter than the idle timeout")
+	}
+	if c.SessionBindingIPv4Prefix < 0 || c.SessionBindingIPv4Prefix > 32 {
+		fail("SESSION_BINDING_IPV4_PREFIX must be between 0 and 32")
+	}
+	if c.SessionBindingIPv6Prefix < 0 || c.SessionBindingIPv6Prefix > 128 {
+		fail("SESSION_BINDING_IPV6_PREFIX must be between 0 and 128")
+	}
+	switch strings.ToLower(c.EventsBackend) {
+	case "", "none", "memory", "redis":
+	case "kafka":
+		if len(c.KafkaBrokers) == 0 {
+			fail("KAFKA_BROKERS is required for the kafka events backend")
+		}
+		switch strings.ToLower(c.KafkaSASLMechanism) {
+		case "":
+		case KafkaSASLPlain, KafkaSASLScramSHA256, KafkaSASLScramSHA512:
+			if c.KafkaSASLUsername == "" {
+				fail("KAFKA_SASL_USERNAME is required with KAFKA_SASL_MECHANISM")
+			}
+		default:
+			fail("KAFKA_SASL_MECHANISM: unknown mechanism %q", c.KafkaSASLMechanism)
+		}
+	default:
+		fail("EVENTS_BACKEND: unknown backend %q", c.EventsBackend)
+	}
+	if err := c.validateCORS(); err != nil {
+		errs = append(errs, err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		fail("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if len(c.TLSClientIdentities) > 0 && c.TLSClientCAFile == "" {
+		fail("TLS_CLIENT_IDENTITIES requires TLS_CLIENT_CA_FILE")
+	}
+	for _, pattern := range c.ShareLinkPaths {
+		if _, err := path.Match(pattern, "/"); err != nil || !strings.HasPrefix(pattern, "/api/") {
+			fail("SHARE_LINK_PATHS: %q is not a path pattern under /api/", pattern)
+		}
+	}
+	if c.ShareLinkBaseURL != "" {
+		if u, err := url.Parse(c.ShareLinkBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("SHARE_LINK_BASE_URL: %q is not an absolute http(s) URL", c.ShareLinkBaseURL)
+		}
+	}
+	if c.PasswordMinLength > maxPasswordBytes {
+		fail("PASSWORD_MIN_LENGTH must not exceed %d", maxPasswordBytes)
+	}
+	if c.AccountLinkBaseURL != "" {
+		if u, err := url.Parse(c.AccountLinkBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("ACCOUNT_LINK_BASE_URL: %q is not an absolute http(s) URL", c.AccountLinkBaseURL)
+		}
+	}
+	switch strings.ToLower(c.Notifier) {
+	case "", NotifierNone, NotifierLog:
+	case NotifierFile:
+		if c.NotifierFile == "" {
+			fail("NOTIFIER_FILE is required for the file notifier")
+		}
+	case NotifierSMTP:
+		if c.SMTPHost == "" || c.SMTPFrom == "" {
+			fail("SMTP_HOST and SMTP_FROM are required for the smtp notifier")
+		}
+	default:
+		fail("NOTIFIER: unknown notifier %q", c.Notifier)
+	}
+	c.validateWebAuthn(fail)
+	c.validateTenants(fail)
+	return errs
+}
+
+// validateWebAuthn checks that every origin passkeys are used from lies
+// within the relying party ID, as browsers require.
+func (c *Config) validateWebAuthn(fail func(format string, args ...interface{})) {
+	if c.WebAuthnRPID == "" {
+		fail("WEBAUTHN_RP_ID is required")
+		return
+	}
+	if len(c.WebAuthnOrigins) == 0 {
+		fail("WEBAUTHN_ORIGINS is required")
+	}
+	for _, origin := range c.WebAuthnOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			fail("WEBAUTHN_ORIGINS: %q is not an http(s) origin", origin)
+			continue
+		}
+		if host := u.Hostname(); host != c.WebAuthnRPID && !strings.HasSuffix(host, "."+c.WebAuthnRPID) {
+			fail("WEBAUTHN_ORIGINS: %q is not within WEBAUTHN_RP_ID %q", origin, c.WebAuthnRPID)
+		}
+	}
+}
+
+func (c *Config) validateTenants(fail func(format string, args ...interface{})) {
+	switch c.TenantMode {
+	case TenantModeOff:
+		return
+	case TenantModeHost, TenantModeHeader:
+	default:
+		fail("TENANT_MODE: unknown mode %q", c.TenantMode)
+		return
+	}
+	if len(c.Tenants) == 0 {
+		fail("TENANTS is required when TENANT_MODE is %s", c.TenantMode)
+	}
+	if c.TenantMode == TenantModeHeader && c.TenantHeader == "" {
+		fail("TENANT_HEADER is required when TENANT_MODE is header")
+	}
+	hosts := make(map[string]string)
+	for _, tenant := range c.Tenants {
+		if c.TenantMode == TenantModeHost && len(tenant.Hosts) == 0 && c.TenantBaseDomain == "" {
+			fail("TENANTS: tenant %q has no hosts and TENANT_BASE_DOMAIN is not set", tenant.ID)
+		}
+		for _, host := range tenant.Hosts {
+			if other, ok := hosts[host]; ok {
+				fail("TENANTS: host %q is assigned to both %q and %q", host, other, tenant.ID)
+			}
+			hosts[host] = tenant.ID
+		}
+		if tenant.Upstream == "" {
+			continue
+		}
+		if u, err := url.Parse(tenant.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("TENANT_UPSTREAMS: %q is not an absolute http(s) URL", tenant.Upstream)
+		}
+	}
+}
+
+// withReloaded returns a copy of c taking every field tagged reload:"true"
+// from next, together with the names of untagged fields that differ and so
+// only take effect after a restart.
+func (c *Config) withReloaded(next *Config) (*Config, []string, []string) {
+	merged := *c
+	mv := reflect.ValueOf(&merged).Elem()
+	cv := reflect.ValueOf(c).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	t := cv.Type()
+
+	var changed, restart []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "true" {
+			mv.Field(i).Set(nv.Field(i))
+			changed = append(changed, field.Name)
+		} else {
+			restart = append(restart, field.Name)
+		}
+	}
+	return &merged, changed, restart
+}
+
+// settings returns the current configuration including reloaded fields.
+// Code reading a field tagged reload:"true" must go through it rather than
+// s.config, which keeps the values from startup.
+func (s *Server) settings() *Config {
+	return s.live.Load()
+}
+
+func (s *Server) ReloadConfig() error {
+	next, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	merged, changed, restart := s.settings().withReloaded(next)
+	if len(restart) > 0 {
+		log.Printf("[CONFIG] Changes to %s require a restart and were not applied", strings.Join(restart, ", "))
+	}
+	if len(changed) == 0 {
+		log.Printf("[CONFIG] Reloaded, no reloadable settings changed")
+		return nil
+	}
+	s.live.Store(merged)
+	s.bodyLimiter.Update(merged)
+	log.Printf("[CONFIG] Reloaded %s", strings.Join(changed, ", "))
+	return nil
+}
+
+// WatchConfig reloads the configuration on SIGHUP and whenever the config
+// file changes. A failed reload keeps the running configuration.
+func (s *Server) WatchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	file := configFile()
+	var lastMod time.Time
+	if info, err := os.Stat(file); file != "" && err == nil {
+		lastMod = info.ModTime()
+	}
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("[CONFIG] SIGHUP received, reloading")
+		case <-ticker.C:
+			if file == "" {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			log.Printf("[CONFIG] %s changed, reloading", file)
+		}
+		if err := s.ReloadConfig(); err != nil {
+			log.Printf("[CONFIG ERROR] Reload failed, keeping current configuration: %v", err)
+		}
+	}
+}
+
+func configFile() string {
+	if configFlags.file != "" {
+		return configFlags.file
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// parseGlobalFlags consumes the leading --config and --set options shared by
+// all commands and returns the remaining arguments.
+func parseGlobalFlags(args []string) ([]string, error) {
+	overrides := map[string]string{}
+	for len(args) > 0 {
+		arg := args[0]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != "--config" && name != "--set" && name != "--tenant" {
+			break
+		}
+		args = args[1:]
+		if !hasValue {
+			if len(args) == 0 {
+				return nil, errUsage
+			}
+			value, args = args[0], args[1:]
+		}
+		switch name {
+		case "--config":
+			configFlags.file = value
+			continue
+		case "--tenant":
+			configFlags.tenant = value
+			continue
+		}
+		key, setting, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, errors.New("--set expects KEY=VALUE")
+		}
+		overrides[strings.ToUpper(key)] = setting
+	}
+	configFlags.overrides = overrides
+	return args, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"gateway.yaml": `
+port: 9090
+session:
+  ttl_hours: 12
+cors:
+  allowed_origins:
+    - https://app.example.com
+    - https://admin.example.com
+audit:
+  stream_enabled: false
+`,
+		"gateway.toml": `
+port = 9090
+cors_allowed_origins = ["https://app.example.com", "https://admin.example.com"]
+
+[session]
+ttl_hours = 12
+
+[audit]
+stream_enabled = false
+`,
+	}
+	want := map[string]string{
+		"PORT":                 "9090",
+		"SESSION_TTL_HOURS":    "12",
+		"CORS_ALLOWED_ORIGINS": "https://app.example.com,https://admin.example.com",
+		"AUDIT_STREAM_ENABLED": "false",
+	}
+	for name, body := range files {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		l, err := newConfigLoader(file, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(l.file, want) {
+			t.Errorf("%s: got %v, want %v", name, l.file, want)
+		}
+	}
+}
+
+func TestConfigFileTOMLSyntaxError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gateway.toml")
+	if err := os.WriteFile(file, []byte("port = \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newConfigLoader(file, nil); err == nil {
+		t.Fatal("expected a parse error for malformed TOML")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "finura_session"
+	refreshCookieName = "finura_refresh"
+	csrfCookieName    = "finura_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+	refreshCookiePath = "/noauth/refresh"
+)
+
+var (
+	ErrCSRFInvalid     = newAPIError(http.StatusForbidden, "csrf.invalid", "Missing or invalid CSRF token")
+	ErrCookiesDisabled = newAPIError(http.StatusBadRequest, "auth.cookies_disabled", "Cookie sessions are not enabled")
+	ErrRefreshMissing  = newAPIError(http.StatusUnauthorized, "auth.refresh_missing", "Refresh token required")
+)
+
+func parseSameSite(v string) (http.SameSite, error) {
+	switch strings.ToLower(v) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown COOKIE_SAMESITE %q", v)
+}
+
+// requestToken returns the access token from the Authorization header or,
+// when cookie sessions are enabled, from the session cookie. The header
+// wins when both are present.
+func (s *Server) requestToken(r *http.Request) (string, bool, *APIError) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		token, err := extractBearerToken(authHeader)
+		if err != nil {
+			return "", false, ErrAuthInvalidHeader
+		}
+		if token == "" {
+			return "", false, ErrAuthTokenRequired
+		}
+		return token, false, nil
+	}
+	if s.config.CookieSessions {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, true, nil
+		}
+	}
+	return "", false, ErrAuthMissingHeader
+}
+
+// refreshToken is requestToken for the refresh endpoint.
+func (s *Server) refreshToken(r *http.Request) (string, bool, *APIError) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		token, err := extractBearerToken(authHeader)
+		if err != nil {
+			return "", false, ErrAuthInvalidHeader
+		}
+		return token, false, nil
+	}
+	if s.config.CookieSessions {
+		if cookie, err := r.Cookie(refreshCookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, true, nil
+		}
+		return "", false, ErrRefreshMissing
+	}
+	return "", false, ErrAuthMissingHeader
+}
+
+// csrfToken derives the CSRF token for a session, so nothing has to be
+// stored and a token planted for another session never validates.
+func (s *Server) csrfToken(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.JWTSecret))
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF implements the double-submit check: the header must echo the
+// CSRF cookie, and both must be the token derived for this session.
+func (s *Server) validCSRF(r *http.Request, sessionID string) bool {
+	header := r.Header.Get(csrfHeaderName)
+	cookie, err := r.Cookie(csrfCookieName)
+	if header == "" || err != nil || !hmac.Equal([]byte(cookie.Value), []byte(header)) {
+		return false
+	}
+	return hmac.Equal([]byte(header), []byte(s.csrfToken(sessionID)))
+}
+
+func (s *Server) cookie(name, value, path string, maxAge time.Duration, httpOnly bool) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   s.config.CookieDomain,
+		HttpOnly: httpOnly,
+		Secure:   s.config.CookieSecure,
+		SameSite: s.config.CookieSameSite,
+	}
+	if maxAge > 0 {
+		c.MaxAge = int(maxAge.Seconds())
+	} else {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+// setAccessCookies stores the access token and the readable CSRF cookie.
+// The session cookie expires with the access token, after which the client
+// refreshes through the refresh cookie.
+func (s *Server) setAccessCookies(w http.ResponseWriter, token, sessionID string, ttl time.Duration) string {
+	csrf := s.csrfToken(sessionID)
+	http.SetCookie(w, s.cookie(sessionCookieName, token, "/", ttl, true))
+	http.SetCookie(w, s.cookie(csrfCookieName, csrf, "/", refreshTokenTTL, false))
+	return csrf
+}
+
+func (s *Server) setRefreshCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, s.cookie(refreshCookieName, token, refreshCookiePath, refreshTokenTTL, true))
+}
+
+func (s *Server) clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, s.cookie(sessionCookieName, "", "/", 0, true))
+	http.SetCookie(w, s.cookie(csrfCookieName, "", "/", 0, false))
+	http.SetCookie(w, s.cookie(refreshCookieName, "", refreshCookiePath, 0, true))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type cookieLogin struct {
+	session *http.Cookie
+	csrf    *http.Cookie
+	token   string
+}
+
+func loginWithCookies(t *testing.T, s *Server, userID string) cookieLogin {
+	t.Helper()
+	w := postLogin(s, "127.0.0.1:5000", nil, `{"user_id":"`+userID+`","username":"`+userID+`","roles":["member"],"use_cookies":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login %s: got status %d: %s", userID, w.Code, w.Body)
+	}
+	var login cookieLogin
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case sessionCookieName:
+			login.session = c
+		case csrfCookieName:
+			login.csrf = c
+		}
+	}
+	var response LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	login.token = response.CSRFToken
+	if login.session == nil || login.csrf == nil || login.token != login.csrf.Value {
+		t.Fatalf("login %s: missing session or CSRF cookie", userID)
+	}
+	return login
+}
+
+func TestCookieSessionCSRF(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"COOKIE_SESSIONS": "true"})
+	alice := loginWithCookies(t, s, "u1")
+	bob := loginWithCookies(t, s, "u2")
+
+	send := func(method, target string, cookies []*http.Cookie, header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(`{}`))
+		r.RemoteAddr = "127.0.0.1:5000"
+		r.Header.Set("Content-Type", "application/json")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		if header != "" {
+			r.Header.Set(csrfHeaderName, header)
+		}
+		w := httptest.NewRecorder()
+		s.Routes().ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cookies []*http.Cookie
+		header  string
+	}{
+		{"no token", []*http.Cookie{alice.session}, ""},
+		{"header without cookie", []*http.Cookie{alice.session}, alice.token},
+		{"cookie without header", []*http.Cookie{alice.session, alice.csrf}, ""},
+		{"header not matching the cookie", []*http.Cookie{alice.session, alice.csrf}, alice.token + "x"},
+		{"forged pair", []*http.Cookie{alice.session, {Name: csrfCookieName, Value: "forged"}}, "forged"},
+		{"token of another session", []*http.Cookie{alice.session, bob.csrf}, bob.token},
+	} {
+		w := send(http.MethodPost, "/api/logout", tc.cookies, tc.header)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "csrf.invalid") {
+			t.Errorf("%s: got status %d: %s", tc.name, w.Code, w.Body)
+		}
+	}
+
+	if w := send(http.MethodGet, "/api/webauthn/credentials", []*http.Cookie{alice.session}, ""); w.Code != http.StatusOK {
+		t.Errorf("safe request without a CSRF token: got status %d: %s", w.Code, w.Body)
+	}
+	if w := send(http.MethodPost, "/api/logout", []*http.Cookie{alice.session, alice.csrf}, alice.token); w.Code != http.StatusOK {
+		t.Errorf("matching CSRF token: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestBearerRequestsSkipCSRF(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"COOKIE_SESSIONS": "true"})
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+	if w := serveRequest(s, http.MethodPost, "/api/logout", login.Token, `{}`); w.Code != http.StatusOK {
+		t.Errorf("bearer request without a CSRF token: got status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", apiKeyHeader, csrfHeaderName}
+	defaultCORSExposed = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After", "Idempotent-Replayed", impersonationHeader}
+)
+
+// CORSPolicy overrides the allowed origins for every path matching Pattern
+// (same syntax as BodyPolicy). An empty Origins list disables CORS there.
+type CORSPolicy struct {
+	Pattern string
+	Origins []string
+}
+
+// parseCORSPolicies reads route overrides in the form
+// "pattern=origin|origin,..." e.g. "/admin/*=https://ops.finura.app".
+func parseCORSPolicies(raw string) ([]CORSPolicy, error) {
+	var policies []CORSPolicy
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, origins, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid CORS policy %q", entry)
+		}
+		policy := CORSPolicy{Pattern: pattern}
+		if origins != "" {
+			policy.Origins = strings.Split(origins, "|")
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// validateCORSOrigins accepts exact origins and patterns with a single "*"
+// in the host, such as "https://*.finura.app". A bare "*" is only allowed
+// without credentials, since browsers refuse that combination and
+// reflecting any origin instead would expose credentialed responses.
+func validateCORSOrigins(origins []string, credentials bool) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			if credentials {
+				return fmt.Errorf("CORS origin \"*\" cannot be combined with CORS_ALLOW_CREDENTIALS")
+			}
+			continue
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("CORS origin %q may contain at most one wildcard", origin)
+		}
+		u, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid CORS origin %q", origin)
+		}
+		if strings.Contains(origin, "*") && !strings.HasPrefix(u.Host, "wildcard.") {
+			return fmt.Errorf("CORS origin %q must use the wildcard as a leading subdomain", origin)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateCORS() error {
+	if err := validateCORSOrigins(cfg.CORSAllowedOrigins, cfg.CORSAllowCredentials); err != nil {
+		return err
+	}
+	for _, policy := range cfg.CORSPolicies {
+		if err := validateCORSOrigins(policy.Origins, cfg.CORSAllowCredentials); err != nil {
+			return fmt.Errorf("CORS_ROUTES %s: %w", policy.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// CORSMiddleware applies the first route override matching the request
+// path, falling back to the global policy.
+func CORSMiddleware(cfg *Config) func(http.Handler) http.Handler {
+	newHandler := func(origins []string) func(http.Handler) http.Handler {
+		if len(origins) == 0 {
+			return func(next http.Handler) http.Handler { return next }
+		}
+		return cors.Handler(cors.Options{
+			AllowedOrigins:   origins,
+			AllowedMethods:   cfg.CORSAllowedMethods,
+			AllowedHeaders:   cfg.CORSAllowedHeaders,
+			ExposedHeaders:   cfg.CORSExposedHeaders,
+			AllowCredentials: cfg.CORSAllowCredentials,
+			MaxAge:           cfg.CORSMaxAge,
+		})
+	}
+
+	fallback := newHandler(cfg.CORSAllowedOrigins)
+	handlers := make([]func(http.Handler) http.Handler, len(cfg.CORSPolicies))
+	for i, policy := range cfg.CORSPolicies {
+		handlers[i] = newHandler(policy.Origins)
+	}
+
+	return func(next http.Handler) http.Handler {
+		defaultNext := fallback(next)
+		routeNext := make([]http.Handler, len(handlers))
+		for i, h := range handlers {
+			routeNext[i] = h(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i, policy := range cfg.CORSPolicies {
+				if matchRoutePattern(policy.Pattern, r.URL.Path) {
+					routeNext[i].ServeHTTP(w, r)
+					return
+				}
+			}
+			defaultNext.ServeHTTP(w, r)
+		})
+	}
+}
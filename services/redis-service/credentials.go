@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// bcrypt ignores everything after the first 72 bytes.
+	maxPasswordBytes = 72
+
+	tokenPasswordReset = "password_reset"
+	tokenEmailVerify   = "email_verify"
+
+	passwordForgotCooldown = 60 * time.Second
+)
+
+var (
+	ErrInvalidCredentials  = newAPIError(http.StatusUnauthorized, "auth.invalid_credentials", "Invalid user or password")
+	ErrPasswordIncorrect   = newAPIError(http.StatusForbidden, "credentials.password_incorrect", "Current password is incorrect")
+	ErrPasswordWeak        = newAPIError(http.StatusBadRequest, "credentials.password_weak", "Password does not meet the requirements")
+	ErrCredentialNotFound  = newAPIError(http.StatusNotFound, "credentials.not_found", "No credentials for this user")
+	ErrEmailTaken          = newAPIError(http.StatusConflict, "credentials.email_taken", "Email address is used by another user")
+	ErrAccountTokenInvalid = newAPIError(http.StatusBadRequest, "credentials.token_invalid", "Token is invalid, already used or expired")
+	ErrNotifierDisabled    = newAPIError(http.StatusServiceUnavailable, "credentials.notifier_disabled", "No notifier is configured to deliver account email")
+)
+
+// Credential is a user's login identity as owned by the gateway.
+type Credential struct {
+	UserID        string `json:"user_id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	// Roles are granted on login with these credentials; roles in the
+	// login request are never trusted for such users.
+	Roles             []string   `json:"roles"`
+	HasPassword       bool       `json:"has_password"`
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+type credentialRecord struct {
+	Credential
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// accountToken is what a password reset or email verification token
+// stands for. Only a hash of the token itself is stored.
+type accountToken struct {
+	UserID   string    `json:"user_id"`
+	Email    string    `json:"email"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+type CredentialStore struct {
+	rdb redis.UniversalClient
+}
+
+func NewCredentialStore(rdb redis.UniversalClient) *CredentialStore {
+	return &CredentialStore{rdb: rdb}
+}
+
+func credentialKey(ctx context.Context, userID string) string {
+	return tenantKey(ctx, "credentials:{"+userID+"}")
+}
+
+// credentialEmailKey indexes users by email without putting the address
+// itself into key names.
+func credentialEmailKey(ctx context.Context, email string) string {
+	return tenantKey(ctx, "credentials_email:"+hashAPIKeySecret(normalizeEmail(email)))
+}
+
+func accountTokenKey(ctx context.Context, purpose, token string) string {
+	return tenantKey(ctx, "account_token:"+purpose+":"+hashAPIKeySecret(token))
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (cs *CredentialStore) load(ctx context.Context, userID string) (*credentialRecord, error) {
+	data, err := cs.rdb.Get(ctx, credentialKey(ctx, userID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+	var record credentialRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credentials: %w", err)
+	}
+	return &record, nil
+}
+
+// save stores record and moves the email index from previousEmail to the
+// record's current address.
+func (cs *CredentialStore) save(ctx context.Context, record *credentialRecord, previousEmail string) error {
+	record.HasPassword = record.PasswordHash != ""
+	record.UpdatedAt = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+	pipe := cs.rdb.TxPipeline()
+	pipe.Set(ctx, credentialKey(ctx, record.UserID), data, 0)
+	if previousEmail != "" && normalizeEmail(previousEmail) != normalizeEmail(record.Email) {
+		pipe.Del(ctx, credentialEmailKey(ctx, previousEmail))
+	}
+	if record.Email != "" {
+		pipe.Set(ctx, credentialEmailKey(ctx, record.Email), record.UserID, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store credentials: %w", err)
+	}
+	return nil
+}
+
+// FindByEmail returns the credentials registered for email, or nil.
+func (cs *CredentialStore) FindByEmail(ctx context.Context, email string) (*credentialRecord, error) {
+	userID, err := cs.rdb.Get(ctx, credentialEmailKey(ctx, email)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to look up email: %w", err)
+	}
+	record, err := cs.load(ctx, userID)
+	if err != nil || record == nil || normalizeEmail(record.Email) != normalizeEmail(email) {
+		return nil, err
+	}
+	return record, nil
+}
+
+// IssueToken creates a single-use token for purpose that expires after ttl.
+func (cs *CredentialStore) IssueToken(ctx context.Context, purpose string, record *credentialRecord, ttl time.Duration) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	data, err := json.Marshal(accountToken{UserID: record.UserID, Email: record.Email, IssuedAt: time.Now()})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token: %w", err)
+	}
+	if err := cs.rdb.Set(ctx, accountTokenKey(ctx, purpose, token), data, ttl).Err(); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+// ConsumeToken deletes token and returns what it stood for, or nil if it
+// does not exist. A token can therefore only ever be used once.
+func (cs *CredentialStore) ConsumeToken(ctx context.Context, purpose, token string) (*accountToken, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := cs.rdb.GetDel(ctx, accountTokenKey(ctx, purpose, token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to consume token: %w", err)
+	}
+	var t accountToken
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	return &t, nil
+}
+
+func (record *credentialRecord) checkPassword(password string) bool {
+	if record.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)) == nil
+}
+
+func (record *credentialRecord) setPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	now := time.Now()
+	record.PasswordHash = string(hash)
+	record.PasswordChangedAt = &now
+	return nil
+}
+
+func (s *Server) validatePassword(password string) error {
+	if len(password) < s.config.PasswordMinLength {
+		return ErrPasswordWeak.WithDetail(fmt.Sprintf("must be at least %d characters", s.config.PasswordMinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordWeak.WithDetail(fmt.Sprintf("must be at most %d bytes", maxPasswordBytes))
+	}
+	return nil
+}
+
+func (s *Server) accountLinkURL(r *http.Request, page, token string) string {
+	base := s.config.AccountLinkBaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + page + "?token=" + token
+}
+
+// credentialChanged revokes every session of the user after their password
+// changed, and tells them about it.
+func (s *Server) credentialChanged(r *http.Request, record *credentialRecord, reason string) {
+	ctx := r.Context()
+	revoked, err := s.sessionManager.DeleteUserSessions(ctx, record.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke sessions of user %s after password change: %v", record.UserID, err)
+	} else if revoked > 0 {
+		s.publishEvent(ctx, Event{Type: EventSessionRevoked, UserID: record.UserID, Username: record.Username, Reason: "password_changed", Data: map[string]string{
+			"count": strconv.Itoa(revoked),
+		}})
+	}
+	log.Printf("[CREDENTIALS] Password of user %s changed (%s), %d sessions revoked", record.UserID, reason, revoked)
+	s.publishEvent(ctx, Event{
+		Type:      EventPasswordChanged,
+		UserID:    record.UserID,
+		Username:  record.Username,
+		IP:        getClientIP(r),
+		UserAgent: r.UserAgent(),
+		Reason:    reason,
+	})
+	if record.Email != "" {
+		s.notify(Notification{
+			Kind:    "password_changed",
+			To:      record.Email,
+			Subject: "Your Finura password was changed",
+			Body:    "The password of your Finura account was changed and all sessions were signed out.\nIf this was not you, reset your password right away.",
+		})
+	}
+}
+
+func (s *Server) credentialStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if redisFailure(err) {
+		writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+		return
+	}
+	writeError(w, r, ErrInternal)
+}
+
+// ForgotPassword mails a reset link if email belongs to a user. The
+// response is the same either way so it cannot be used to find accounts,
+// and the lookup happens after it is sent so its timing cannot either.
+func (s *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if normalizeEmail(data.Email) == "" {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("email is required"))
+		return
+	}
+
+	ctx := r.Context()
+	accepted := MessageResponse{Message: "If an account exists for this email, a password reset link has been sent"}
+	throttleKey := tenantKey(ctx, "password_forgot:"+hashAPIKeySecret(normalizeEmail(data.Email)))
+	first, err := s.rdb.SetNX(ctx, throttleKey, 1, passwordForgotCooldown).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to throttle password reset: %v", err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	if first {
+		go s.sendPasswordReset(r.Clone(context.WithoutCancel(ctx)), data.Email)
+	}
+	writeJSON(w, http.StatusAccepted, accepted)
+}
+
+// sendPasswordReset does the part of ForgotPassword that depends on whether
+// the account exists, off the request path.
+func (s *Server) sendPasswordReset(r *http.Request, email string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	record, err := s.credentials.FindByEmail(ctx, email)
+	if err != nil {
+		log.Printf("[ERROR] Failed to look up credentials for password reset: %v", err)
+		return
+	}
+	if record == nil {
+		return
+	}
+	token, err := s.credentials.IssueToken(ctx, tokenPasswordReset, record, s.config.PasswordResetTTL)
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue password reset token for user %s: %v", record.UserID, err)
+		return
+	}
+	s.auditRequest(r, AuditPasswordResetRequested, &Claims{UserID: record.UserID, Username: record.Username}, http.StatusAccepted, "")
+	s.notify(Notification{
+		Kind:    "password_reset",
+		To:      record.Email,
+		Subject: "Reset your Finura password",
+		Body: fmt.Sprintf("Use this link to choose a new password. It can be used once and expires in %d minutes.\n\n", int(s.config.PasswordResetTTL.Minutes())) +
+			s.accountLinkURL(r, "/password/reset", token) + "\n\nIf you did not ask for this, you can ignore this message.",
+	})
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// signs the user out everywhere.
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Checked first so a rejected password does not use up the token.
+	if err := s.validatePassword(data.Password); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	token, err := s.credentials.ConsumeToken(ctx, tokenPasswordReset, data.Token)
+	if err != nil {
+		log.Printf("[ERROR] Failed to consume password reset token: %v", err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	var record *credentialRecord
+	if token != nil {
+		record, err = s.credentials.load(ctx, token.UserID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load credentials of user %s: %v", token.UserID, err)
+			s.credentialStoreError(w, r, err)
+			return
+		}
+	}
+	// A reset link dies with any later password change, and with a change
+	// of address since it was sent.
+	if record == nil || normalizeEmail(record.Email) != normalizeEmail(token.Email) ||
+		(record.PasswordChangedAt != nil && record.PasswordChangedAt.After(token.IssuedAt)) {
+		s.auditRequest(r, AuditPasswordResetFailed, nil, ErrAccountTokenInvalid.Status, "invalid reset token")
+		writeError(w, r, ErrAccountTokenInvalid)
+		return
+	}
+
+	if err := record.setPassword(data.Password); err != nil {
+		log.Printf("[ERROR] %v", err)
+		writeError(w, r, ErrInternal)
+		return
+	}
+	// Receiving the link proves control of the address.
+	record.EmailVerified = true
+	if err := s.credentials.save(ctx, record, record.Email); err != nil {
+		log.Printf("[ERROR] Failed to save password of user %s: %v", record.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+
+	s.auditRequest(r, AuditPasswordReset, &Claims{UserID: record.UserID, Username: record.Username}, http.StatusOK, "")
+	s.credentialChanged(r, record, "reset")
+	writeJSON(w, http.StatusOK, MessageResponse{Message: "Password has been reset, please log in again"})
+}
+
+// ChangePassword replaces the caller's password and ends all of their
+// sessions, including the current one.
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.validatePassword(data.NewPassword); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	record, err := s.credentials.load(ctx, claims.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load credentials of user %s: %v", claims.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	if record == nil {
+		writeError(w, r, ErrCredentialNotFound)
+		return
+	}
+	if !record.checkPassword(data.CurrentPassword) {
+		s.auditRequest(r, AuditPasswordChangeFailed, claims, ErrPasswordIncorrect.Status, "current password incorrect")
+		writeError(w, r, ErrPasswordIncorrect)
+		return
+	}
+
+	if err := record.setPassword(data.NewPassword); err != nil {
+		log.Printf("[ERROR] %v", err)
+		writeError(w, r, ErrInternal)
+		return
+	}
+	if err := s.credentials.save(ctx, record, record.Email); err != nil {
+		log.Printf("[ERROR] Failed to save password of user %s: %v", record.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+
+	s.auditRequest(r, AuditPasswordChanged, claims, http.StatusOK, "")
+	s.credentialChanged(r, record, "changed")
+	if s.config.CookieSessions {
+		s.clearSessionCookies(w)
+	}
+	writeJSON(w, http.StatusOK, MessageResponse{Message: "Password changed, please log in again"})
+}
+
+// RequestEmailVerification mails the caller a link to confirm their
+// address.
+func (s *Server) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+
+	ctx := r.Context()
+	record, err := s.credentials.load(ctx, claims.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load credentials of user %s: %v", claims.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	if record == nil || record.Email == "" {
+		writeError(w, r, ErrCredentialNotFound)
+		return
+	}
+	if record.EmailVerified {
+		writeJSON(w, http.StatusOK, MessageResponse{Message: "Email address is already verified"})
+		return
+	}
+	if s.notifier == nil {
+		writeError(w, r, ErrNotifierDisabled)
+		return
+	}
+
+	token, err := s.credentials.IssueToken(ctx, tokenEmailVerify, record, s.config.EmailVerifyTTL)
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue email verification token for user %s: %v", record.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	s.auditRequest(r, AuditEmailVerifyRequested, claims, http.StatusAccepted, "")
+	s.notify(Notification{
+		Kind:    "email_verify",
+		To:      record.Email,
+		Subject: "Confirm your email address for Finura",
+		Body: fmt.Sprintf("Use this link to confirm your email address. It expires in %d hours.\n\n", int(s.config.EmailVerifyTTL.Hours())) +
+			s.accountLinkURL(r, "/email/verify", token),
+	})
+	writeJSON(w, http.StatusAccepted, MessageResponse{Message: "Verification email sent"})
+}
+
+// VerifyEmail marks the address a verification token was sent to as
+// verified.
+func (s *Server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	token, err := s.credentials.ConsumeToken(ctx, tokenEmailVerify, data.Token)
+	if err != nil {
+		log.Printf("[ERROR] Failed to consume email verification token: %v", err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	var record *credentialRecord
+	if token != nil {
+		record, err = s.credentials.load(ctx, token.UserID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load credentials of user %s: %v", token.UserID, err)
+			s.credentialStoreError(w, r, err)
+			return
+		}
+	}
+	if record == nil || normalizeEmail(record.Email) != normalizeEmail(token.Email) {
+		writeError(w, r, ErrAccountTokenInvalid)
+		return
+	}
+
+	record.EmailVerified = true
+	if err := s.credentials.save(ctx, record, record.Email); err != nil {
+		log.Printf("[ERROR] Failed to save credentials of user %s: %v", record.UserID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	log.Printf("[CREDENTIALS] User %s verified their email address", record.UserID)
+	s.auditRequest(r, AuditEmailVerified, &Claims{UserID: record.UserID, Username: record.Username}, http.StatusOK, "")
+	writeJSON(w, http.StatusOK, MessageResponse{Message: "Email address verified"})
+}
+
+// AdminSetCredentials creates or updates the gateway credentials of a
+// user. Setting a password signs the user out everywhere.
+func (s *Server) AdminSetCredentials(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	var data struct {
+		Username string   `json:"username"`
+		Email    string   `json:"email"`
+		Password string   `json:"password"`
+		Roles    []string `json:"roles"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if data.Email != "" {
+		addr, err := mail.ParseAddress(data.Email)
+		if err != nil || addr.Address != strings.TrimSpace(data.Email) {
+			writeError(w, r, ErrRequestInvalidField.WithDetail("email is not a valid address"))
+			return
+		}
+		data.Email = normalizeEmail(data.Email)
+	}
+	if data.Password != "" {
+		if err := s.validatePassword(data.Password); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	record, err := s.credentials.load(ctx, userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load credentials of user %s: %v", userID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if record == nil {
+		if data.Username == "" || len(data.Roles) == 0 {
+			writeError(w, r, ErrRequestInvalidField.WithDetail("username and roles are required for new credentials"))
+			return
+		}
+		record = &credentialRecord{Credential: Credential{UserID: userID}}
+		status = http.StatusCreated
+	}
+	previousEmail := record.Email
+	if data.Username != "" {
+		record.Username = data.Username
+	}
+	if len(data.Roles) > 0 {
+		record.Roles = data.Roles
+	}
+	if data.Email != "" && data.Email != normalizeEmail(record.Email) {
+		owner, err := s.credentials.FindByEmail(ctx, data.Email)
+		if err != nil {
+			log.Printf("[ERROR] Failed to look up email: %v", err)
+			s.credentialStoreError(w, r, err)
+			return
+		}
+		if owner != nil && owner.UserID != userID {
+			writeError(w, r, ErrEmailTaken)
+			return
+		}
+		record.Email, record.EmailVerified = data.Email, false
+	}
+	if data.Password != "" {
+		if err := record.setPassword(data.Password); err != nil {
+			log.Printf("[ERROR] %v", err)
+			writeError(w, r, ErrInternal)
+			return
+		}
+	}
+	if err := s.credentials.save(ctx, record, previousEmail); err != nil {
+		log.Printf("[ERROR] Failed to save credentials of user %s: %v", userID, err)
+		s.credentialStoreError(w, r, err)
+		return
+	}
+
+	log.Printf("[ADMIN] Set credentials of user %s (%s)", userID, record.Username)
+	s.auditRequest(r, AuditCredentialsUpdated, nil, status, fmt.Sprintf("credentials of user %s updated, password set: %t, roles: %s", userID, data.Password != "", strings.Join(record.Roles, " ")))
+	if data.Password != "" && status == http.StatusOK {
+		s.credentialChanged(r, record, "admin")
+	}
+	writeJSON(w, status, record.Credential)
+}
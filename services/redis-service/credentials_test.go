@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminKey = "admin-key-secret"
+
+func setCredentials(t *testing.T, s *Server, userID, body string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPut, "/admin/users/"+userID+"/credentials", strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Admin-Key", testAdminKey)
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+		t.Fatalf("set credentials: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+// waitNotifications returns the notifications written by the test server's
+// file notifier once at least n have arrived.
+func waitNotifications(t *testing.T, s *Server, n int) []Notification {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var notifications []Notification
+		if f, err := os.Open(s.notifier.(*FileNotifier).path); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var n Notification
+				if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+					t.Fatal(err)
+				}
+				notifications = append(notifications, n)
+			}
+			f.Close()
+		}
+		if len(notifications) >= n || time.Now().After(deadline) {
+			return notifications
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoginTakesRolesFromCredentials(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	setCredentials(t, s, "u1", `{"username":"alice","password":"correct horse battery","roles":["member"]}`)
+
+	for _, remote := range []string{"203.0.113.7:5000", "127.0.0.1:5000"} {
+		w := postLogin(s, remote, nil, `{"user_id":"u1","username":"mallory","roles":["administrator"],"password":"correct horse battery"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login from %s: got status %d: %s", remote, w.Code, w.Body)
+		}
+		var response LoginResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		session, err := s.sessionManager.GetSession(context.Background(), response.SessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(session.Roles, []string{"member"}) || session.Username != "alice" {
+			t.Errorf("login from %s: session of %s with roles %v, want alice with the stored roles", remote, session.Username, session.Roles)
+		}
+	}
+}
+
+func TestAdminSetCredentialsRequiresRoles(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	r := httptest.NewRequest(http.MethodPut, "/admin/users/u1/credentials", strings.NewReader(`{"username":"alice","password":"correct horse battery"}`))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Admin-Key", testAdminKey)
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("new credentials without roles: got status %d, want 400", w.Code)
+	}
+}
+
+func TestForgotPasswordIndistinguishable(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	setCredentials(t, s, "u1", `{"username":"alice","email":"alice@example.com","roles":["member"]}`)
+
+	known := serveRequest(s, http.MethodPost, "/noauth/password/forgot", "", `{"email":"alice@example.com"}`)
+	unknown := serveRequest(s, http.MethodPost, "/noauth/password/forgot", "", `{"email":"nobody@example.com"}`)
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Fatalf("responses differ: %d %q and %d %q", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+
+	notifications := waitNotifications(t, s, 1)
+	if len(notifications) != 1 || notifications[0].Kind != "password_reset" || notifications[0].To != "alice@example.com" {
+		t.Fatalf("got notifications %+v, want one reset link to alice", notifications)
+	}
+}
+
+func TestChangePasswordRejectsScopedToken(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	setCredentials(t, s, "u1", `{"username":"alice","password":"correct horse battery","roles":["member"]}`)
+	login := loginToken(t, s, `{"user_id":"u1","password":"correct horse battery"}`)
+
+	w := serveRequest(s, http.MethodPost, "/api/tokens", login.Token, `{"scopes":["*"]}`)
+	var scoped ScopedTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&scoped); err != nil || scoped.Token == "" {
+		t.Fatalf("mint scoped token: got status %d: %v", w.Code, err)
+	}
+	change := `{"current_password":"correct horse battery","new_password":"another long password"}`
+	if w := serveRequest(s, http.MethodPost, "/api/password", scoped.Token, change); w.Code != http.StatusForbidden {
+		t.Fatalf("password change with a scoped token: got status %d, want 403", w.Code)
+	}
+	if w := serveRequest(s, http.MethodPost, "/api/password", login.Token, change); w.Code != http.StatusOK {
+		t.Fatalf("password change with the login token: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestNotifierDisabledByDefault(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	notifier, err := NewNotifier(s.config)
+	if err != nil || notifier != nil {
+		t.Fatalf("default notifier = %v (%v), want none", notifier, err)
+	}
+
+	s.notifier = nil
+	setCredentials(t, s, "u1", `{"username":"alice","email":"alice@example.com","password":"correct horse battery","roles":["member"]}`)
+	login := loginToken(t, s, `{"user_id":"u1","password":"correct horse battery"}`)
+	if w := serveRequest(s, http.MethodPost, "/api/email/verification", login.Token, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("email verification without a notifier: got status %d, want 503", w.Code)
+	}
+}
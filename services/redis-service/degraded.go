@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DegradedRateLimitLocal  = "local"
+	DegradedRateLimitOpen   = "open"
+	DegradedRateLimitClosed = "closed"
+
+	localLimiterMaxEntries = 100000
+)
+
+var ErrStoreUnavailable = newAPIError(http.StatusServiceUnavailable, "store.unavailable", "Session store temporarily unavailable")
+
+// localLimiter is the in-process fallback used while Redis is unreachable.
+// It counts per instance in fixed windows, so the effective limit across a
+// fleet is higher than the configured one; that is the intended trade-off
+// against rejecting everything.
+type localLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*localWindow
+
+	checked  atomic.Uint64
+	rejected atomic.Uint64
+}
+
+type localWindow struct {
+	start time.Time
+	count int
+}
+
+type LocalLimiterStats struct {
+	Checked  uint64 `json:"checked"`
+	Rejected uint64 `json:"rejected"`
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{windows: make(map[string]*localWindow)}
+}
+
+func (l *localLimiter) Allow(ip string, limit int, window time.Duration) *RateLimitResult {
+	now := time.Now()
+	l.mu.Lock()
+	w, ok := l.windows[ip]
+	if !ok || now.Sub(w.start) >= window {
+		if !ok && len(l.windows) >= localLimiterMaxEntries {
+			l.prune(now, window)
+		}
+		w = &localWindow{start: now}
+		l.windows[ip] = w
+	}
+	w.count++
+	count, reset := w.count, w.start.Add(window)
+	l.mu.Unlock()
+
+	l.checked.Add(1)
+	result := &RateLimitResult{Allowed: count <= limit, Remaining: limit - count, ResetTime: reset}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	if !result.Allowed {
+		l.rejected.Add(1)
+		result.RetryAfter = reset.Sub(now)
+	}
+	return result
+}
+
+func (l *localLimiter) prune(now time.Time, window time.Duration) {
+	for ip, w := range l.windows {
+		if now.Sub(w.start) >= window {
+			delete(l.windows, ip)
+		}
+	}
+	if len(l.windows) >= localLimiterMaxEntries {
+		l.windows = make(map[string]*localWindow)
+	}
+}
+
+func (l *localLimiter) Stats() LocalLimiterStats {
+	return LocalLimiterStats{Checked: l.checked.Load(), Rejected: l.rejected.Load()}
+}
+
+// degradedRateLimit applies DEGRADED_RATE_LIMIT when the shared limiter in
+// Redis cannot be consulted.
+func (s *Server) degradedRateLimit(w http.ResponseWriter, r *http.Request, next http.Handler, ip string, err error) {
+	if !errors.Is(err, ErrRedisUnavailable) {
+		log.Printf("[ERROR] Rate limit check failed for IP %s, using %s policy: %v", ip, s.config.DegradedRateLimit, err)
+	}
+
+	switch s.config.DegradedRateLimit {
+	case DegradedRateLimitOpen:
+		next.ServeHTTP(w, r)
+	case DegradedRateLimitClosed:
+		writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+	default:
+		limit := s.rateLimitFor(r.Context())
+		result := s.localLimiter.Allow(ip, limit, time.Minute)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetTime.Unix(), 10))
+		if !result.Allowed {
+			log.Printf("[RATE_LIMITED] IP %s exceeded local rate limit (%d requests/minute) for path %s", ip, limit, r.URL.Path)
+			writeRetryableError(w, r, ErrRateLimitExceeded, result.RetryAfter.Seconds())
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+type HealthResponse struct {
+	Status            string            `json:"status"`
+	Redis             BreakerStats      `json:"redis"`
+	StaleSessionReads uint64            `json:"stale_session_reads"`
+	LocalRateLimit    LocalLimiterStats `json:"local_rate_limit"`
+}
+
+func (s *Server) AdminHealth(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if s.breaker.Degraded() {
+		status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{
+		Status:            status,
+		Redis:             s.breaker.Stats(),
+		StaleSessionReads: s.sessionManager.cache.staleReadCount(),
+		LocalRateLimit:    s.localLimiter.Stats(),
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// APIError is an error returned to clients as an RFC 7807 problem document.
+// Code is a stable, machine-readable identifier the frontend can switch on.
+type APIError struct {
+	Status int
+	Code   string
+	Title  string
+	Detail string
+}
+
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+var (
+	ErrAuthMissingHeader   = newAPIError(http.StatusUnauthorized, "auth.missing_header", "Missing Authorization header")
+	ErrAuthInvalidHeader   = newAPIError(http.StatusUnauthorized, "auth.invalid_header", "Invalid Authorization header format")
+	ErrAuthTokenInvalid    = newAPIError(http.StatusUnauthorized, "auth.token_invalid", "Invalid token")
+	ErrAuthTokenExpired    = newAPIError(http.StatusUnauthorized, "auth.token_expired", "Token has expired")
+	ErrAuthTokenRequired   = newAPIError(http.StatusBadRequest, "auth.token_required", "Token is required")
+	ErrAuthRefreshInvalid  = newAPIError(http.StatusUnauthorized, "auth.refresh_invalid", "Invalid or expired refresh token")
+	ErrAuthContextMissing  = newAPIError(http.StatusInternalServerError, "auth.context_missing", "Authentication context missing")
+	ErrAuthCallerUntrusted = newAPIError(http.StatusForbidden, "auth.caller_untrusted", "Caller is not allowed to assert user identities")
+
+	ErrSessionNotFound       = newAPIError(http.StatusNotFound, "session.not_found", "Session not found")
+	ErrSessionInvalid        = newAPIError(http.StatusUnauthorized, "session.invalid", "Session expired or invalid")
+	ErrSessionExpired        = newAPIError(http.StatusUnauthorized, "session.expired", "Session reached its maximum lifetime, please log in again")
+	ErrSessionMismatch       = newAPIError(http.StatusUnauthorized, "session.mismatch", "Session validation failed")
+	ErrSessionCreateFailed   = newAPIError(http.StatusInternalServerError, "session.create_failed", "Failed to create session")
+	ErrSessionDeleteFailed   = newAPIError(http.StatusInternalServerError, "session.delete_failed", "Failed to logout")
+	ErrSessionContextMissing = newAPIError(http.StatusInternalServerError, "session.context_missing", "Session context missing")
+	ErrTokenCreateFailed     = newAPIError(http.StatusInternalServerError, "token.create_failed", "Failed to create authentication token")
+
+	ErrRateLimitExceeded = newAPIError(http.StatusTooManyRequests, "ratelimit.exceeded", "Rate limit exceeded")
+	ErrRateLimitBlocked  = newAPIError(http.StatusTooManyRequests, "ratelimit.ip_blocked", "IP temporarily blocked due to rate limit violations")
+
+	ErrRequestInvalidJSON     = newAPIError(http.StatusBadRequest, "request.invalid_json", "Invalid JSON format")
+	ErrRequestInvalidForm     = newAPIError(http.StatusBadRequest, "request.invalid_form", "Invalid form body")
+	ErrRequestJSONTooDeep     = newAPIError(http.StatusBadRequest, "request.json_too_deep", "JSON body nested too deeply")
+	ErrRequestInvalidField    = newAPIError(http.StatusBadRequest, "request.invalid_field", "Invalid request field")
+	ErrRequestBodyTooLarge    = newAPIError(http.StatusRequestEntityTooLarge, "request.body_too_large", "Request body too large")
+	ErrRequestUnsupportedType = newAPIError(http.StatusUnsupportedMediaType, "request.unsupported_media_type", "Unsupported content type")
+	ErrRequestReadFailed      = newAPIError(http.StatusBadRequest, "request.read_failed", "Failed to read request body")
+	ErrRequestPathInvalid     = newAPIError(http.StatusBadRequest, "request.path_invalid", "Request path must be canonical")
+	ErrRequestNotFound        = newAPIError(http.StatusNotFound, "request.not_found", "Not found")
+	ErrRequestMethod          = newAPIError(http.StatusMethodNotAllowed, "request.method_not_allowed", "Method not allowed")
+
+	ErrIdempotencyKeyTooLong = newAPIError(http.StatusBadRequest, "idempotency.key_too_long", "Idempotency-Key too long")
+	ErrIdempotencyInProgress = newAPIError(http.StatusConflict, "idempotency.in_progress", "Request with this idempotency key is still in progress")
+	ErrIdempotencyMismatch   = newAPIError(http.StatusUnprocessableEntity, "idempotency.mismatch", "Idempotency key was already used with a different request")
+
+	ErrUpstreamUnavailable = newAPIError(http.StatusBadGateway, "upstream.unavailable", "Upstream service unavailable")
+	ErrUpstreamTimeout     = newAPIError(http.StatusGatewayTimeout, "upstream.timeout", "Upstream service timed out")
+
+	ErrInternal = newAPIError(http.StatusInternalServerError, "internal.error", "Internal server error")
+)
+
+func newAPIError(status int, code, title string) *APIError {
+	return &APIError{Status: status, Code: code, Title: title}
+}
+
+func (e *APIError) Error() string {
+	if e.Detail != "" {
+		return e.Code + ": " + e.Detail
+	}
+	return e.Code + ": " + e.Title
+}
+
+// Is matches on Code so errors carrying a detail still compare equal to the
+// predefined value.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+func (e *APIError) WithDetail(detail string) *APIError {
+	c := *e
+	c.Detail = detail
+	return &c
+}
+
+// tokenError maps a JWT parsing error onto the matching API error.
+func tokenError(err error) *APIError {
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return ErrAuthTokenExpired
+	}
+	return ErrAuthTokenInvalid
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = ErrInternal
+	}
+
+	problem := Problem{
+		Type:   "urn:finura:error:" + apiErr.Code,
+		Title:  apiErr.Title,
+		Status: apiErr.Status,
+		Detail: apiErr.Detail,
+		Code:   apiErr.Code,
+	}
+	if r != nil {
+		problem.Instance = r.URL.Path
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func writeRetryableError(w http.ResponseWriter, r *http.Request, err error, retryAfterSeconds float64) {
+	w.Header().Set("Retry-After", strconv.FormatFloat(retryAfterSeconds, 'f', 0, 64))
+	writeError(w, r, err)
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, ErrRequestNotFound)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, ErrRequestMethod)
+}
+
+// Recoverer replaces chi's middleware.Recoverer so panics are reported with
+// the same problem+json body as every other error.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				if rvr == http.ErrAbortHandler {
+					panic(rvr)
+				}
+				log.Printf("[PANIC] %v\n%s", rvr, debug.Stack())
+				if r.Header.Get("Connection") != "Upgrade" {
+					writeError(w, r, ErrInternal)
+				}
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EventSchemaVersion = 1
+
+	EventSessionCreated    = "session.created"
+	EventSessionRevoked    = "session.revoked"
+	EventSessionExpired    = "session.expired"
+	EventBindingMismatch   = "session.binding_mismatch"
+	EventLoginFailed       = "login.failed"
+	EventIPBlocked         = "ip.blocked"
+	EventRateLimitExceeded = "ratelimit.exceeded"
+	EventPasswordChanged   = "password.changed"
+)
+
+// Event is the versioned envelope published for other services such as the
+// notification-service. Fields are only ever added within a schema version.
+type Event struct {
+	SchemaVersion int               `json:"schema_version"`
+	ID            string            `json:"id"`
+	Type          string            `json:"type"`
+	Time          time.Time         `json:"time"`
+	TenantID      string            `json:"tenant_id,omitempty"`
+	UserID        string            `json:"user_id,omitempty"`
+	Username      string            `json:"username,omitempty"`
+	SessionID     string            `json:"session_id,omitempty"`
+	IP            string            `json:"ip,omitempty"`
+	UserAgent     string            `json:"user_agent,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+	Data          map[string]string `json:"data,omitempty"`
+}
+
+type EventPublisher interface {
+	Publish(ctx context.Context, event Event) error
+	Close() error
+}
+
+type NoopPublisher struct{}
+
+func (NoopPublisher) Publish(ctx context.Context, event Event) error { return nil }
+func (NoopPublisher) Close() error                                   { return nil }
+
+// MemoryPublisher keeps published events in memory; it is meant for tests
+// and local development.
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (mp *MemoryPublisher) Publish(ctx context.Context, event Event) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.events = append(mp.events, event)
+	return nil
+}
+
+func (mp *MemoryPublisher) Events() []Event {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return append([]Event(nil), mp.events...)
+}
+
+func (mp *MemoryPublisher) Close() error { return nil }
+
+type RedisStreamPublisher struct {
+	rdb    redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+func NewRedisStreamPublisher(rdb redis.UniversalClient, stream string, maxLen int64) *RedisStreamPublisher {
+	return &RedisStreamPublisher{rdb: rdb, stream: stream, maxLen: maxLen}
+}
+
+func (rp *RedisStreamPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	err = rp.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: rp.stream,
+		MaxLen: rp.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"type":           event.Type,
+			"schema_version": event.SchemaVersion,
+			"payload":        payload,
+		},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+	return nil
+}
+
+func (rp *RedisStreamPublisher) Close() error { return nil }
+
+// asyncPublisher decouples request handling from the backend: events are
+// queued and delivered by a single worker, and dropped when the queue is full.
+type asyncPublisher struct {
+	backend EventPublisher
+	queue   chan Event
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncPublisher(backend EventPublisher, size int) *asyncPublisher {
+	ap := &asyncPublisher{
+		backend: backend,
+		queue:   make(chan Event, size),
+		done:    make(chan struct{}),
+	}
+	go ap.run()
+	return ap
+}
+
+func (ap *asyncPublisher) run() {
+	defer close(ap.done)
+	for event := range ap.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := ap.backend.Publish(ctx, event); err != nil {
+			log.Printf("[EVENTS ERROR] Failed to publish %s event: %v", event.Type, err)
+		}
+		cancel()
+	}
+}
+
+func (ap *asyncPublisher) Publish(ctx context.Context, event Event) error {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	if ap.closed {
+		return errors.New("event publisher closed")
+	}
+	select {
+	case ap.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("event queue full")
+	}
+}
+
+func (ap *asyncPublisher) Close() error {
+	ap.mu.Lock()
+	if ap.closed {
+		ap.mu.Unlock()
+		return nil
+	}
+	ap.closed = true
+	close(ap.queue)
+	ap.mu.Unlock()
+	<-ap.done
+	return ap.backend.Close()
+}
+
+func NewEventPublisher(rdb redis.UniversalClient, cfg *Config) (EventPublisher, error) {
+	var backend EventPublisher
+	switch strings.ToLower(cfg.EventsBackend) {
+	case "", "none":
+		return NoopPublisher{}, nil
+	case "memory":
+		// Appending to a slice never blocks, and returning the publisher
+		// itself keeps Events reachable.
+		return NewMemoryPublisher(), nil
+	case "redis":
+		backend = NewRedisStreamPublisher(rdb, cfg.EventsStreamKey, cfg.EventsStreamMaxLen)
+	case "kafka":
+		if len(cfg.KafkaBrokers) == 0 {
+			return nil, fmt.Errorf("KAFKA_BROKERS is required for the kafka events backend")
+		}
+		kafkaPublisher, err := NewKafkaPublisher(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backend = kafkaPublisher
+	default:
+		return nil, fmt.Errorf("unknown EVENTS_BACKEND %q", cfg.EventsBackend)
+	}
+	return newAsyncPublisher(backend, 1024), nil
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) publishLoginFailed(r *http.Request, identity *Claims, reason string) {
+	event := Event{Type: EventLoginFailed, IP: getClientIP(r), UserAgent: r.UserAgent(), Reason: reason}
+	if identity != nil {
+		event.UserID, event.Username = identity.UserID, identity.Username
+	}
+	s.publishEvent(r.Context(), event)
+}
+
+func (s *Server) publishEvent(ctx context.Context, event Event) {
+	event.SchemaVersion = EventSchemaVersion
+	event.ID = newEventID()
+	event.Time = time.Now().UTC()
+	if event.TenantID == "" {
+		event.TenantID = tenantID(ctx)
+	}
+	if err := s.events.Publish(ctx, event); err != nil {
+		log.Printf("[WARN] Event %s not published: %v", event.Type, err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAsyncPublisherPublishAfterClose(t *testing.T) {
+	backend := NewMemoryPublisher()
+	ap := newAsyncPublisher(backend, 4)
+	if err := ap.Publish(context.Background(), Event{Type: EventSessionCreated}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := ap.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := ap.Publish(context.Background(), Event{Type: EventSessionRevoked}); err == nil {
+		t.Error("publish after close succeeded")
+	}
+	if err := ap.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	if events := backend.Events(); len(events) != 1 || events[0].Type != EventSessionCreated {
+		t.Errorf("got events %+v, want the one published before close", events)
+	}
+}
+
+func TestMemoryEventsBackendIsNotWrapped(t *testing.T) {
+	publisher, err := NewEventPublisher(nil, &Config{EventsBackend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := publisher.(*MemoryPublisher); !ok {
+		t.Fatalf("got %T, want *MemoryPublisher", publisher)
+	}
+}
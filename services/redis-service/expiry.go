@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionExpiredMarkerPrefix = "session_expired:"
+	sessionExpiredMarkerTTL    = time.Hour
+)
+
+// clearUserSessionScript deletes the user_session pointer only while it still
+// points at the given session, so a newer login is never clobbered.
+var clearUserSessionScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// sessionUserID recovers the user ID from a session ID minted by issueSession
+// ("<userID>_<unixnano>"). Expired keys carry no value, so this is the only
+// way to find the secondary index for them.
+func sessionUserID(sessionID string) string {
+	i := strings.LastIndex(sessionID, "_")
+	if i <= 0 {
+		return ""
+	}
+	return sessionID[:i]
+}
+
+func (sm *SessionManager) clearUserSession(ctx context.Context, userID, sessionID string) (bool, error) {
+	n, err := clearUserSessionScript.Run(ctx, sm.rdb, []string{userSessionKey(ctx, userID)}, sessionID).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to clear user session pointer: %w", err)
+	}
+	return n == 1, nil
+}
+
+// enableExpiryNotifications makes sure expired events are published, adding
+// the required flags to whatever the server already has configured. Managed
+// Redis offerings often forbid CONFIG, in which case the current setting is
+// checked instead.
+func enableExpiryNotifications(ctx context.Context, rdb redis.UniversalClient) error {
+	current := ""
+	values, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err == nil {
+		current = values["notify-keyspace-events"]
+	}
+	if hasExpiryFlags(current) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read notify-keyspace-events: %w", err)
+	}
+
+	flags := current
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	if !strings.ContainsAny(flags, "xA") {
+		flags += "x"
+	}
+	if err := rdb.ConfigSet(ctx, "notify-keyspace-events", flags).Err(); err != nil {
+		return fmt.Errorf("failed to enable keyspace notifications: %w", err)
+	}
+	log.Printf("[SESSION EXPIRY] Enabled keyspace notifications (%s)", flags)
+	return nil
+}
+
+func hasExpiryFlags(flags string) bool {
+	return strings.Contains(flags, "E") && strings.ContainsAny(flags, "xA")
+}
+
+// WatchSessionExpiry reacts to expired session keys. It listens for keyspace
+// notifications when they can be enabled and otherwise falls back to
+// periodically reconciling user_session pointers. Notifications are fire and
+// forget, so expirations published while the subscription is down are
+// caught by a sweeper running at the longer backup interval.
+func (s *Server) WatchSessionExpiry(ctx context.Context) {
+	if s.config.SessionExpiryNotifications {
+		// Cluster nodes only publish events for their own keys, so a single
+		// subscription would miss most expirations.
+		if s.config.RedisMode == RedisModeCluster {
+			log.Printf("[SESSION EXPIRY] Keyspace notifications are per node in cluster mode, using sweeper")
+		} else if err := enableExpiryNotifications(ctx, s.rdb); err != nil {
+			log.Printf("[WARN] Keyspace notifications unavailable, using sweeper: %v", err)
+		} else {
+			go s.runSessionSweeper(ctx, s.config.SessionBackupSweepInterval)
+			s.listenSessionExpiry(ctx)
+			return
+		}
+	}
+	s.runSessionSweeper(ctx, s.config.SessionSweepInterval)
+}
+
+func (s *Server) listenSessionExpiry(ctx context.Context) {
+	channel := fmt.Sprintf("__keyevent@%d__:expired", s.config.RedisDB)
+	pubsub := s.rdb.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	log.Printf("[SESSION EXPIRY] Listening on %s", channel)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			id, key := splitTenantKey(msg.Payload)
+			if !strings.HasPrefix(key, "session:") {
+				continue
+			}
+			tctx := ctx
+			if id != "" {
+				tenant, ok := s.tenants.Lookup(id)
+				if !ok {
+					continue
+				}
+				tctx = withTenant(ctx, tenant)
+			}
+			s.handleSessionExpired(tctx, sessionIDFromKey(key))
+		}
+	}
+}
+
+func (s *Server) runSessionSweeper(ctx context.Context, interval time.Duration) {
+	log.Printf("[SESSION EXPIRY] Sweeping every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.sweepSessions(ctx); err != nil {
+				log.Printf("[ERROR] Session sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("[SESSION EXPIRY] Sweep reconciled %d expired sessions", n)
+			}
+		}
+	}
+}
+
+// sweepSessions finds user_session pointers whose session key is gone and
+// handles them as expired.
+func (s *Server) sweepSessions(ctx context.Context) (int, error) {
+	reconciled := 0
+	for _, ctx := range s.tenantContexts(ctx) {
+		err := scanKeys(ctx, s.rdb, tenantKey(ctx, "user_session:*"), func(key string) error {
+			sessionID, err := s.rdb.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			exists, err := s.rdb.Exists(ctx, sessionKey(ctx, sessionID)).Result()
+			if err != nil {
+				return fmt.Errorf("failed to check session %s: %w", sessionID, err)
+			}
+			if exists != 0 {
+				return nil
+			}
+			// A login may have moved the pointer to a new session and
+			// deleted this one since it was read.
+			current, err := s.rdb.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			if current != sessionID {
+				return nil
+			}
+			s.handleSessionExpired(ctx, sessionID)
+			reconciled++
+			return nil
+		})
+		if err != nil {
+			return reconciled, fmt.Errorf("failed to scan user sessions: %w", err)
+		}
+	}
+	return reconciled, nil
+}
+
+// handleSessionExpired cleans up after a session that ended by TTL. Every
+// gateway instance receives the notification, so a short-lived marker makes
+// sure only one of them records the logout.
+func (s *Server) handleSessionExpired(ctx context.Context, sessionID string) {
+	s.sessionManager.cache.delete(tenantKey(ctx, sessionID))
+	userID := sessionUserID(sessionID)
+	if userID == "" {
+		return
+	}
+
+	claimed, err := s.rdb.SetNX(ctx, tenantKey(ctx, sessionExpiredMarkerPrefix+sessionID), 1, sessionExpiredMarkerTTL).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to claim expired session %s: %v", sessionID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if _, err := s.sessionManager.clearUserSession(ctx, userID, sessionID); err != nil {
+		log.Printf("[ERROR] Failed to clean up expired session %s: %v", sessionID, err)
+	}
+
+	log.Printf("[SESSION EXPIRED] %s", sessionID)
+	s.audit.Record(ctx, AuditEvent{
+		Type:      AuditSessionExpired,
+		UserID:    userID,
+		SessionID: sessionID,
+		Detail:    "session timed out",
+	})
+	s.publishEvent(ctx, Event{Type: EventSessionExpired, UserID: userID, SessionID: sessionID, Reason: "timeout"})
+}
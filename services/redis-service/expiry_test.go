@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func expiredEvents(s *Server) int {
+	n := 0
+	for _, event := range s.events.(*MemoryPublisher).Events() {
+		if event.Type == EventSessionExpired {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSweepReportsExpiredSession(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+	login, err := s.issueSession(ctx, "u1", "alice", []string{"member"}, ClientFingerprint{IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.del(sessionKey(ctx, login.SessionID))
+
+	if n, err := s.sweepSessions(ctx); err != nil || n != 1 {
+		t.Fatalf("sweep: reconciled %d, err %v", n, err)
+	}
+	if n := expiredEvents(s); n != 1 {
+		t.Errorf("published %d expiry events, want 1", n)
+	}
+	if _, ok := fake.strings[userSessionKey(ctx, "u1")]; ok {
+		t.Error("pointer to the expired session was left behind")
+	}
+}
+
+func TestSweepIgnoresReplacedSession(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+	first, err := s.issueSession(ctx, "u1", "alice", []string{"member"}, ClientFingerprint{IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new login replaces the session between the sweeper reading the
+	// pointer and checking that the session exists.
+	var second *LoginResponse
+	fake.before = func(name string, args []string) {
+		if name == "exists" && second == nil && args[0] == sessionKey(ctx, first.SessionID) {
+			fake.before = nil
+			second, err = s.issueSession(ctx, "u1", "alice", []string{"member"}, ClientFingerprint{IP: "127.0.0.1"})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if n, err := s.sweepSessions(ctx); err != nil || n != 0 {
+		t.Fatalf("sweep: reconciled %d, err %v", n, err)
+	}
+	if second == nil {
+		t.Fatal("the sweep never checked the first session")
+	}
+	if n := expiredEvents(s); n != 0 {
+		t.Errorf("replaced session reported as expired %d times", n)
+	}
+	if got := fake.strings[userSessionKey(ctx, "u1")]; got != second.SessionID {
+		t.Errorf("pointer names %q, want the new session %q", got, second.SessionID)
+	}
+	if fake.exists(sessionKey(ctx, first.SessionID)) {
+		t.Error("replaced session was not deleted")
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is an in-memory stand-in for the handful of commands the gateway
+// uses, installed as a go-redis hook so no server is needed. Expiry is
+// recorded but not enforced; scripts are emulated by Go functions registered
+// per script.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	ttls    map[string]time.Duration
+	scripts map[string]fakeScript
+	calls   int
+	// before runs ahead of every command, outside the lock, so a test can
+	// interleave its own requests with the code under test.
+	before func(name string, args []string)
+	// down makes every command fail as if Redis could not be reached.
+	down bool
+}
+
+type fakeScript func(f *fakeRedis, keys []string, args []string) (interface{}, error)
+
+var (
+	errFakeWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errFakeDown      = &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+)
+
+func newFakeRedis() *fakeRedis {
+	f := &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		ttls:    make(map[string]time.Duration),
+		scripts: make(map[string]fakeScript),
+	}
+	f.script(touchSessionScript, func(f *fakeRedis, keys, args []string) (interface{}, error) {
+		if _, ok := f.strings[keys[0]]; ok {
+			return nil, errFakeWrongType
+		}
+		hash, ok := f.hashes[keys[0]]
+		if !ok {
+			return int64(0), nil
+		}
+		hash["last_seen"] = args[0]
+		return int64(1), nil
+	})
+	f.script(clearUserSessionScript, func(f *fakeRedis, keys, args []string) (interface{}, error) {
+		if f.strings[keys[0]] != args[0] {
+			return int64(0), nil
+		}
+		return f.del(keys[0]), nil
+	})
+	ownsIdempotencyKey := func(f *fakeRedis, key, owner string) bool {
+		var record IdempotencyRecord
+		current, ok := f.strings[key]
+		return ok && json.Unmarshal([]byte(current), &record) == nil && record.Owner == owner
+	}
+	f.script(completeIdempotencyScript, func(f *fakeRedis, keys, args []string) (interface{}, error) {
+		if !ownsIdempotencyKey(f, keys[0], args[0]) {
+			return int64(0), nil
+		}
+		f.set([]string{keys[0], args[1], "px", args[2]})
+		return int64(1), nil
+	})
+	f.script(releaseIdempotencyScript, func(f *fakeRedis, keys, args []string) (interface{}, error) {
+		if !ownsIdempotencyKey(f, keys[0], args[0]) {
+			return int64(0), nil
+		}
+		return f.del(keys[0]), nil
+	})
+	f.script(useShareLinkScript, func(f *fakeRedis, keys, args []string) (interface{}, error) {
+		link, ok := f.hashes[keys[0]]
+		if !ok {
+			return int64(-1), nil
+		}
+		max, _ := strconv.Atoi(link["max_uses"])
+		uses, _ := strconv.Atoi(link["uses"])
+		if max > 0 && uses >= max {
+			return int64(0), nil
+		}
+		link["uses"] = strconv.Itoa(uses + 1)
+		return int64(1), nil
+	})
+	return f
+}
+
+// client returns a go-redis client served entirely by f. Hooks run before
+// f, so they see every command.
+func (f *fakeRedis) client(hooks ...redis.Hook) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "fake:6379",
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, os.ErrClosed
+		},
+	})
+	for _, hook := range hooks {
+		rdb.AddHook(hook)
+	}
+	rdb.AddHook(f)
+	return rdb
+}
+
+func (f *fakeRedis) script(s *redis.Script, fn fakeScript) {
+	f.scripts[s.Hash()] = fn
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return f.process(cmd)
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var first error
+		if f.down {
+			for _, cmd := range cmds {
+				cmd.SetErr(errFakeDown)
+			}
+			return errFakeDown
+		}
+		for _, cmd := range cmds {
+			switch cmd.Name() {
+			case "multi", "exec":
+				continue
+			}
+			if err := f.process(cmd); err != nil && err != redis.Nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+}
+
+func (f *fakeRedis) process(cmd redis.Cmder) error {
+	if f.before != nil {
+		f.before(cmd.Name(), cmdArgs(cmd))
+	}
+	if f.down {
+		cmd.SetErr(errFakeDown)
+		return errFakeDown
+	}
+	f.mu.Lock()
+	f.calls++
+	val, err := f.do(cmd.Name(), cmdArgs(cmd))
+	f.mu.Unlock()
+	return setFakeResult(cmd, val, err)
+}
+
+func cmdArgs(cmd redis.Cmder) []string {
+	raw := cmd.Args()[1:]
+	args := make([]string, len(raw))
+	for i, arg := range raw {
+		switch v := arg.(type) {
+		case []byte:
+			args[i] = string(v)
+		default:
+			args[i] = fmt.Sprint(v)
+		}
+	}
+	return args
+}
+
+func (f *fakeRedis) do(name string, args []string) (interface{}, error) {
+	switch name {
+	case "ping", "watch", "unwatch":
+		return "OK", nil
+	case "publish":
+		return int64(0), nil
+	case "get", "getdel":
+		if _, ok := f.hashes[args[0]]; ok {
+			return nil, errFakeWrongType
+		}
+		v, ok := f.strings[args[0]]
+		if !ok {
+			return nil, redis.Nil
+		}
+		if name == "getdel" {
+			f.del(args[0])
+		}
+		return v, nil
+	case "set":
+		return f.set(args)
+	case "setnx":
+		return f.set([]string{args[0], args[1], "nx"})
+	case "del", "unlink":
+		var n int64
+		for _, key := range args {
+			n += f.del(key)
+		}
+		return n, nil
+	case "exists":
+		var n int64
+		for _, key := range args {
+			if f.exists(key) {
+				n++
+			}
+		}
+		return n, nil
+	case "expire", "pexpire":
+		if !f.exists(args[0]) {
+			return false, nil
+		}
+		amount, _ := strconv.ParseInt(args[1], 10, 64)
+		unit := time.Second
+		if name == "pexpire" {
+			unit = time.Millisecond
+		}
+		f.ttls[args[0]] = time.Duration(amount) * unit
+		return true, nil
+	case "hset":
+		if _, ok := f.strings[args[0]]; ok {
+			return nil, errFakeWrongType
+		}
+		hash := f.hashes[args[0]]
+		if hash == nil {
+			hash = make(map[string]string)
+			f.hashes[args[0]] = hash
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return added, nil
+	case "hget":
+		v, ok := f.hashes[args[0]][args[1]]
+		if !ok {
+			return nil, redis.Nil
+		}
+		return v, nil
+	case "hgetall":
+		if _, ok := f.strings[args[0]]; ok {
+			return nil, errFakeWrongType
+		}
+		out := make(map[string]string, len(f.hashes[args[0]]))
+		for k, v := range f.hashes[args[0]] {
+			out[k] = v
+		}
+		return out, nil
+	case "hdel":
+		var n int64
+		for _, field := range args[1:] {
+			if _, ok := f.hashes[args[0]][field]; ok {
+				delete(f.hashes[args[0]], field)
+				n++
+			}
+		}
+		if len(f.hashes[args[0]]) == 0 {
+			delete(f.hashes, args[0])
+		}
+		return n, nil
+	case "scan":
+		match := "*"
+		for i := 1; i+1 < len(args); i++ {
+			if strings.EqualFold(args[i], "match") {
+				match = args[i+1]
+			}
+		}
+		var keys []string
+		for _, key := range f.keys() {
+			if ok, _ := path.Match(match, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	case "zadd":
+		zset := f.zsets[args[0]]
+		if zset == nil {
+			zset = make(map[string]float64)
+			f.zsets[args[0]] = zset
+		}
+		var added int64
+		for i := 1; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := zset[args[i+1]]; !ok {
+				added++
+			}
+			zset[args[i+1]] = score
+		}
+		return added, nil
+	case "zcard":
+		return int64(len(f.zsets[args[0]])), nil
+	case "zremrangebyscore":
+		min, _ := strconv.ParseFloat(args[1], 64)
+		max, _ := strconv.ParseFloat(args[2], 64)
+		var n int64
+		for member, score := range f.zsets[args[0]] {
+			if score >= min && score <= max {
+				delete(f.zsets[args[0]], member)
+				n++
+			}
+		}
+		return n, nil
+	case "zrange":
+		members := make([]string, 0, len(f.zsets[args[0]]))
+		for member := range f.zsets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return f.zsets[args[0]][members[i]] < f.zsets[args[0]][members[j]]
+		})
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if stop < 0 || stop >= len(members) {
+			stop = len(members) - 1
+		}
+		if start > stop {
+			return []string{}, nil
+		}
+		return members[start : stop+1], nil
+	case "pttl":
+		if !f.exists(args[0]) {
+			return time.Duration(-2), nil
+		}
+		if ttl, ok := f.ttls[args[0]]; ok {
+			return ttl, nil
+		}
+		return time.Duration(-1), nil
+	case "dump":
+		if v, ok := f.strings[args[0]]; ok {
+			return "string:" + v, nil
+		}
+		if hash, ok := f.hashes[args[0]]; ok {
+			data, _ := json.Marshal(hash)
+			return "hash:" + string(data), nil
+		}
+		return nil, redis.Nil
+	case "restore":
+		if f.exists(args[0]) {
+			return nil, errors.New("BUSYKEY Target key name already exists.")
+		}
+		kind, payload, _ := strings.Cut(args[2], ":")
+		if kind == "hash" {
+			hash := make(map[string]string)
+			if err := json.Unmarshal([]byte(payload), &hash); err != nil {
+				return nil, err
+			}
+			f.hashes[args[0]] = hash
+		} else {
+			f.strings[args[0]] = payload
+		}
+		if ms, _ := strconv.ParseInt(args[1], 10, 64); ms > 0 {
+			f.ttls[args[0]] = time.Duration(ms) * time.Millisecond
+		}
+		return "OK", nil
+	case "evalsha", "eval":
+		sha := args[0]
+		if name == "eval" {
+			sum := sha1.Sum([]byte(args[0]))
+			sha = hex.EncodeToString(sum[:])
+		}
+		fn, ok := f.scripts[sha]
+		if !ok {
+			return nil, fmt.Errorf("fake redis: no emulation for script %s", sha)
+		}
+		n, _ := strconv.Atoi(args[1])
+		return fn(f, args[2:2+n], args[2+n:])
+	}
+	return nil, fmt.Errorf("fake redis: unsupported command %q", name)
+}
+
+func (f *fakeRedis) set(args []string) (interface{}, error) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			if f.exists(key) {
+				return nil, redis.Nil
+			}
+		case "xx":
+			if !f.exists(key) {
+				return nil, redis.Nil
+			}
+		case "ex", "px":
+			amount, _ := strconv.ParseInt(args[i+1], 10, 64)
+			ttl = time.Duration(amount) * time.Second
+			if strings.ToLower(args[i]) == "px" {
+				ttl = time.Duration(amount) * time.Millisecond
+			}
+			i++
+		}
+	}
+	f.del(key)
+	f.strings[key] = value
+	if ttl > 0 {
+		f.ttls[key] = ttl
+	}
+	return "OK", nil
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	_, isString := f.strings[key]
+	_, isHash := f.hashes[key]
+	_, isZSet := f.zsets[key]
+	return isString || isHash || isZSet
+}
+
+func (f *fakeRedis) del(key string) int64 {
+	if !f.exists(key) {
+		return 0
+	}
+	delete(f.strings, key)
+	delete(f.hashes, key)
+	delete(f.zsets, key)
+	delete(f.ttls, key)
+	return 1
+}
+
+func (f *fakeRedis) keys() []string {
+	keys := make([]string, 0, len(f.strings)+len(f.hashes))
+	for key := range f.strings {
+		keys = append(keys, key)
+	}
+	for key := range f.hashes {
+		keys = append(keys, key)
+	}
+	for key := range f.zsets {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func setFakeResult(cmd redis.Cmder, val interface{}, err error) error {
+	if err != nil {
+		if c, ok := cmd.(*redis.BoolCmd); ok && err == redis.Nil {
+			c.SetVal(false)
+			return nil
+		}
+		cmd.SetErr(err)
+		return err
+	}
+	switch c := cmd.(type) {
+	case *redis.StatusCmd:
+		c.SetVal(val.(string))
+	case *redis.StringCmd:
+		c.SetVal(val.(string))
+	case *redis.IntCmd:
+		c.SetVal(val.(int64))
+	case *redis.DurationCmd:
+		c.SetVal(val.(time.Duration))
+	case *redis.BoolCmd:
+		switch v := val.(type) {
+		case bool:
+			c.SetVal(v)
+		case int64:
+			c.SetVal(v == 1)
+		default:
+			c.SetVal(v == "OK")
+		}
+	case *redis.MapStringStringCmd:
+		c.SetVal(val.(map[string]string))
+	case *redis.StringSliceCmd:
+		c.SetVal(val.([]string))
+	case *redis.ScanCmd:
+		c.SetVal(val.([]string), 0)
+	case *redis.Cmd:
+		c.SetVal(val)
+	default:
+		err := fmt.Errorf("fake redis: unsupported result type %T for %s", cmd, cmd.Name())
+		cmd.SetErr(err)
+		return err
+	}
+	return nil
+}
+
+// newTestServer builds a Server from the default configuration plus env,
+// backed by an in-memory fake Redis.
+func newTestServer(tb testing.TB, env map[string]string) (*Server, *fakeRedis) {
+	tb.Setenv("JWT_SECRET", "test-secret-that-is-long-enough-for-hs256")
+	tb.Setenv("EVENTS_BACKEND", "memory")
+	tb.Setenv("AUDIT_STREAM_ENABLED", "false")
+	for key, value := range env {
+		tb.Setenv(key, value)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		tb.Fatalf("load config: %v", err)
+	}
+
+	fake := newFakeRedis()
+	rdb := fake.client()
+	audit, err := NewAuditLogger(rdb, cfg)
+	if err != nil {
+		tb.Fatalf("audit logger: %v", err)
+	}
+	events, err := NewEventPublisher(rdb, cfg)
+	if err != nil {
+		tb.Fatalf("event publisher: %v", err)
+	}
+	s := &Server{
+		rdb:            rdb,
+		rateLimiter:    NewRateLimiter(rdb),
+		sessionManager: NewSessionManager(rdb, cfg.SessionCacheTTL, cfg.DegradedSessionStale),
+		idempotency:    NewIdempotencyStore(rdb),
+		apiKeys:        NewAPIKeyStore(rdb),
+		credentials:    NewCredentialStore(rdb),
+		passkeys:       NewPasskeyStore(rdb),
+		bodyLimiter:    NewBodyLimiter(cfg),
+		keys:           NewKeyRing(rdb, cfg.JWTSecret),
+		audit:          audit,
+		events:         events,
+		notifier:       NewFileNotifier(tb.TempDir() + "/notifications.jsonl"),
+		headers:        NewSecurityHeaders(cfg),
+		breaker:        NewCircuitBreaker(cfg.RedisBreakerThreshold, cfg.RedisBreakerCooldown),
+		localLimiter:   newLocalLimiter(),
+		tenants:        NewTenantRegistry(cfg),
+		config:         cfg,
+	}
+	s.live.Store(cfg)
+	if err := s.keys.Load(context.Background()); err != nil {
+		tb.Fatalf("load keys: %v", err)
+	}
+	tb.Cleanup(func() {
+		audit.Close()
+		events.Close()
+	})
+	return s, fake
+}
+
+// serveRequest sends one request through the full router, authenticated
+// with token if it is not empty.
+func serveRequest(s *Server, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:5000"
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+// loginToken logs a user in through the trusted loopback caller and returns
+// the login response.
+func loginToken(tb testing.TB, s *Server, body string) LoginResponse {
+	tb.Helper()
+	w := postLogin(s, "127.0.0.1:5000", nil, body)
+	if w.Code != http.StatusOK {
+		tb.Fatalf("login: got status %d: %s", w.Code, w.Body)
+	}
+	var response LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		tb.Fatal(err)
+	}
+	return response
+}
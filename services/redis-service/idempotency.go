@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	idempotencyStateProcessing = "processing"
+	idempotencyStateCompleted  = "completed"
+	maxIdempotencyKeyLength    = 255
+)
+
+type IdempotencyStore struct {
+	rdb redis.UniversalClient
+}
+
+type IdempotencyRecord struct {
+	State string `json:"state"`
+	// Owner identifies the request holding a processing record, so a
+	// request whose lock expired cannot overwrite a later holder's record.
+	Owner       string      `json:"owner,omitempty"`
+	RequestHash string      `json:"request_hash"`
+	StatusCode  int         `json:"status_code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// completeIdempotencyScript and releaseIdempotencyScript only act while the
+// record is still the processing record of ARGV[1].
+var completeIdempotencyScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current or cjson.decode(current).owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+var releaseIdempotencyScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current or cjson.decode(current).owner ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+var errIdempotencyLockLost = errors.New("idempotency lock expired before the request finished")
+
+func NewIdempotencyStore(rdb redis.UniversalClient) *IdempotencyStore {
+	return &IdempotencyStore{rdb: rdb}
+}
+
+func idempotencyKey(ctx context.Context, userID, key string) string {
+	return tenantKey(ctx, fmt.Sprintf("idempotency:%s:%s", userID, key))
+}
+
+// Acquire reserves the key for the current request and returns the owner
+// token to pass to Complete or Release. If a record already exists it is
+// returned instead with an empty owner, and the caller must not run the
+// handler.
+func (is *IdempotencyStore) Acquire(ctx context.Context, key, requestHash string, lockTTL time.Duration) (*IdempotencyRecord, string, error) {
+	owner, err := randomHex(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate idempotency owner: %w", err)
+	}
+	record := &IdempotencyRecord{
+		State:       idempotencyStateProcessing,
+		Owner:       owner,
+		RequestHash: requestHash,
+		CreatedAt:   time.Now(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	acquired, err := is.rdb.SetNX(ctx, key, data, lockTTL).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to acquire idempotency key: %w", err)
+	}
+	if acquired {
+		return nil, owner, nil
+	}
+
+	existing, err := is.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return existing, "", nil
+}
+
+func (is *IdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	data, err := is.rdb.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get idempotency record: %w", err)
+	}
+
+	var record IdempotencyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+	return &record, nil
+}
+
+// Complete replaces owner's processing record with the stored response.
+func (is *IdempotencyStore) Complete(ctx context.Context, key, owner string, record *IdempotencyRecord, ttl time.Duration) error {
+	record.State = idempotencyStateCompleted
+	record.Owner = ""
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	stored, err := completeIdempotencyScript.Run(ctx, is.rdb, []string{key}, owner, data, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to store idempotency record: %w", err)
+	}
+	if stored == 0 {
+		return errIdempotencyLockLost
+	}
+	return nil
+}
+
+// Release deletes owner's processing record so the key can be retried.
+func (is *IdempotencyStore) Release(ctx context.Context, key, owner string) error {
+	released, err := releaseIdempotencyScript.Run(ctx, is.rdb, []string{key}, owner).Int()
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	if released == 0 {
+		return errIdempotencyLockLost
+	}
+	return nil
+}
+
+// Wait polls until the record held under key is completed, released or the
+// timeout elapses.
+func (is *IdempotencyStore) Wait(ctx context.Context, key string, timeout time.Duration) (*IdempotencyRecord, error) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		record, err := is.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.State == idempotencyStateCompleted {
+			return record, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrIdempotencyInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func hashIdempotentRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.RawQuery))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status != 0 {
+		return
+	}
+	rr.status = status
+	rr.header = rr.ResponseWriter.Header().Clone()
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, record *IdempotencyRecord) {
+	for name, values := range record.Header {
+		if strings.HasPrefix(name, "X-Ratelimit-") {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+func (s *Server) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, ErrIdempotencyKeyTooLong)
+			return
+		}
+
+		claims, ok := r.Context().Value("user").(*Claims)
+		if !ok {
+			writeError(w, r, ErrAuthContextMissing)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				writeError(w, r, ErrRequestBodyTooLarge)
+				return
+			}
+			writeError(w, r, ErrRequestReadFailed)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		redisKey := idempotencyKey(ctx, claims.UserID, key)
+		requestHash := hashIdempotentRequest(r, body)
+
+		record, owner, err := s.idempotency.Acquire(ctx, redisKey, requestHash, s.config.IdempotencyLockTimeout)
+		if err != nil {
+			log.Printf("[ERROR] Idempotency check failed for user %s: %v", claims.UserID, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if owner == "" {
+			if record != nil && record.RequestHash != requestHash {
+				log.Printf("[IDEMPOTENCY] Key reuse with different request by user %s on %s %s", claims.UserID, r.Method, r.URL.Path)
+				writeError(w, r, ErrIdempotencyMismatch)
+				return
+			}
+
+			if record == nil || record.State != idempotencyStateCompleted {
+				record, err = s.idempotency.Wait(ctx, redisKey, s.config.IdempotencyWaitTimeout)
+				if err != nil || record == nil || record.RequestHash != requestHash {
+					writeRetryableError(w, r, ErrIdempotencyInProgress, 1)
+					return
+				}
+			}
+
+			log.Printf("[IDEMPOTENCY] Replaying stored response for user %s on %s %s", claims.UserID, r.Method, r.URL.Path)
+			replayIdempotentResponse(w, record)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Server errors are not stored so the client can retry with the same key.
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			if err := s.idempotency.Release(context.Background(), redisKey, owner); err != nil {
+				log.Printf("[WARN] Failed to release idempotency key for user %s: %v", claims.UserID, err)
+			}
+			return
+		}
+
+		err = s.idempotency.Complete(context.Background(), redisKey, owner, &IdempotencyRecord{
+			RequestHash: requestHash,
+			StatusCode:  rec.status,
+			Header:      rec.header,
+			Body:        rec.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}, s.config.IdempotencyTTL)
+		if err != nil {
+			log.Printf("[WARN] Failed to store idempotent response for user %s: %v", claims.UserID, err)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpstream answers every request with its running count, failing
+// the first fail requests with a 500.
+func countingUpstream(t *testing.T, fail int32) (*httptest.Server, *int32) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n <= fail {
+			http.Error(w, "upstream failure", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"invoice":%d}`, n)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &calls
+}
+
+func idempotentPost(s *Server, target, token, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	upstream, calls := countingUpstream(t, 0)
+	s, _ := newTestServer(t, map[string]string{"PROXY_TARGET_URL": upstream.URL})
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+
+	first := idempotentPost(s, "/api/invoices", login.Token, "key-1", `{"amount":10}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request: got status %d: %s", first.Code, first.Body)
+	}
+	second := idempotentPost(s, "/api/invoices", login.Token, "key-1", `{"amount":10}`)
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay: got status %d body %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response is not marked Idempotent-Replayed")
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+
+	if w := idempotentPost(s, "/api/invoices", login.Token, "key-2", `{"amount":10}`); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("a new key was answered from another key's record")
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("upstream called %d times after a new key, want 2", n)
+	}
+}
+
+func TestIdempotencyKeyConflict(t *testing.T) {
+	upstream, calls := countingUpstream(t, 0)
+	s, _ := newTestServer(t, map[string]string{"PROXY_TARGET_URL": upstream.URL})
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+
+	if w := idempotentPost(s, "/api/invoices", login.Token, "key-1", `{"amount":10}`); w.Code != http.StatusCreated {
+		t.Fatalf("first request: got status %d: %s", w.Code, w.Body)
+	}
+	for name, target := range map[string]string{
+		"different body":  "/api/invoices",
+		"different query": "/api/invoices?draft=true",
+		"different path":  "/api/receipts",
+	} {
+		body := `{"amount":10}`
+		if name == "different body" {
+			body = `{"amount":99}`
+		}
+		w := idempotentPost(s, target, login.Token, "key-1", body)
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "idempotency.mismatch") {
+			t.Errorf("%s: got status %d: %s", name, w.Code, w.Body)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("upstream called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	upstream, calls := countingUpstream(t, 1)
+	s, _ := newTestServer(t, map[string]string{"PROXY_TARGET_URL": upstream.URL})
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+
+	if w := idempotentPost(s, "/api/invoices", login.Token, "key-1", `{}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("first request: got status %d, want 500", w.Code)
+	}
+	w := idempotentPost(s, "/api/invoices", login.Token, "key-1", `{}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after a server error: got status %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+}
+
+func TestIdempotencyLockOwnership(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+	key := idempotencyKey(ctx, "u1", "key-1")
+
+	_, first, err := s.idempotency.Acquire(ctx, key, "hash", time.Minute)
+	if err != nil || first == "" {
+		t.Fatalf("first acquire: owner %q, err %v", first, err)
+	}
+	if record, owner, err := s.idempotency.Acquire(ctx, key, "hash", time.Minute); err != nil || owner != "" || record == nil || record.State != idempotencyStateProcessing {
+		t.Fatalf("acquire of a held key: owner %q, record %+v, err %v", owner, record, err)
+	}
+
+	// The first lock expires and another request takes the key over.
+	fake.del(key)
+	_, second, err := s.idempotency.Acquire(ctx, key, "hash", time.Minute)
+	if err != nil || second == "" || second == first {
+		t.Fatalf("second acquire: owner %q, err %v", second, err)
+	}
+
+	stale := &IdempotencyRecord{RequestHash: "hash", StatusCode: http.StatusCreated, Body: []byte("stale")}
+	if err := s.idempotency.Complete(ctx, key, first, stale, time.Hour); err != errIdempotencyLockLost {
+		t.Errorf("complete by the expired owner: got %v, want %v", err, errIdempotencyLockLost)
+	}
+	if err := s.idempotency.Release(ctx, key, first); err != errIdempotencyLockLost {
+		t.Errorf("release by the expired owner: got %v, want %v", err, errIdempotencyLockLost)
+	}
+	if record, err := s.idempotency.Get(ctx, key); err != nil || record == nil || record.State != idempotencyStateProcessing {
+		t.Fatalf("expired owner changed the record: %+v, err %v", record, err)
+	}
+
+	fresh := &IdempotencyRecord{RequestHash: "hash", StatusCode: http.StatusCreated, Body: []byte("fresh")}
+	if err := s.idempotency.Complete(ctx, key, second, fresh, time.Hour); err != nil {
+		t.Fatalf("complete by the current owner: %v", err)
+	}
+	record, err := s.idempotency.Get(ctx, key)
+	if err != nil || record == nil || record.State != idempotencyStateCompleted || string(record.Body) != "fresh" {
+		t.Fatalf("completed record: %+v, err %v", record, err)
+	}
+	if err := s.idempotency.Release(ctx, key, second); err != errIdempotencyLockLost {
+		t.Errorf("release of a completed record: got %v, want %v", err, errIdempotencyLockLost)
+	}
+}
+
+func TestHashIdempotentRequest(t *testing.T) {
+	hash := func(method, target, body string) string {
+		return hashIdempotentRequest(httptest.NewRequest(method, target, nil), []byte(body))
+	}
+	base := hash(http.MethodPost, "/api/invoices?a=1", "{}")
+	if base != hash(http.MethodPost, "/api/invoices?a=1", "{}") {
+		t.Fatal("hash is not stable")
+	}
+	for _, other := range []string{
+		hash(http.MethodPut, "/api/invoices?a=1", "{}"),
+		hash(http.MethodPost, "/api/invoices?a=2", "{}"),
+		hash(http.MethodPost, "/api/invoices", "?a=1{}"),
+		hash(http.MethodPost, "/api/invoices?a=1", "{ }"),
+	} {
+		if other == base {
+			t.Error("different requests share a hash")
+		}
+	}
+}
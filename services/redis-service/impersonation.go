@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const impersonationHeader = "X-Impersonated-By"
+
+var ErrImpersonationForbidden = newAPIError(http.StatusForbidden, "auth.impersonation_forbidden", "Not allowed while impersonating a user")
+
+type ImpersonationResponse struct {
+	Token          string    `json:"token"`
+	SessionID      string    `json:"session_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	UserID         string    `json:"user_id"`
+	Username       string    `json:"username"`
+	ImpersonatorID string    `json:"impersonator_id"`
+}
+
+// impersonationDenied reports whether r is off limits to an impersonated
+// session: IMPERSONATION_DENIED_PATHS (credential and 2FA changes by
+// default), minting further credentials in the user's name and managing
+// their passkeys.
+func (s *Server) impersonationDenied(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/tokens", "/api/share-links":
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/webauthn/") {
+		return true
+	}
+	for _, pattern := range s.config.ImpersonationDeniedPaths {
+		if ok, _ := path.Match(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutAdminRoles keeps an administrator from gaining another
+// administrator's rights through impersonation.
+func (s *Server) withoutAdminRoles(roles []string) []string {
+	kept := []string{}
+	for _, role := range roles {
+		admin := false
+		for _, adminRole := range s.config.AdminRoles {
+			if strings.EqualFold(role, adminRole) {
+				admin = true
+			}
+		}
+		if !admin {
+			kept = append(kept, role)
+		}
+	}
+	return kept
+}
+
+func withoutScope(scopes []string, drop string) []string {
+	kept := []string{}
+	for _, scope := range scopes {
+		if scope != drop {
+			kept = append(kept, scope)
+		}
+	}
+	return kept
+}
+
+// targetRoles returns the roles of the user's current session, which is
+// what the user sees, falling back to the roles given by the admin.
+func (s *Server) targetRoles(ctx context.Context, userID string, fallback []string) []string {
+	sessionID, err := s.rdb.Get(ctx, userSessionKey(ctx, userID)).Result()
+	if err == nil {
+		if session, err := s.sessionManager.GetSession(ctx, sessionID); err == nil {
+			return session.Roles
+		}
+	} else if err != redis.Nil {
+		log.Printf("[WARN] Failed to look up current session of user %s: %v", userID, err)
+	}
+	if len(fallback) == 0 {
+		return []string{"user"}
+	}
+	return fallback
+}
+
+// AdminImpersonate creates a short-lived session in which an administrator
+// acts as another user. The session stands alongside the user's own, and
+// every request made with it is audited against the administrator.
+func (s *Server) AdminImpersonate(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		UserID   string   `json:"user_id"`
+		Username string   `json:"username"`
+		Roles    []string `json:"roles"`
+		Reason   string   `json:"reason"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if data.UserID == "" || data.Username == "" || data.Reason == "" {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("user_id, username and reason are required"))
+		return
+	}
+
+	// The shared admin key names no one the audit trail could hold to
+	// account, so impersonation needs an administrator's own session.
+	ctx := r.Context()
+	admin, ok := ctx.Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAPIKeySessionRequired.WithDetail("impersonation requires an administrator session"))
+		return
+	}
+	if admin.ImpersonatorID != "" || admin.UserID == data.UserID {
+		writeError(w, r, ErrImpersonationForbidden.WithDetail("cannot impersonate yourself or from an impersonated session"))
+		return
+	}
+	actorID, actorName := admin.UserID, admin.Username
+
+	now := time.Now()
+	sessionID := fmt.Sprintf("%s_%d", data.UserID, now.UnixNano())
+	session := &UserSession{
+		TenantID:         tenantID(ctx),
+		UserID:           data.UserID,
+		Username:         data.Username,
+		Roles:            s.withoutAdminRoles(s.targetRoles(ctx, data.UserID, data.Roles)),
+		LoginTime:        now,
+		LastSeen:         now,
+		IPAddress:        getClientIP(r),
+		ExpiresAt:        now.Add(s.config.ImpersonationMaxLifetime),
+		UserAgentHash:    hashFingerprint(r.UserAgent()),
+		ImpersonatorID:   actorID,
+		ImpersonatorName: actorName,
+	}
+	if err := s.sessionManager.CreateSession(ctx, sessionID, session, s.config.ImpersonationMaxLifetime); err != nil {
+		log.Printf("[ERROR] Failed to create impersonation session for user %s: %v", data.UserID, err)
+		writeError(w, r, ErrSessionCreateFailed)
+		return
+	}
+
+	claims := &Claims{
+		TenantID:         session.TenantID,
+		UserID:           session.UserID,
+		Username:         session.Username,
+		SessionID:        sessionID,
+		Scopes:           withoutScope(s.scopesForRoles(session.Roles), credentialsScope),
+		ImpersonatorID:   actorID,
+		ImpersonatorName: actorName,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	token, err := s.keys.Sign(claims)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create impersonation token for user %s: %v", data.UserID, err)
+		_ = s.sessionManager.DeleteSession(ctx, sessionID)
+		writeError(w, r, ErrTokenCreateFailed)
+		return
+	}
+
+	log.Printf("[ADMIN] %s (%s) started impersonating user %s (%s) in session %s: %s", actorName, actorID, data.UserID, data.Username, sessionID, data.Reason)
+	s.auditRequest(r, AuditImpersonationStarted, claims, http.StatusCreated, "reason: "+data.Reason)
+	s.publishEvent(ctx, Event{
+		Type:      EventSessionCreated,
+		UserID:    session.UserID,
+		Username:  session.Username,
+		SessionID: sessionID,
+		IP:        session.IPAddress,
+		UserAgent: r.UserAgent(),
+		Reason:    "impersonation",
+		Data:      map[string]string{"impersonator_id": actorID},
+	})
+
+	writeJSON(w, http.StatusCreated, ImpersonationResponse{
+		Token:          token,
+		SessionID:      sessionID,
+		ExpiresAt:      session.ExpiresAt,
+		UserID:         session.UserID,
+		Username:       session.Username,
+		ImpersonatorID: actorID,
+	})
+}
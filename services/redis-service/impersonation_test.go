@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestImpersonateRequiresAdminSession(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": "admin-key-secret"})
+	r := httptest.NewRequest(http.MethodPost, "/admin/impersonate", strings.NewReader(`{"user_id":"u2","username":"bob","reason":"ticket 42"}`))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Admin-Key", "admin-key-secret")
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("impersonation with the admin key: got status %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+func TestImpersonationTokenLacksCredentialsScope(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	admin := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["administrator"]}`)
+
+	w := serveRequest(s, http.MethodPost, "/admin/impersonate", admin.Token, `{"user_id":"u2","username":"bob","reason":"ticket 42"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("impersonate: got status %d: %s", w.Code, w.Body)
+	}
+	var response ImpersonationResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ImpersonatorID != "u1" {
+		t.Errorf("impersonator = %q, want the administrator's user ID", response.ImpersonatorID)
+	}
+
+	claims := &Claims{}
+	if _, err := jwt.ParseWithClaims(response.Token, claims, s.keys.KeyFunc); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(claims.Scopes, credentialsScope) {
+		t.Errorf("impersonation token carries %s: %v", credentialsScope, claims.Scopes)
+	}
+
+	for _, path := range []string{"/api/password", "/api/tokens", "/api/webauthn/register/begin"} {
+		if w := serveRequest(s, http.MethodPost, path, response.Token, `{}`); w.Code != http.StatusForbidden {
+			t.Errorf("%s while impersonating: got status %d, want 403", path, w.Code)
+		}
+	}
+}
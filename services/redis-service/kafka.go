@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	KafkaSASLPlain       = "plain"
+	KafkaSASLScramSHA256 = "scram-sha-256"
+	KafkaSASLScramSHA512 = "scram-sha-512"
+)
+
+// KafkaPublisher produces events with acks from the partition leader.
+// Keys are partitioned with murmur2 like the Java client, so the gateway
+// agrees with other producers on the partition of a user's events.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaPublisher(cfg *Config) (*KafkaPublisher, error) {
+	transport := &kafka.Transport{ClientID: "finura-gateway", DialTimeout: 5 * time.Second}
+	if cfg.KafkaTLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.KafkaTLSCAFile != "" {
+			pool, err := loadCertPool(cfg.KafkaTLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLS = tlsConfig
+	}
+	mechanism, err := kafkaSASLMechanism(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport.SASL = mechanism
+
+	return &KafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(cfg.KafkaBrokers...),
+		Topic:        cfg.KafkaTopic,
+		Balancer:     &kafka.Murmur2Balancer{},
+		RequiredAcks: kafka.RequireOne,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    transport,
+	}}, nil
+}
+
+func kafkaSASLMechanism(cfg *Config) (sasl.Mechanism, error) {
+	switch strings.ToLower(cfg.KafkaSASLMechanism) {
+	case "":
+		return nil, nil
+	case KafkaSASLPlain:
+		return plain.Mechanism{Username: cfg.KafkaSASLUsername, Password: cfg.KafkaSASLPassword}, nil
+	case KafkaSASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.KafkaSASLUsername, cfg.KafkaSASLPassword)
+	case KafkaSASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.KafkaSASLUsername, cfg.KafkaSASLPassword)
+	default:
+		return nil, fmt.Errorf("unknown KAFKA_SASL_MECHANISM %q", cfg.KafkaSASLMechanism)
+	}
+}
+
+func (kp *KafkaPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	// Keying by user keeps every event of one user on the same partition,
+	// so consumers see them in order.
+	key := event.UserID
+	if key == "" {
+		key = event.IP
+	}
+	err = kp.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(key),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(event.Type)},
+			{Key: "schema_version", Value: []byte(fmt.Sprint(event.SchemaVersion))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to produce event: %w", err)
+	}
+	return nil
+}
+
+func (kp *KafkaPublisher) Close() error {
+	return kp.writer.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestKafkaSASLMechanism(t *testing.T) {
+	for _, tc := range []struct {
+		mechanism string
+		name      string
+	}{
+		{KafkaSASLPlain, "PLAIN"},
+		{"SCRAM-SHA-256", "SCRAM-SHA-256"},
+		{KafkaSASLScramSHA512, "SCRAM-SHA-512"},
+	} {
+		cfg := &Config{KafkaSASLMechanism: tc.mechanism, KafkaSASLUsername: "gateway", KafkaSASLPassword: "secret"}
+		mechanism, err := kafkaSASLMechanism(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.mechanism, err)
+		}
+		if mechanism.Name() != tc.name {
+			t.Errorf("%s: got mechanism %s, want %s", tc.mechanism, mechanism.Name(), tc.name)
+		}
+	}
+
+	if mechanism, err := kafkaSASLMechanism(&Config{}); err != nil || mechanism != nil {
+		t.Errorf("no mechanism configured: got %v, %v", mechanism, err)
+	}
+	if _, err := kafkaSASLMechanism(&Config{KafkaSASLMechanism: "gssapi"}); err == nil {
+		t.Error("unknown mechanism was accepted")
+	}
+}
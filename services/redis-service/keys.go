@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	envKeyID           = "env"
+	currentKeyIDKey    = "jwt:current_kid"
+	signingKeyPrefix   = "jwt:key:"
+	keyRefreshInterval = 30 * time.Second
+)
+
+// KeyRing holds the HMAC keys used to sign and verify tokens. JWT_SECRET is
+// always accepted under the "env" key ID; keys created by `keys rotate` live
+// in Redis so every gateway instance picks them up without a restart.
+type KeyRing struct {
+	rdb        redis.UniversalClient
+	mu         sync.RWMutex
+	currentKID string
+	keys       map[string][]byte
+}
+
+type SigningKey struct {
+	KID        string        `json:"kid"`
+	Current    bool          `json:"current"`
+	TTL        time.Duration `json:"ttl"`
+	Persistent bool          `json:"persistent"`
+}
+
+func NewKeyRing(rdb redis.UniversalClient, secret string) *KeyRing {
+	return &KeyRing{
+		rdb:        rdb,
+		currentKID: envKeyID,
+		keys:       map[string][]byte{envKeyID: []byte(secret)},
+	}
+}
+
+func (kr *KeyRing) Load(ctx context.Context) error {
+	keys := map[string][]byte{envKeyID: kr.envSecret()}
+
+	err := scanKeys(ctx, kr.rdb, signingKeyPrefix+"*", func(key string) error {
+		raw, err := kr.rdb.Get(ctx, key).Result()
+		if err != nil {
+			return nil
+		}
+		secret, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil
+		}
+		keys[strings.TrimPrefix(key, signingKeyPrefix)] = secret
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan signing keys: %w", err)
+	}
+
+	currentKID, err := kr.rdb.Get(ctx, currentKeyIDKey).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to get current key id: %w", err)
+	}
+	if _, ok := keys[currentKID]; !ok {
+		currentKID = envKeyID
+	}
+
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.currentKID = currentKID
+	kr.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the key ring periodically until ctx is cancelled.
+func (kr *KeyRing) Watch(ctx context.Context) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := kr.Load(ctx); err != nil {
+				log.Printf("[WARN] Failed to reload signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func (kr *KeyRing) envSecret() []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[envKeyID]
+}
+
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	kr.mu.RLock()
+	kid := kr.currentKID
+	secret := kr.keys[kid]
+	kr.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != envKeyID {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(secret)
+}
+
+// KeyFunc resolves the verification key for a parsed token by its kid
+// header; tokens without one were signed with JWT_SECRET.
+func (kr *KeyRing) KeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = envKeyID
+	}
+
+	kr.mu.RLock()
+	secret, ok := kr.keys[kid]
+	kr.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return secret, nil
+}
+
+// Rotate creates a new signing key and makes it current. The previous key
+// stays valid for retain so outstanding tokens keep working until they
+// expire.
+func (kr *KeyRing) Rotate(ctx context.Context, retain time.Duration) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate key id: %w", err)
+	}
+	kid := hex.EncodeToString(idBytes)
+
+	previous, err := kr.rdb.Get(ctx, currentKeyIDKey).Result()
+	if err != nil && err != redis.Nil {
+		return "", fmt.Errorf("failed to get current key id: %w", err)
+	}
+
+	pipe := kr.rdb.TxPipeline()
+	pipe.Set(ctx, signingKeyPrefix+kid, base64.StdEncoding.EncodeToString(secret), 0)
+	pipe.Set(ctx, currentKeyIDKey, kid, 0)
+	if previous != "" {
+		pipe.Expire(ctx, signingKeyPrefix+previous, retain)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	if err := kr.Load(ctx); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+func (kr *KeyRing) List(ctx context.Context) ([]SigningKey, error) {
+	if err := kr.Load(ctx); err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := make([]SigningKey, 0, len(kr.keys))
+	for kid := range kr.keys {
+		key := SigningKey{KID: kid, Current: kid == kr.currentKID, Persistent: true}
+		if kid != envKeyID {
+			ttl, err := kr.rdb.TTL(ctx, signingKeyPrefix+kid).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get key ttl: %w", err)
+			}
+			if ttl > 0 {
+				key.TTL = ttl
+				key.Persistent = false
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	defaultJSONContentTypes  = []string{"application/json"}
+	defaultProxyContentTypes = []string{"application/json", "multipart/form-data", "application/x-www-form-urlencoded"}
+	formContentTypes         = []string{"application/x-www-form-urlencoded"}
+)
+
+// BodyPolicy limits the size and content type of request bodies for every
+// path matching Pattern. Pattern segments may use path.Match wildcards and a
+// trailing "/*" matches any remaining segments.
+type BodyPolicy struct {
+	Pattern      string
+	MaxBytes     int64
+	ContentTypes []string
+}
+
+type BodyLimiter struct {
+	mu       sync.RWMutex
+	policies []BodyPolicy
+	fallback BodyPolicy
+}
+
+func NewBodyLimiter(cfg *Config) *BodyLimiter {
+	bl := &BodyLimiter{}
+	bl.Update(cfg)
+	return bl
+}
+
+// Update replaces the policies, so route limits can change on config reload.
+func (bl *BodyLimiter) Update(cfg *Config) {
+	policies := []BodyPolicy{
+		// OAuth clients post token requests form-encoded (RFC 6749 section 4.4.2).
+		{Pattern: "/noauth/token", MaxBytes: cfg.MaxAuthBodyBytes, ContentTypes: []string{"application/x-www-form-urlencoded", "application/json"}},
+		{Pattern: "/noauth/*", MaxBytes: cfg.MaxAuthBodyBytes, ContentTypes: defaultJSONContentTypes},
+		{Pattern: "/api/chats/*/image", MaxBytes: cfg.MaxUploadBytes, ContentTypes: []string{"multipart/form-data", "image/*"}},
+	}
+	// Routes from the environment take precedence over the built-in ones.
+	policies = append(append([]BodyPolicy{}, cfg.BodyPolicies...), policies...)
+	bl.mu.Lock()
+	bl.policies = policies
+	// Other proxied routes accept any content type, as before body limits
+	// existed; only explicit route policies restrict it.
+	bl.fallback = BodyPolicy{Pattern: "/*", MaxBytes: cfg.MaxBodyBytes}
+	bl.mu.Unlock()
+}
+
+// parseBodyPolicies reads route policies in the form
+// "pattern=maxBytes[:type|type],..." e.g. "/api/receipts=5242880:multipart/form-data".
+func parseBodyPolicies(raw string) ([]BodyPolicy, error) {
+	var policies []BodyPolicy
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, rest, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid body policy %q", entry)
+		}
+		sizeStr, types, _ := strings.Cut(rest, ":")
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid max bytes in body policy %q", entry)
+		}
+		policy := BodyPolicy{Pattern: pattern, MaxBytes: size, ContentTypes: defaultProxyContentTypes}
+		if types != "" {
+			policy.ContentTypes = strings.Split(types, "|")
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func matchRoutePattern(pattern, urlPath string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i, seg := range patternSegments {
+		if seg == "*" && i == len(patternSegments)-1 {
+			return len(pathSegments) >= len(patternSegments)
+		}
+		if i >= len(pathSegments) {
+			return false
+		}
+		if ok, _ := path.Match(seg, pathSegments[i]); !ok {
+			return false
+		}
+	}
+	return len(pathSegments) == len(patternSegments)
+}
+
+func (bl *BodyLimiter) PolicyFor(urlPath string) BodyPolicy {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	for _, p := range bl.policies {
+		if matchRoutePattern(p.Pattern, urlPath) {
+			return p
+		}
+	}
+	return bl.fallback
+}
+
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if a == "*/*" || strings.EqualFold(a, mediaType) {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRequestBody(r *http.Request) bool {
+	return r.ContentLength > 0 || (r.ContentLength == -1 && r.Body != nil && r.Body != http.NoBody)
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr) || errors.Is(err, ErrRequestBodyTooLarge)
+}
+
+// BodyLimitMiddleware rejects oversized or unexpected bodies up front and
+// wraps the rest in http.MaxBytesReader so streamed uploads are cut off once
+// they pass the route limit.
+func (s *Server) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasRequestBody(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy := s.bodyLimiter.PolicyFor(r.URL.Path)
+
+		if r.ContentLength > policy.MaxBytes {
+			log.Printf("[LIMITS] Rejected %d byte body from IP %s for path %s (max %d)", r.ContentLength, getClientIP(r), r.URL.Path, policy.MaxBytes)
+			writeError(w, r, ErrRequestBodyTooLarge)
+			return
+		}
+
+		if len(policy.ContentTypes) > 0 && !contentTypeAllowed(r.Header.Get("Content-Type"), policy.ContentTypes) {
+			log.Printf("[LIMITS] Rejected content type %q from IP %s for path %s", r.Header.Get("Content-Type"), getClientIP(r), r.URL.Path)
+			writeError(w, r, ErrRequestUnsupportedType)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, policy.MaxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeFormBody parses an application/x-www-form-urlencoded request body,
+// bounded by the body policy of the route. Query parameters are ignored.
+func (s *Server) decodeFormBody(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	if !contentTypeAllowed(r.Header.Get("Content-Type"), formContentTypes) {
+		return nil, ErrRequestUnsupportedType
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.bodyLimiter.PolicyFor(r.URL.Path).MaxBytes)
+	if err := r.ParseForm(); err != nil {
+		if isBodyTooLarge(err) {
+			return nil, ErrRequestBodyTooLarge
+		}
+		return nil, ErrRequestInvalidForm
+	}
+	return r.PostForm, nil
+}
+
+func checkJSONDepth(data []byte, maxDepth int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrRequestInvalidJSON
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxDepth {
+				return ErrRequestJSONTooDeep
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// decodeJSONBody decodes a JSON request body into dst for handlers served by
+// the gateway itself, bounded by the body policy of the route.
+func (s *Server) decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	if !contentTypeAllowed(r.Header.Get("Content-Type"), defaultJSONContentTypes) {
+		return ErrRequestUnsupportedType
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.bodyLimiter.PolicyFor(r.URL.Path).MaxBytes))
+	if err != nil {
+		if isBodyTooLarge(err) {
+			return ErrRequestBodyTooLarge
+		}
+		return ErrRequestReadFailed
+	}
+
+	if err := checkJSONDepth(data, s.settings().MaxJSONDepth); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(dst); err != nil {
+		return ErrRequestInvalidJSON
+	}
+	if dec.More() {
+		return ErrRequestInvalidJSON.WithDetail("request body must contain a single JSON value")
+	}
+	return nil
+}
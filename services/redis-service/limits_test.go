@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimitContentTypes(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"BODY_LIMIT_ROUTES": "/api/receipts=1024:application/json"})
+	handler := s.BodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		want        int
+	}{
+		{"/api/invoices/import", "text/csv", http.StatusNoContent},
+		{"/api/documents", "application/pdf", http.StatusNoContent},
+		{"/api/documents", "application/octet-stream", http.StatusNoContent},
+		{"/api/receipts", "application/json", http.StatusNoContent},
+		{"/api/receipts", "text/csv", http.StatusUnsupportedMediaType},
+		{"/noauth/login", "text/plain", http.StatusUnsupportedMediaType},
+		{"/noauth/login", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"/noauth/token", "application/x-www-form-urlencoded", http.StatusNoContent},
+		{"/api/chats/c1/image", "text/plain", http.StatusUnsupportedMediaType},
+	} {
+		r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader("a,b\n"))
+		r.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.contentType, tc.path, w.Code, tc.want)
+		}
+	}
+}
+
+func TestDecodeJSONBodyUsesRoutePolicy(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{
+		"BODY_LIMIT_ROUTES":   "/api/tokens=64:application/json",
+		"MAX_AUTH_BODY_BYTES": "32",
+		"MAX_BODY_BYTES":      "4096",
+	})
+	decode := func(path, body string) error {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		var dst map[string]interface{}
+		return s.decodeJSONBody(httptest.NewRecorder(), r, &dst)
+	}
+	medium := `{"scopes":["invoices:read"],"resource":"/api/x"}`
+	large := `{"scopes":["invoices:read"],"resource":"/api/` + strings.Repeat("x", 100) + `"}`
+
+	if err := decode("/api/tokens", medium); err != nil {
+		t.Errorf("body within the route limit: %v", err)
+	}
+	if err := decode("/api/tokens", large); err != ErrRequestBodyTooLarge {
+		t.Errorf("body over the route limit: got %v", err)
+	}
+	if err := decode("/noauth/login", medium); err != ErrRequestBodyTooLarge {
+		t.Errorf("body over the auth limit: got %v", err)
+	}
+	if err := decode("/api/password", large); err != nil {
+		t.Errorf("body within the default limit: %v", err)
+	}
+}
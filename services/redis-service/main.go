@@ -2,45 +2,179 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	loginCallerKeyHeader = "X-Login-Key"
 )
 
 type Config struct {
-	RedisHost            string
-	RedisPort            string
-	RedisPassword        string
-	JWTSecret            string
-	AccessPort           string
-	ProxyTargetURL       string
-	MaxRequestsPerMinute int
-	BlockDuration        time.Duration
-	SessionTTL           time.Duration
-	RequestTimeout       time.Duration
+	RedisHost                  string
+	RedisPort                  string
+	RedisPassword              string `secret:"true"`
+	RedisMode                  string
+	RedisAddrs                 []string
+	RedisUsername              string
+	RedisDB                    int
+	RedisSentinelMaster        string
+	RedisSentinelUsername      string
+	RedisSentinelPassword      string `secret:"true"`
+	RedisTLS                   bool
+	RedisTLSCAFile             string
+	RedisTLSCertFile           string
+	RedisTLSKeyFile            string
+	RedisTLSServerName         string
+	RedisPoolSize              int
+	RedisMinIdleConns          int
+	RedisDialTimeout           time.Duration
+	RedisReadTimeout           time.Duration
+	RedisWriteTimeout          time.Duration
+	RedisPoolTimeout           time.Duration
+	RedisBreakerThreshold      int
+	RedisBreakerCooldown       time.Duration
+	DegradedRateLimit          string
+	DegradedSessionStale       time.Duration
+	JWTSecret                  string `secret:"true"`
+	AccessPort                 string
+	ProxyTargetURL             string
+	MaxRequestsPerMinute       int           `reload:"true"`
+	BlockDuration              time.Duration `reload:"true"`
+	SessionTTL                 time.Duration
+	SessionIdleTimeout         time.Duration
+	SessionMaxLifetime         time.Duration
+	RequestTimeout             time.Duration
+	IdempotencyTTL             time.Duration
+	IdempotencyLockTimeout     time.Duration
+	IdempotencyWaitTimeout     time.Duration
+	MaxBodyBytes               int64        `reload:"true"`
+	MaxAuthBodyBytes           int64        `reload:"true"`
+	MaxUploadBytes             int64        `reload:"true"`
+	MaxJSONDepth               int          `reload:"true"`
+	BodyPolicies               []BodyPolicy `reload:"true"`
+	AdminRoles                 []string
+	AdminAPIKey                string `secret:"true"`
+	LoginTrustedNetworks       []*net.IPNet
+	TrustedProxies             []*net.IPNet
+	LoginCallerKey             string `secret:"true"`
+	MachineTokenTTL            time.Duration
+	RoleScopes                 map[string][]string
+	RouteScopes                []ScopeRule
+	ScopedTokenMaxTTL          time.Duration
+	ShareLinkPaths             []string
+	ShareLinkMaxTTL            time.Duration
+	ShareLinkBaseURL           string
+	ImpersonationMaxLifetime   time.Duration
+	ImpersonationDeniedPaths   []string
+	PasswordMinLength          int
+	PasswordResetTTL           time.Duration
+	EmailVerifyTTL             time.Duration
+	AccountLinkBaseURL         string
+	Notifier                   string
+	NotifierFile               string
+	SMTPHost                   string
+	SMTPPort                   string
+	SMTPUsername               string
+	SMTPPassword               string `secret:"true"`
+	SMTPFrom                   string
+	WebAuthnRPID               string
+	WebAuthnRPName             string
+	WebAuthnOrigins            []string
+	WebAuthnChallengeTTL       time.Duration
+	WebAuthnSecondFactor       bool
+	AuditStreamEnabled         bool
+	AuditStreamKey             string
+	AuditStreamMaxLen          int64
+	AuditFile                  string
+	AuditFileMaxBytes          int64
+	EventsBackend              string
+	EventsStreamKey            string
+	EventsStreamMaxLen         int64
+	KafkaBrokers               []string
+	KafkaTopic                 string
+	KafkaTLS                   bool
+	KafkaTLSCAFile             string
+	KafkaSASLMechanism         string
+	KafkaSASLUsername          string
+	KafkaSASLPassword          string `secret:"true"`
+	SessionExpiryNotifications bool
+	SessionSweepInterval       time.Duration
+	SessionBackupSweepInterval time.Duration
+	SessionTouchInterval       time.Duration
+	SessionCacheTTL            time.Duration
+	SessionBinding             []string
+	SessionBindingAction       string
+	SessionBindingIPv4Prefix   int
+	SessionBindingIPv6Prefix   int
+	CookieSessions             bool
+	CookieSecure               bool
+	CookieDomain               string
+	CookieSameSite             http.SameSite
+	CORSAllowedOrigins         []string
+	CORSAllowedMethods         []string
+	CORSAllowedHeaders         []string
+	CORSExposedHeaders         []string
+	CORSAllowCredentials       bool
+	CORSMaxAge                 int
+	CORSPolicies               []CORSPolicy
+	SecurityHeadersEnabled     bool
+	HSTSMaxAge                 time.Duration
+	HSTSIncludeSubdomains      bool
+	HSTSPreload                bool
+	ContentSecurityPolicy      string
+	ReferrerPolicy             string
+	PermissionsPolicy          string
+	FrameOptions               string
+	StripResponseHeaders       []string
+	TLSCertFile                string
+	TLSKeyFile                 string
+	TLSMinVersion              uint16
+	TLSCipherSuites            []uint16
+	TLSClientCAFile            string
+	TLSClientAuth              tls.ClientAuthType
+	TLSClientIdentities        map[string][]string
+	TLSRedirectPort            string
+	ACMEDomains                []string
+	ACMEEmail                  string
+	ACMEDirectoryURL           string
+	ACMECacheDir               string
+	ACMECAFile                 string
+	TenantMode                 string
+	TenantHeader               string
+	TenantBaseDomain           string
+	Tenants                    []Tenant
 }
 
 type SessionManager struct {
-	rdb *redis.Client
+	rdb   redis.UniversalClient
+	cache *sessionCache
 }
 
 type RateLimiter struct {
-	rdb *redis.Client
+	rdb redis.UniversalClient
 }
 
 func LoadConfig() (*Config, error) {
@@ -48,62 +182,239 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		log.Printf("[WARN] .env not loaded: %v", err)
 	}
-	c := &Config{
-		RedisHost:            getEnv("REDIS_HOST", "localhost"),
-		RedisPort:            getEnv("REDIS_PORT", "6379"),
-		RedisPassword:        os.Getenv("REDIS_PASSWORD"),
-		JWTSecret:            os.Getenv("JWT_SECRET"),
-		AccessPort:           getEnv("ACCESS_PORT", "8080"),
-		ProxyTargetURL:       getEnv("PROXY_TARGET_URL", "http://185.141.216.228:10000"),
-		MaxRequestsPerMinute: getEnvInt("MAX_REQUESTS_PER_MINUTE", 60),
-		BlockDuration:        time.Duration(getEnvInt("BLOCK_DURATION_MINUTES", 5)) * time.Minute,
-		SessionTTL:           time.Duration(getEnvInt("SESSION_TTL_HOURS", 24)) * time.Hour,
-		RequestTimeout:       time.Duration(getEnvInt("REQUEST_TIMEOUT_SECONDS", 10)) * time.Second,
-	}
-	if c.JWTSecret == "" {
-		return nil, errors.New("JWT_SECRET is required")
+	l, err := newConfigLoader(configFile(), configFlags.overrides)
+	if err != nil {
+		return nil, err
 	}
-	return c, nil
-}
-
-func getEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	c := &Config{
+		RedisHost:                l.str("REDIS_HOST", "localhost"),
+		RedisPort:                l.str("REDIS_PORT", "6379"),
+		RedisPassword:            l.secret("REDIS_PASSWORD"),
+		RedisMode:                strings.ToLower(l.str("REDIS_MODE", RedisModeStandalone)),
+		RedisAddrs:               l.list("REDIS_ADDRS", nil),
+		RedisUsername:            l.str("REDIS_USERNAME", ""),
+		RedisDB:                  l.int("REDIS_DB", 0),
+		RedisSentinelMaster:      l.str("REDIS_SENTINEL_MASTER", ""),
+		RedisSentinelUsername:    l.str("REDIS_SENTINEL_USERNAME", ""),
+		RedisSentinelPassword:    l.secret("REDIS_SENTINEL_PASSWORD"),
+		RedisTLS:                 l.bool("REDIS_TLS", false),
+		RedisTLSCAFile:           l.str("REDIS_TLS_CA_FILE", ""),
+		RedisTLSCertFile:         l.str("REDIS_TLS_CERT_FILE", ""),
+		RedisTLSKeyFile:          l.str("REDIS_TLS_KEY_FILE", ""),
+		RedisTLSServerName:       l.str("REDIS_TLS_SERVER_NAME", ""),
+		RedisPoolSize:            l.int("REDIS_POOL_SIZE", 50),
+		RedisMinIdleConns:        l.int("REDIS_MIN_IDLE_CONNS", 0),
+		RedisDialTimeout:         time.Duration(l.int("REDIS_DIAL_TIMEOUT_MS", 5000)) * time.Millisecond,
+		RedisReadTimeout:         time.Duration(l.int("REDIS_READ_TIMEOUT_MS", 3000)) * time.Millisecond,
+		RedisWriteTimeout:        time.Duration(l.int("REDIS_WRITE_TIMEOUT_MS", 3000)) * time.Millisecond,
+		RedisPoolTimeout:         time.Duration(l.int("REDIS_POOL_TIMEOUT_MS", 4000)) * time.Millisecond,
+		RedisBreakerThreshold:    l.int("REDIS_BREAKER_THRESHOLD", 5),
+		RedisBreakerCooldown:     time.Duration(l.int("REDIS_BREAKER_COOLDOWN_SECONDS", 10)) * time.Second,
+		DegradedRateLimit:        strings.ToLower(l.str("DEGRADED_RATE_LIMIT", DegradedRateLimitLocal)),
+		DegradedSessionStale:     time.Duration(l.int("DEGRADED_SESSION_STALE_SECONDS", 300)) * time.Second,
+		JWTSecret:                l.secret("JWT_SECRET"),
+		AccessPort:               l.str("ACCESS_PORT", "8080"),
+		ProxyTargetURL:           l.str("PROXY_TARGET_URL", "http://localhost:10000"),
+		MaxRequestsPerMinute:     l.int("MAX_REQUESTS_PER_MINUTE", 60),
+		BlockDuration:            time.Duration(l.int("BLOCK_DURATION_MINUTES", 5)) * time.Minute,
+		SessionTTL:               time.Duration(l.int("SESSION_TTL_HOURS", 24)) * time.Hour,
+		SessionIdleTimeout:       time.Duration(l.int("SESSION_IDLE_TIMEOUT_MINUTES", 24*60)) * time.Minute,
+		SessionMaxLifetime:       time.Duration(l.int("SESSION_MAX_LIFETIME_HOURS", 7*24)) * time.Hour,
+		RequestTimeout:           time.Duration(l.int("REQUEST_TIMEOUT_SECONDS", 10)) * time.Second,
+		IdempotencyTTL:           time.Duration(l.int("IDEMPOTENCY_TTL_HOURS", 24)) * time.Hour,
+		IdempotencyLockTimeout:   time.Duration(l.int("IDEMPOTENCY_LOCK_TIMEOUT_SECONDS", 60)) * time.Second,
+		IdempotencyWaitTimeout:   time.Duration(l.int("IDEMPOTENCY_WAIT_TIMEOUT_SECONDS", 5)) * time.Second,
+		MaxBodyBytes:             int64(l.int("MAX_BODY_BYTES", 1<<20)),
+		MaxAuthBodyBytes:         int64(l.int("MAX_AUTH_BODY_BYTES", 16<<10)),
+		MaxUploadBytes:           int64(l.int("MAX_UPLOAD_BYTES", 10<<20)),
+		MaxJSONDepth:             l.int("MAX_JSON_DEPTH", 32),
+		AdminRoles:               l.list("ADMIN_ROLES", []string{"administrator"}),
+		AdminAPIKey:              l.secret("ADMIN_API_KEY"),
+		LoginCallerKey:           l.secret("LOGIN_CALLER_KEY"),
+		MachineTokenTTL:          time.Duration(l.int("MACHINE_TOKEN_TTL_MINUTES", 15)) * time.Minute,
+		ScopedTokenMaxTTL:        time.Duration(l.int("SCOPED_TOKEN_MAX_TTL_HOURS", 24)) * time.Hour,
+		ShareLinkPaths:           l.list("SHARE_LINK_PATHS", []string{"/api/invoices/*/pdf", "/api/receipts/*/pdf"}),
+		ShareLinkMaxTTL:          time.Duration(l.int("SHARE_LINK_MAX_TTL_HOURS", 7*24)) * time.Hour,
+		ShareLinkBaseURL:         l.str("SHARE_LINK_BASE_URL", ""),
+		ImpersonationMaxLifetime: time.Duration(l.int("IMPERSONATION_MAX_LIFETIME_MINUTES", 30)) * time.Minute,
+		ImpersonationDeniedPaths: l.list("IMPERSONATION_DENIED_PATHS", []string{
+			"/api/password", "/api/password/*", "/api/*/password", "/api/*/*/password",
+			"/api/2fa", "/api/2fa/*", "/api/*/2fa", "/api/*/2fa/*", "/api/*/*/2fa", "/api/*/*/2fa/*",
+		}),
+		PasswordMinLength:          l.int("PASSWORD_MIN_LENGTH", 10),
+		PasswordResetTTL:           time.Duration(l.int("PASSWORD_RESET_TTL_MINUTES", 30)) * time.Minute,
+		EmailVerifyTTL:             time.Duration(l.int("EMAIL_VERIFY_TTL_HOURS", 24)) * time.Hour,
+		AccountLinkBaseURL:         l.str("ACCOUNT_LINK_BASE_URL", ""),
+		Notifier:                   l.str("NOTIFIER", NotifierNone),
+		NotifierFile:               l.str("NOTIFIER_FILE", ""),
+		SMTPHost:                   l.str("SMTP_HOST", ""),
+		SMTPPort:                   l.str("SMTP_PORT", "587"),
+		SMTPUsername:               l.str("SMTP_USERNAME", ""),
+		SMTPPassword:               l.secret("SMTP_PASSWORD"),
+		SMTPFrom:                   l.str("SMTP_FROM", ""),
+		WebAuthnRPID:               l.str("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:             l.str("WEBAUTHN_RP_NAME", "Finura"),
+		WebAuthnOrigins:            l.list("WEBAUTHN_ORIGINS", []string{"http://localhost:3000"}),
+		WebAuthnChallengeTTL:       time.Duration(l.int("WEBAUTHN_CHALLENGE_TTL_SECONDS", 120)) * time.Second,
+		WebAuthnSecondFactor:       l.bool("WEBAUTHN_SECOND_FACTOR", true),
+		AuditStreamEnabled:         l.bool("AUDIT_STREAM_ENABLED", true),
+		AuditStreamKey:             l.str("AUDIT_STREAM_KEY", "audit:events"),
+		AuditStreamMaxLen:          int64(l.int("AUDIT_STREAM_MAXLEN", 0)),
+		AuditFile:                  l.str("AUDIT_FILE", ""),
+		AuditFileMaxBytes:          int64(l.int("AUDIT_FILE_MAX_MB", 50)) << 20,
+		EventsBackend:              l.str("EVENTS_BACKEND", "none"),
+		EventsStreamKey:            l.str("EVENTS_STREAM_KEY", "events:gateway"),
+		EventsStreamMaxLen:         int64(l.int("EVENTS_STREAM_MAXLEN", 100000)),
+		KafkaBrokers:               l.list("KAFKA_BROKERS", nil),
+		KafkaTopic:                 l.str("KAFKA_TOPIC", "finura.gateway.events"),
+		KafkaTLS:                   l.bool("KAFKA_TLS", false),
+		KafkaTLSCAFile:             l.str("KAFKA_TLS_CA_FILE", ""),
+		KafkaSASLMechanism:         l.str("KAFKA_SASL_MECHANISM", ""),
+		KafkaSASLUsername:          l.str("KAFKA_SASL_USERNAME", ""),
+		KafkaSASLPassword:          l.secret("KAFKA_SASL_PASSWORD"),
+		SessionExpiryNotifications: l.bool("SESSION_EXPIRY_NOTIFICATIONS", true),
+		SessionSweepInterval:       time.Duration(l.int("SESSION_SWEEP_INTERVAL_SECONDS", 60)) * time.Second,
+		SessionBackupSweepInterval: time.Duration(l.int("SESSION_BACKUP_SWEEP_INTERVAL_SECONDS", 900)) * time.Second,
+		SessionTouchInterval:       time.Duration(l.int("SESSION_TOUCH_INTERVAL_SECONDS", 60)) * time.Second,
+		SessionCacheTTL:            time.Duration(l.int("SESSION_CACHE_TTL_SECONDS", 5)) * time.Second,
+		SessionBindingIPv4Prefix:   l.int("SESSION_BINDING_IPV4_PREFIX", 24),
+		SessionBindingIPv6Prefix:   l.int("SESSION_BINDING_IPV6_PREFIX", 64),
+		CookieSessions:             l.bool("COOKIE_SESSIONS", false),
+		CookieSecure:               l.bool("COOKIE_SECURE", true),
+		CookieDomain:               l.str("COOKIE_DOMAIN", ""),
+		CORSAllowedOrigins:         l.list("CORS_ALLOWED_ORIGINS", []string{"http://localhost:3000"}),
+		CORSAllowedMethods:         l.list("CORS_ALLOWED_METHODS", defaultCORSMethods),
+		CORSAllowedHeaders:         l.list("CORS_ALLOWED_HEADERS", defaultCORSHeaders),
+		CORSExposedHeaders:         l.list("CORS_EXPOSED_HEADERS", defaultCORSExposed),
+		CORSAllowCredentials:       l.bool("CORS_ALLOW_CREDENTIALS", true),
+		CORSMaxAge:                 l.int("CORS_MAX_AGE_SECONDS", 300),
+		SecurityHeadersEnabled:     l.bool("SECURITY_HEADERS_ENABLED", true),
+		HSTSMaxAge:                 time.Duration(l.int("HSTS_MAX_AGE_SECONDS", 31536000)) * time.Second,
+		HSTSIncludeSubdomains:      l.bool("HSTS_INCLUDE_SUBDOMAINS", true),
+		HSTSPreload:                l.bool("HSTS_PRELOAD", false),
+		ContentSecurityPolicy:      l.str("CONTENT_SECURITY_POLICY", "default-src 'none'; frame-ancestors 'none'"),
+		ReferrerPolicy:             l.str("REFERRER_POLICY", "no-referrer"),
+		PermissionsPolicy:          l.str("PERMISSIONS_POLICY", "camera=(), microphone=(), geolocation=()"),
+		FrameOptions:               l.str("FRAME_OPTIONS", "DENY"),
+		StripResponseHeaders:       l.list("STRIP_RESPONSE_HEADERS", defaultStripHeaders),
+		TLSCertFile:                l.str("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 l.str("TLS_KEY_FILE", ""),
+		TLSClientCAFile:            l.str("TLS_CLIENT_CA_FILE", ""),
+		TLSRedirectPort:            l.str("TLS_REDIRECT_PORT", ""),
+		ACMEDomains:                l.list("ACME_DOMAINS", nil),
+		ACMEEmail:                  l.str("ACME_EMAIL", ""),
+		ACMEDirectoryURL:           l.str("ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory),
+		ACMECacheDir:               l.str("ACME_CACHE_DIR", "acme-cache"),
+		ACMECAFile:                 l.str("ACME_CA_FILE", ""),
+		TenantMode:                 strings.ToLower(l.str("TENANT_MODE", TenantModeOff)),
+		TenantHeader:               l.str("TENANT_HEADER", "X-Tenant-ID"),
+		TenantBaseDomain:           l.str("TENANT_BASE_DOMAIN", ""),
 	}
-	return def
-}
-
-func getEnvInt(key string, def int) int {
-	if v := os.Getenv(key); v != "" {
-		if i, err := strconv.Atoi(v); err == nil {
-			return i
-		}
+	policies, err := parseBodyPolicies(l.str("BODY_LIMIT_ROUTES", ""))
+	l.check("BODY_LIMIT_ROUTES", err)
+	c.BodyPolicies = policies
+	c.SessionBinding, c.SessionBindingAction, err = parseBindingConfig(
+		l.list("SESSION_BINDING", nil),
+		strings.ToLower(l.str("SESSION_BINDING_ACTION", BindingActionLog)),
+	)
+	l.check("SESSION_BINDING", err)
+	c.CookieSameSite, err = parseSameSite(l.str("COOKIE_SAMESITE", "lax"))
+	l.check("COOKIE_SAMESITE", err)
+	c.CORSPolicies, err = parseCORSPolicies(l.str("CORS_ROUTES", ""))
+	l.check("CORS_ROUTES", err)
+	c.TLSMinVersion, err = parseTLSVersion(l.str("TLS_MIN_VERSION", "1.2"))
+	l.check("TLS_MIN_VERSION", err)
+	c.TLSCipherSuites, err = parseCipherSuites(l.list("TLS_CIPHER_SUITES", nil))
+	l.check("TLS_CIPHER_SUITES", err)
+	c.TLSClientAuth, err = parseClientAuth(l.str("TLS_CLIENT_AUTH", "verify_if_given"))
+	l.check("TLS_CLIENT_AUTH", err)
+	c.TLSClientIdentities, err = parseRoleScopes(l.list("TLS_CLIENT_IDENTITIES", nil))
+	l.check("TLS_CLIENT_IDENTITIES", err)
+	c.Tenants, err = parseTenants(l.list("TENANTS", nil), l.list("TENANT_UPSTREAMS", nil), l.list("TENANT_RATE_LIMITS", nil))
+	l.check("TENANTS", err)
+	c.LoginTrustedNetworks, err = parseCIDRs(l.list("LOGIN_TRUSTED_CIDRS", []string{"127.0.0.0/8", "::1/128"}))
+	l.check("LOGIN_TRUSTED_CIDRS", err)
+	c.TrustedProxies, err = parseCIDRs(l.list("TRUSTED_PROXIES", nil))
+	l.check("TRUSTED_PROXIES", err)
+	c.RoleScopes, err = parseRoleScopes(l.list("ROLE_SCOPES", nil))
+	l.check("ROLE_SCOPES", err)
+	c.RouteScopes, err = parseRouteScopes(l.list("ROUTE_SCOPES", nil))
+	l.check("ROUTE_SCOPES", err)
+
+	errs := append(l.errs, l.unknown()...)
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
 	}
-	return def
+	return c, nil
 }
 
 type Server struct {
-	rdb            *redis.Client
+	rdb            redis.UniversalClient
 	rateLimiter    *RateLimiter
 	sessionManager *SessionManager
-	jwtSecret      []byte
+	idempotency    *IdempotencyStore
+	apiKeys        *APIKeyStore
+	credentials    *CredentialStore
+	passkeys       *PasskeyStore
+	bodyLimiter    *BodyLimiter
+	keys           *KeyRing
+	audit          *AuditLogger
+	events         EventPublisher
+	notifier       Notifier
+	headers        *SecurityHeaders
+	breaker        *CircuitBreaker
+	localLimiter   *localLimiter
+	tenants        *TenantRegistry
 	config         *Config
+	live           atomic.Pointer[Config]
 }
 
 type Claims struct {
-	UserID    string `json:"user_id"`
-	Username  string `json:"username"`
-	SessionID string `json:"session_id"`
+	TenantID  string   `json:"tenant_id,omitempty"`
+	UserID    string   `json:"user_id"`
+	Username  string   `json:"username"`
+	SessionID string   `json:"session_id"`
+	Scopes    []string `json:"scopes,omitempty"`
+	// Resource restricts a down-scoped token to GET on a single path.
+	Resource string `json:"resource,omitempty"`
+	// KeyID is set on machine tokens issued for an API key.
+	KeyID string `json:"key_id,omitempty"`
+	// ImpersonatorID is the administrator acting as UserID.
+	ImpersonatorID   string `json:"impersonator_id,omitempty"`
+	ImpersonatorName string `json:"impersonator_name,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type UserSession struct {
-	UserID    string    `json:"user_id"`
-	Username  string    `json:"username"`
-	Roles     []string  `json:"roles"`
-	LoginTime time.Time `json:"login_time"`
-	LastSeen  time.Time `json:"last_seen"`
-	IPAddress string    `json:"ip_address"`
+	TenantID         string    `json:"tenant_id,omitempty"`
+	UserID           string    `json:"user_id"`
+	Username         string    `json:"username"`
+	Roles            []string  `json:"roles"`
+	LoginTime        time.Time `json:"login_time"`
+	LastSeen         time.Time `json:"last_seen"`
+	IPAddress        string    `json:"ip_address"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	UserAgentHash    string    `json:"user_agent_hash,omitempty"`
+	DeviceHash       string    `json:"device_hash,omitempty"`
+	ImpersonatorID   string    `json:"impersonator_id,omitempty"`
+	ImpersonatorName string    `json:"impersonator_name,omitempty"`
+}
+
+// ttl is how long the session key may live from now: the idle timeout, cut
+// short by the absolute lifetime.
+func (us *UserSession) ttl(idle time.Duration, now time.Time) time.Duration {
+	if remaining := us.ExpiresAt.Sub(now); remaining < idle {
+		return remaining
+	}
+	return idle
+}
+
+func (us *UserSession) IdleExpiresAt(idle time.Duration) time.Time {
+	if t := us.LastSeen.Add(idle); t.Before(us.ExpiresAt) {
+		return t
+	}
+	return us.ExpiresAt
 }
 
 type RateLimitResult struct {
@@ -113,99 +424,226 @@ type RateLimitResult struct {
 	RetryAfter time.Duration
 }
 
+type LoginResponse struct {
+	Token        string   `json:"token,omitempty"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	CSRFToken    string   `json:"csrf_token,omitempty"`
+	SessionID    string   `json:"session_id"`
+	ExpiresIn    int      `json:"expires_in"`
+	UserID       string   `json:"user_id"`
+	Username     string   `json:"username"`
+	Scopes       []string `json:"scopes"`
+	// DeviceToken is returned instead of the device cookie when a trusted
+	// caller logs a client in on its behalf, for the caller to pass on.
+	DeviceToken string `json:"device_token,omitempty"`
+}
+
+type RefreshResponse struct {
+	Token     string `json:"token,omitempty"`
+	CSRFToken string `json:"csrf_token,omitempty"`
+	SessionID string `json:"session_id"`
+	ExpiresIn int    `json:"expires_in"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+type SessionResponse struct {
+	Success       bool      `json:"success"`
+	UserID        string    `json:"user_id"`
+	Username      string    `json:"username"`
+	Roles         []string  `json:"roles"`
+	LoginTime     time.Time `json:"login_time"`
+	LastSeen      time.Time `json:"last_seen"`
+	IPAddress     string    `json:"ip_address"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	IdleExpiresAt time.Time `json:"idle_expires_at"`
+	// Resource is set for tokens restricted to one path, which the
+	// upstream must only serve that path for.
+	Resource string `json:"resource,omitempty"`
+}
+
+type ApiResponse struct {
+	Message   string    `json:"message"`
+	Path      string    `json:"path"`
+	Method    string    `json:"method"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	SessionID string    `json:"session_id"`
+	LoginTime time.Time `json:"login_time"`
+	LastSeen  time.Time `json:"last_seen"`
+	IPAddress string    `json:"ip_address"`
+}
+
 func NewServer() (*Server, error) {
 	cfg, err := LoadConfig()
 	if err != nil {
 		return nil, err
 	}
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
-		Password: cfg.RedisPassword,
-		PoolSize: 50,
-	})
+	rdb, err := newRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	breaker := NewCircuitBreaker(cfg.RedisBreakerThreshold, cfg.RedisBreakerCooldown)
+	rdb.AddHook(breaker)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis (%s): %w", redisDescription(cfg), err)
+	}
+	keys := NewKeyRing(rdb, cfg.JWTSecret)
+	if err := keys.Load(ctx); err != nil {
+		return nil, err
+	}
+	audit, err := NewAuditLogger(rdb, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := audit.migrateHead(ctx); err != nil {
+		return nil, err
+	}
+	events, err := NewEventPublisher(rdb, cfg)
+	if err != nil {
 		return nil, err
 	}
-	return &Server{
+	notifier, err := NewNotifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
 		rdb:            rdb,
 		rateLimiter:    NewRateLimiter(rdb),
-		sessionManager: NewSessionManager(rdb),
-		jwtSecret:      []byte(cfg.JWTSecret),
+		sessionManager: NewSessionManager(rdb, cfg.SessionCacheTTL, cfg.DegradedSessionStale),
+		idempotency:    NewIdempotencyStore(rdb),
+		apiKeys:        NewAPIKeyStore(rdb),
+		credentials:    NewCredentialStore(rdb),
+		passkeys:       NewPasskeyStore(rdb),
+		bodyLimiter:    NewBodyLimiter(cfg),
+		keys:           keys,
+		audit:          audit,
+		events:         events,
+		notifier:       notifier,
+		headers:        NewSecurityHeaders(cfg),
+		breaker:        breaker,
+		localLimiter:   newLocalLimiter(),
+		tenants:        NewTenantRegistry(cfg),
 		config:         cfg,
-	}, nil
+	}
+	s.live.Store(cfg)
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancelMigrate()
+	for _, tctx := range s.tenantContexts(migrateCtx) {
+		moved, err := migrateLegacyKeys(tctx, rdb)
+		if err != nil {
+			return nil, err
+		}
+		if moved > 0 {
+			log.Printf("[REDIS] Migrated %d keys to cluster hash tags (tenant %q)", moved, tenantID(tctx))
+		}
+	}
+	return s, nil
 }
 
 func main() {
-	server, err := NewServer()
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+func (s *Server) Routes() http.Handler {
 	r := chi.NewRouter()
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
 
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		ExposedHeaders:   []string{"*"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
-
-	testSessionID := "test_session_" + strconv.FormatInt(time.Now().Unix(), 10)
-	testSession := &UserSession{
-		UserID:    "0",
-		Username:  "TestUser",
-		LoginTime: time.Now(),
-		LastSeen:  time.Now(),
-		IPAddress: "127.0.0.1",
-		Roles:     []string{"TEST"},
-	}
-
-	err = server.sessionManager.CreateSession(context.Background(), testSessionID, testSession, server.config.SessionTTL)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create test session: %v", err)
-	} else {
-		testToken, _ := server.createJWT("0", "TestUser", testSessionID, 24*time.Hour)
-		log.Printf("[DEV] Test token: %s", testToken)
-		testRefreshToken, _ := server.createRefreshToken("0", "TestUser", testSessionID, 30*24*time.Hour)
-		log.Printf("[DEV] Test refresh_token: %s", testRefreshToken)
-		log.Printf("[DEV] Test sessionID: %s", testSessionID)
-	}
+	r.Use(s.ClientIPMiddleware)
+	r.Use(s.headers.Middleware)
+	r.Use(CORSMiddleware(s.config))
+	r.Use(s.TenantMiddleware)
 
 	r.Use(
 		middleware.Logger,
-		middleware.Recoverer,
+		Recoverer,
 		middleware.Timeout(30*time.Second),
-		server.RateLimitMiddleware,
+		s.RateLimitMiddleware,
+		s.BodyLimitMiddleware,
 	)
 
-	r.Mount("/noauth", publicRouter(server))
-	r.Mount("/api", authRouter(server))
+	r.Mount("/noauth", publicRouter(s))
+	r.Mount("/api", authRouter(s))
+	r.Mount("/admin", adminRouter(s))
+	return r
+}
 
-	log.Printf("Server listening on port %s", server.config.AccessPort)
-	http.ListenAndServe(
-		":"+server.config.AccessPort,
-		r,
-	)
+func (s *Server) Serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.keys.Watch(ctx)
+	go s.WatchSessionExpiry(ctx)
+	go s.sessionManager.WatchInvalidations(ctx)
+	go s.WatchConfig(ctx)
+
+	srv := &http.Server{Addr: ":" + s.config.AccessPort, Handler: s.Routes()}
+	if !s.config.tlsEnabled() {
+		log.Printf("Server listening on port %s", s.config.AccessPort)
+		return srv.ListenAndServe()
+	}
+
+	tlsConfig, redirect, err := s.tlsSetup(ctx)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tlsConfig
+	if s.config.TLSRedirectPort != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on port %s to HTTPS", s.config.TLSRedirectPort)
+			if err := http.ListenAndServe(":"+s.config.TLSRedirectPort, redirect); err != nil {
+				log.Printf("[TLS ERROR] Redirect listener stopped: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("Server listening on port %s (TLS)", s.config.AccessPort)
+	return srv.ListenAndServeTLS("", "")
 }
 
 func publicRouter(s *Server) http.Handler {
 	r := chi.NewRouter()
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
 	// r.HandleFunc("/*", s.ApiHandler)
 	r.Post("/login", s.Login)
 	r.Post("/refresh", s.RefreshSession)
+	r.Post("/token", s.MachineToken)
+	r.Post("/password/forgot", s.ForgotPassword)
+	r.Post("/password/reset", s.ResetPassword)
+	r.Post("/email/verify", s.VerifyEmail)
+	r.Post("/webauthn/login/begin", s.BeginPasskeyLogin)
+	r.Post("/webauthn/login/finish", s.FinishPasskeyLogin)
+	r.Get("/share/{token}", s.ServeShareLink(s.upstreamProxy()))
 	return r
 }
 
 func authRouter(s *Server) http.Handler {
 	r := chi.NewRouter()
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
 	r.Use(s.AuthMiddleware)
-	r.Post("/logout", s.Logout)
+	r.Use(s.ScopeMiddleware)
+	r.Use(s.AuditMiddleware)
+	r.Use(s.IdempotencyMiddleware)
+	r.With(s.RequireSession).Post("/logout", s.Logout)
 	r.Post("/session/get", s.GetSession)
-	proxy := newReverseProxy(s.config.ProxyTargetURL)
-	r.Handle("/*", proxy)
+	r.With(s.RequireSession).Post("/tokens", s.MintScopedToken)
+	r.With(s.RequireSession).Post("/share-links", s.CreateShareLink)
+	r.With(s.RequireSession).Delete("/share-links/{linkID}", s.RevokeShareLink)
+	r.With(s.RequireSession).Post("/password", s.ChangePassword)
+	r.With(s.RequireSession).Post("/email/verification", s.RequestEmailVerification)
+	r.With(s.RequireSession).Post("/webauthn/register/begin", s.BeginPasskeyRegistration)
+	r.With(s.RequireSession).Post("/webauthn/register/finish", s.FinishPasskeyRegistration)
+	r.With(s.RequireSession).Get("/webauthn/credentials", s.ListPasskeys)
+	r.With(s.RequireSession).Delete("/webauthn/credentials/{credentialID}", s.DeletePasskey)
+	r.Handle("/*", s.upstreamProxy())
 	return r
 }
 
@@ -213,7 +651,7 @@ type reverseProxy struct {
 	proxy *httputil.ReverseProxy
 }
 
-func newReverseProxy(target string) *reverseProxy {
+func newReverseProxy(target string, headers *SecurityHeaders) *reverseProxy {
 	tgt, err := url.Parse(target)
 	if err != nil {
 		log.Fatalf("Invalid PROXY_TARGET_URL: %v", err)
@@ -248,11 +686,21 @@ func newReverseProxy(target string) *reverseProxy {
 			resp.Header.Del("Access-Control-Allow-Credentials")
 			resp.Header.Del("Access-Control-Expose-Headers")
 			resp.Header.Del("Access-Control-Max-Age")
+			headers.filterUpstream(resp.Header)
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if isBodyTooLarge(err) {
+				log.Printf("[LIMITS] Upload to %s exceeded body limit", r.URL.Path)
+				writeError(w, r, ErrRequestBodyTooLarge)
+				return
+			}
 			log.Printf("[PROXY ERROR] %v", err)
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeError(w, r, ErrUpstreamTimeout)
+				return
+			}
+			writeError(w, r, ErrUpstreamUnavailable)
 		},
 	}}
 }
@@ -269,18 +717,105 @@ func joinPath(base, path string) string {
 	return base + path
 }
 
-func NewSessionManager(rdb *redis.Client) *SessionManager {
-	return &SessionManager{rdb: rdb}
+// touchSessionScript bumps last_seen and the TTL of an existing session hash
+// only, so a session deleted concurrently (logout, revocation) is not
+// brought back.
+var touchSessionScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "last_seen", ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+func NewSessionManager(rdb redis.UniversalClient, cacheTTL, staleTTL time.Duration) *SessionManager {
+	return &SessionManager{rdb: rdb, cache: newSessionCache(cacheTTL, staleTTL)}
+}
+
+func (us *UserSession) fields() (map[string]interface{}, error) {
+	roles, err := json.Marshal(us.Roles)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"tenant_id":         us.TenantID,
+		"user_id":           us.UserID,
+		"username":          us.Username,
+		"roles":             roles,
+		"login_time":        us.LoginTime.Format(time.RFC3339Nano),
+		"last_seen":         us.LastSeen.Format(time.RFC3339Nano),
+		"ip_address":        us.IPAddress,
+		"expires_at":        us.ExpiresAt.Format(time.RFC3339Nano),
+		"ua_hash":           us.UserAgentHash,
+		"device_hash":       us.DeviceHash,
+		"impersonator_id":   us.ImpersonatorID,
+		"impersonator_name": us.ImpersonatorName,
+	}, nil
+}
+
+func sessionFromFields(values map[string]string) (*UserSession, error) {
+	session := &UserSession{
+		TenantID:         values["tenant_id"],
+		UserID:           values["user_id"],
+		Username:         values["username"],
+		IPAddress:        values["ip_address"],
+		UserAgentHash:    values["ua_hash"],
+		DeviceHash:       values["device_hash"],
+		ImpersonatorID:   values["impersonator_id"],
+		ImpersonatorName: values["impersonator_name"],
+	}
+	if err := json.Unmarshal([]byte(values["roles"]), &session.Roles); err != nil {
+		return nil, fmt.Errorf("invalid roles: %w", err)
+	}
+	for field, dst := range map[string]*time.Time{
+		"login_time": &session.LoginTime,
+		"last_seen":  &session.LastSeen,
+		"expires_at": &session.ExpiresAt,
+	} {
+		if values[field] == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, values[field])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		*dst = t
+	}
+	return session, nil
+}
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
 }
 
 func (sm *SessionManager) CreateSession(ctx context.Context, sessionID string, session *UserSession, ttl time.Duration) error {
-	sessionData, err := json.Marshal(session)
+	return sm.storeSession(ctx, sessionID, session, ttl, 0)
+}
+
+// CreateUserSession stores the session and points the user_session pointer
+// at it in one transaction, so the pointer never names a session that has
+// not been written yet.
+func (sm *SessionManager) CreateUserSession(ctx context.Context, sessionID string, session *UserSession, ttl, pointerTTL time.Duration) error {
+	return sm.storeSession(ctx, sessionID, session, ttl, pointerTTL)
+}
+
+func (sm *SessionManager) storeSession(ctx context.Context, sessionID string, session *UserSession, ttl, pointerTTL time.Duration) error {
+	fields, err := session.fields()
 	if err != nil {
 		return fmt.Errorf("failed to marshal session: %w", err)
 	}
 
-	key := fmt.Sprintf("session:%s", sessionID)
-	err = sm.rdb.Set(ctx, key, sessionData, ttl).Err()
+	key := sessionKey(ctx, sessionID)
+	_, err = sm.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, ttl)
+		if pointerTTL > 0 {
+			pipe.Set(ctx, userSessionKey(ctx, session.UserID), sessionID, pointerTTL)
+		}
+		return nil
+	})
 	if err != nil {
 		return fmt.Errorf("failed to store session: %w", err)
 	}
@@ -289,8 +824,47 @@ func (sm *SessionManager) CreateSession(ctx context.Context, sessionID string, s
 }
 
 func (sm *SessionManager) GetSession(ctx context.Context, sessionID string) (*UserSession, error) {
-	key := fmt.Sprintf("session:%s", sessionID)
+	if session, ok := sm.cache.get(tenantKey(ctx, sessionID)); ok {
+		return session, nil
+	}
+
+	session, err := sm.loadSession(ctx, sessionID)
+	if err != nil {
+		if redisFailure(err) {
+			if stale, ok := sm.cache.getStale(tenantKey(ctx, sessionID)); ok {
+				return stale, nil
+			}
+		}
+		return nil, err
+	}
+	sm.cache.put(tenantKey(ctx, sessionID), session)
+	return session, nil
+}
 
+// loadSession reads a session from Redis, bypassing the cache. Sessions
+// written before the switch to hashes are still stored as JSON strings.
+func (sm *SessionManager) loadSession(ctx context.Context, sessionID string) (*UserSession, error) {
+	key := sessionKey(ctx, sessionID)
+
+	values, err := sm.rdb.HGetAll(ctx, key).Result()
+	if isWrongType(err) {
+		return sm.loadLegacySession(ctx, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	if len(values) == 0 {
+		return nil, errors.New("session not found")
+	}
+
+	session, err := sessionFromFields(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return session, nil
+}
+
+func (sm *SessionManager) loadLegacySession(ctx context.Context, key string) (*UserSession, error) {
 	data, err := sm.rdb.Get(ctx, key).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -308,22 +882,43 @@ func (sm *SessionManager) GetSession(ctx context.Context, sessionID string) (*Us
 	return &session, nil
 }
 
-func (sm *SessionManager) UpdateSession(ctx context.Context, sessionID string, ttl time.Duration) error {
-	session, err := sm.GetSession(ctx, sessionID)
+// TouchSession records session.LastSeen and extends the session TTL without
+// rewriting the rest of the session.
+func (sm *SessionManager) TouchSession(ctx context.Context, sessionID string, session *UserSession, ttl time.Duration) error {
+	key := sessionKey(ctx, sessionID)
+	lastSeen := session.LastSeen.Format(time.RFC3339Nano)
+
+	touched, err := touchSessionScript.Run(ctx, sm.rdb, []string{key}, lastSeen, ttl.Milliseconds()).Int()
+	if isWrongType(err) {
+		// Legacy JSON session: rewrite it as a hash.
+		return sm.CreateSession(ctx, sessionID, session, ttl)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to touch session: %w", err)
 	}
-
-	session.LastSeen = time.Now()
-	return sm.CreateSession(ctx, sessionID, session, ttl)
+	if touched == 0 {
+		sm.cache.delete(tenantKey(ctx, sessionID))
+		return errors.New("session not found")
+	}
+	sm.cache.put(tenantKey(ctx, sessionID), session)
+	return nil
 }
 
 func (sm *SessionManager) DeleteSession(ctx context.Context, sessionID string) error {
-	key := fmt.Sprintf("session:%s", sessionID)
-	return sm.rdb.Del(ctx, key).Err()
+	key := sessionKey(ctx, sessionID)
+	if err := sm.rdb.Del(ctx, key).Err(); err != nil {
+		return err
+	}
+	sm.invalidate(ctx, sessionID)
+	if userID := sessionUserID(sessionID); userID != "" {
+		if _, err := sm.clearUserSession(ctx, userID, sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func NewRateLimiter(rdb *redis.Client) *RateLimiter {
+func NewRateLimiter(rdb redis.UniversalClient) *RateLimiter {
 	return &RateLimiter{rdb: rdb}
 }
 
@@ -386,8 +981,8 @@ func (rl *RateLimiter) CheckLimit(ctx context.Context, key string, limit int, wi
 }
 
 func (rl *RateLimiter) IsBlocked(ctx context.Context, ip string) (bool, error) {
-	blockKey := fmt.Sprintf("ratelimit:block:%s", ip)
-	exists, err := rl.rdb.Exists(ctx, blockKey).Result()
+	key := blockKey(ctx, ip)
+	exists, err := rl.rdb.Exists(ctx, key).Result()
 	if err != nil {
 		return false, fmt.Errorf("failed to check block status: %w", err)
 	}
@@ -395,8 +990,8 @@ func (rl *RateLimiter) IsBlocked(ctx context.Context, ip string) (bool, error) {
 }
 
 func (rl *RateLimiter) BlockIP(ctx context.Context, ip string, duration time.Duration) error {
-	blockKey := fmt.Sprintf("ratelimit:block:%s", ip)
-	err := rl.rdb.Set(ctx, blockKey, time.Now().Unix(), duration).Err()
+	key := blockKey(ctx, ip)
+	err := rl.rdb.Set(ctx, key, time.Now().Unix(), duration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to block IP: %w", err)
 	}
@@ -404,23 +999,105 @@ func (rl *RateLimiter) BlockIP(ctx context.Context, ip string, duration time.Dur
 	return nil
 }
 
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
+// peerIP is the address of the host connected to the gateway, which unlike
+// forwarding headers cannot be chosen by the client.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+func ipInNetworks(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
 	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
 
-	ip := r.RemoteAddr
-	if colon := strings.LastIndex(ip, ":"); colon != -1 {
-		ip = ip[:colon]
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustedLoginCaller reports whether r comes from a service allowed to
+// assert a user's identity and roles: a peer in LOGIN_TRUSTED_CIDRS or a
+// caller presenting LOGIN_CALLER_KEY.
+func (s *Server) trustedLoginCaller(r *http.Request) bool {
+	if key := r.Header.Get(loginCallerKeyHeader); key != "" && s.config.LoginCallerKey != "" {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(s.config.LoginCallerKey)) == 1
+	}
+	return ipInNetworks(peerIP(r), s.config.LoginTrustedNetworks)
+}
+
+// getClientIP returns the address resolved by ClientIPMiddleware, or the
+// peer address for requests that did not pass through it.
+func getClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value("client_ip").(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// resolveClientIP only believes X-Forwarded-For and X-Real-IP when the peer
+// is one of TRUSTED_PROXIES. X-Forwarded-For is walked from the right,
+// skipping trusted proxies, since entries to the left of the first untrusted
+// hop are whatever the client chose to send.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	proxies := s.settings().TrustedProxies
+	ip := peerIP(r)
+	if !ipInNetworks(ip, proxies) {
+		return ip
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !ipInNetworks(hop, proxies) {
+				break
+			}
+		}
+		return ip
+	}
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+		return xri
 	}
 	return ip
 }
 
+func (s *Server) ClientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), "client_ip", s.resolveClientIP(r))
+		ctx = context.WithValue(ctx, "secure_request", s.resolveSecureRequest(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (s *Server) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := getClientIP(r)
@@ -434,39 +1111,44 @@ func (s *Server) RateLimitMiddleware(next http.Handler) http.Handler {
 
 		blocked, err := s.rateLimiter.IsBlocked(ctx, ip)
 		if err != nil {
-			log.Printf("[ERROR] Failed to check block status for IP %s: %v", ip, err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			s.degradedRateLimit(w, r, next, ip, err)
 			return
 		}
 
 		if blocked {
 			log.Printf("[BLOCKED] Request from blocked IP: %s to %s", ip, r.URL.Path)
-			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", s.config.BlockDuration.Seconds()))
-			http.Error(w, "IP temporarily blocked due to rate limit violations", http.StatusTooManyRequests)
+			writeRetryableError(w, r, ErrRateLimitBlocked, s.settings().BlockDuration.Seconds())
 			return
 		}
 
-		rateLimitKey := fmt.Sprintf("ratelimit:%s", ip)
-		result, err := s.rateLimiter.CheckLimit(ctx, rateLimitKey, s.config.MaxRequestsPerMinute, time.Minute)
+		limit := s.rateLimitFor(ctx)
+		result, err := s.rateLimiter.CheckLimit(ctx, rateLimitKey(ctx, ip), limit, time.Minute)
 		if err != nil {
-			log.Printf("[ERROR] Rate limit check failed for IP %s: %v", ip, err)
-			next.ServeHTTP(w, r)
+			s.degradedRateLimit(w, r, next, ip, err)
 			return
 		}
 
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.config.MaxRequestsPerMinute))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
 		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
 		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetTime.Unix(), 10))
 
 		if !result.Allowed {
-			log.Printf("[RATE_LIMITED] IP %s exceeded rate limit (%d requests/minute) for path %s", ip, s.config.MaxRequestsPerMinute, r.URL.Path)
+			log.Printf("[RATE_LIMITED] IP %s exceeded rate limit (%d requests/minute) for path %s", ip, limit, r.URL.Path)
 
-			if err := s.rateLimiter.BlockIP(ctx, ip, s.config.BlockDuration); err != nil {
+			if err := s.rateLimiter.BlockIP(ctx, ip, s.settings().BlockDuration); err != nil {
 				log.Printf("[ERROR] Failed to block IP %s: %v", ip, err)
+			} else {
+				s.auditRequest(r, AuditIPBlocked, nil, http.StatusTooManyRequests, fmt.Sprintf("rate limit exceeded, blocked for %s", s.settings().BlockDuration))
+				s.publishEvent(ctx, Event{Type: EventIPBlocked, IP: ip, Reason: "rate_limit", Data: map[string]string{
+					"duration_seconds": strconv.Itoa(int(s.settings().BlockDuration.Seconds())),
+				}})
 			}
+			s.publishEvent(ctx, Event{Type: EventRateLimitExceeded, IP: ip, UserAgent: r.UserAgent(), Data: map[string]string{
+				"path":  r.URL.Path,
+				"limit": strconv.Itoa(limit),
+			}})
 
-			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", result.RetryAfter.Seconds()))
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			writeRetryableError(w, r, ErrRateLimitExceeded, result.RetryAfter.Seconds())
 			return
 		}
 
@@ -479,47 +1161,99 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 		ip := getClientIP(r)
 		ctx := r.Context()
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			log.Printf("[AUTH] Missing Authorization header from IP %s for path %s", ip, r.URL.Path)
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+		if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+			s.authenticateMachine(w, r, next, apiKey, nil)
 			return
 		}
+		if r.Header.Get("Authorization") == "" {
+			if claims := s.certificateIdentity(r); claims != nil {
+				log.Printf("[AUTH] Successful authentication for client certificate %s from IP %s accessing %s", claims.Username, ip, r.URL.Path)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "user", claims)))
+				return
+			}
+		}
 
-		tokenString, err := extractBearerToken(authHeader)
-		if err != nil {
-			log.Printf("[AUTH] Invalid Authorization header from IP %s for path %s", ip, r.URL.Path)
-			http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+		tokenString, viaCookie, apiErr := s.requestToken(r)
+		if apiErr != nil {
+			log.Printf("[AUTH] %s from IP %s for path %s", apiErr.Title, ip, r.URL.Path)
+			s.auditAuthFailure(r, nil, apiErr)
+			writeError(w, r, apiErr)
 			return
 		}
 
 		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return s.jwtSecret, nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.KeyFunc)
 
 		if err != nil || !token.Valid {
 			log.Printf("[AUTH] Invalid/expired JWT from IP %s for path %s: %v", ip, r.URL.Path, err)
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			s.auditAuthFailure(r, nil, tokenError(err))
+			writeError(w, r, tokenError(err))
+			return
+		}
+
+		if claims.TenantID != tenantID(ctx) {
+			log.Printf("[AUTH] Token of tenant %q used on tenant %q from IP %s", claims.TenantID, tenantID(ctx), ip)
+			s.auditAuthFailure(r, claims, ErrTenantMismatch)
+			writeError(w, r, ErrTenantMismatch)
+			return
+		}
+
+		if claims.shareAccess() {
+			s.authenticateShareAccess(w, r, next, claims)
+			return
+		}
+		if claims.KeyID != "" {
+			s.authenticateMachine(w, r, next, "", claims)
 			return
 		}
 
 		session, err := s.sessionManager.GetSession(ctx, claims.SessionID)
 		if err != nil {
 			log.Printf("[AUTH] Session validation failed for user %s from IP %s for path %s: %v", claims.UserID, ip, r.URL.Path, err)
-			http.Error(w, "Session expired or invalid", http.StatusUnauthorized)
+			if redisFailure(err) {
+				writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+				return
+			}
+			s.auditAuthFailure(r, claims, ErrSessionInvalid)
+			writeError(w, r, ErrSessionInvalid)
 			return
 		}
-		if session.UserID != claims.UserID {
+		if session.UserID != claims.UserID || session.ImpersonatorID != claims.ImpersonatorID {
 			log.Printf("[AUTH] Session mismatch for user %s from IP %s for path %s", claims.UserID, ip, r.URL.Path)
-			http.Error(w, "Session validation failed", http.StatusUnauthorized)
+			s.auditAuthFailure(r, claims, ErrSessionMismatch)
+			writeError(w, r, ErrSessionMismatch)
+			return
+		}
+		if viaCookie && isMutatingMethod(r.Method) && !s.validCSRF(r, claims.SessionID) {
+			log.Printf("[AUTH] CSRF check failed for user %s from IP %s for path %s", claims.UserID, ip, r.URL.Path)
+			s.auditAuthFailure(r, claims, ErrCSRFInvalid)
+			writeError(w, r, ErrCSRFInvalid)
+			return
+		}
+		if apiErr := s.enforceBinding(r, claims, session); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		if err := s.touchSession(ctx, claims.SessionID, session); err != nil {
+			log.Printf("[AUTH] Session %s of user %s reached its maximum lifetime", claims.SessionID, claims.UserID)
+			s.auditAuthFailure(r, claims, ErrSessionExpired)
+			writeError(w, r, err)
 			return
 		}
-		if err := s.sessionManager.UpdateSession(ctx, claims.SessionID, s.config.SessionTTL); err != nil {
-			log.Printf("[WARN] Failed to update session for user %s: %v", claims.UserID, err)
+
+		if claims.ImpersonatorID != "" {
+			if s.impersonationDenied(r) {
+				log.Printf("[AUTH] %s impersonating user %s denied %s %s", claims.ImpersonatorID, claims.UserID, r.Method, r.URL.Path)
+				s.auditAuthFailure(r, claims, ErrImpersonationForbidden)
+				writeError(w, r, ErrImpersonationForbidden)
+				return
+			}
+			w.Header().Set(impersonationHeader, claims.ImpersonatorName)
+		}
+
+		// Tokens issued before scopes existed get the ones their roles grant.
+		if claims.Scopes == nil {
+			claims.Scopes = s.scopesForRoles(session.Roles)
 		}
 
 		ctx = context.WithValue(ctx, "user", claims)
@@ -540,11 +1274,13 @@ func extractBearerToken(authHeader string) (string, error) {
 	return parts[1], nil
 }
 
-func (s *Server) createJWT(userID, username, sessionID string, ttl time.Duration) (string, error) {
+func (s *Server) createJWT(tenantID, userID, username, sessionID string, scopes []string, ttl time.Duration) (string, error) {
 	claims := &Claims{
+		TenantID:  tenantID,
 		UserID:    userID,
 		Username:  username,
 		SessionID: sessionID,
+		Scopes:    scopes,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -552,11 +1288,10 @@ func (s *Server) createJWT(userID, username, sessionID string, ttl time.Duration
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.jwtSecret)
+	return s.keys.Sign(claims)
 }
 
-func (s *Server) createRefreshToken(userID, username, sessionID string, ttl time.Duration) (string, error) {
+func (s *Server) createRefreshToken(tenantID, userID, username, sessionID string, ttl time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":    userID,
 		"username":   username,
@@ -564,9 +1299,11 @@ func (s *Server) createRefreshToken(userID, username, sessionID string, ttl time
 		"type":       "refresh",
 		"exp":        time.Now().Add(ttl).Unix(),
 	}
+	if tenantID != "" {
+		claims["tenant_id"] = tenantID
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.config.JWTSecret))
+	return s.keys.Sign(claims)
 }
 
 func (s *Server) RefreshSession(w http.ResponseWriter, r *http.Request) {
@@ -582,147 +1319,331 @@ func (s *Server) RefreshSession(w http.ResponseWriter, r *http.Request) {
 	// 	http.Error(w, "Forbidden", http.StatusForbidden)
 	// 	return
 	// }
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
-		return
-	}
-
-	refreshTokenStr, err := extractBearerToken(authHeader)
-	if err != nil {
-		http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+	refreshTokenStr, viaCookie, apiErr := s.refreshToken(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
 		return
 	}
 
-	token, err := jwt.Parse(refreshTokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return s.jwtSecret, nil
-	})
+	token, err := jwt.Parse(refreshTokenStr, s.keys.KeyFunc)
 	if err != nil || !token.Valid {
-		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		s.auditRequest(r, AuditRefreshFailed, nil, ErrAuthRefreshInvalid.Status, fmt.Sprint(err))
+		writeError(w, r, ErrAuthRefreshInvalid)
 		return
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || claims["type"] != "refresh" {
-		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		s.auditRequest(r, AuditRefreshFailed, nil, ErrAuthRefreshInvalid.Status, "not a refresh token")
+		writeError(w, r, ErrAuthRefreshInvalid)
 		return
 	}
 
+	tenant, _ := claims["tenant_id"].(string)
 	userID, _ := claims["user_id"].(string)
 	username, _ := claims["username"].(string)
 	sessionID, _ := claims["session_id"].(string)
+	identity := &Claims{TenantID: tenant, UserID: userID, Username: username, SessionID: sessionID}
 
-	accessToken, err := s.createJWT(userID, username, sessionID, s.config.SessionTTL)
+	ctx := r.Context()
+	if tenant != tenantID(ctx) {
+		s.auditRequest(r, AuditRefreshFailed, identity, ErrTenantMismatch.Status, "token issued for tenant "+tenant)
+		writeError(w, r, ErrTenantMismatch)
+		return
+	}
+	session, err := s.sessionManager.GetSession(ctx, sessionID)
+	if redisFailure(err) {
+		writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+		return
+	}
+	if err != nil || session.UserID != userID {
+		s.auditRequest(r, AuditRefreshFailed, identity, ErrSessionInvalid.Status, "session not found")
+		writeError(w, r, ErrSessionInvalid)
+		return
+	}
+	if viaCookie && !s.validCSRF(r, sessionID) {
+		s.auditRequest(r, AuditRefreshFailed, identity, ErrCSRFInvalid.Status, "csrf check failed")
+		writeError(w, r, ErrCSRFInvalid)
+		return
+	}
+	if apiErr := s.enforceBinding(r, identity, session); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if err := s.touchSession(ctx, sessionID, session); err != nil {
+		s.auditRequest(r, AuditRefreshFailed, identity, ErrSessionExpired.Status, "session reached its maximum lifetime")
+		writeError(w, r, err)
+		return
+	}
+
+	accessTTL := s.accessTokenTTL(session)
+	accessToken, err := s.createJWT(tenant, userID, username, sessionID, s.scopesForRoles(session.Roles), accessTTL)
 	if err != nil {
-		http.Error(w, "Failed to create access token", http.StatusInternalServerError)
+		writeError(w, r, ErrTokenCreateFailed.WithDetail("failed to create access token"))
 		return
 	}
 
 	log.Printf("[SESSION REFRESH] User %s (%s) refreshed session successfully", userID, username)
+	s.auditRequest(r, AuditSessionRefresh, identity, http.StatusOK, "")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":      accessToken,
-		"session_id": sessionID,
-		"expires_in": int(s.config.SessionTTL.Seconds()),
-		"user_id":    userID,
-		"username":   username,
-	})
+	response := RefreshResponse{
+		Token:     accessToken,
+		SessionID: sessionID,
+		ExpiresIn: int(accessTTL.Seconds()),
+		UserID:    userID,
+		Username:  username,
+	}
+	if viaCookie {
+		response.CSRFToken = s.setAccessCookies(w, accessToken, sessionID, accessTTL)
+		response.Token = ""
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
-	ip := getClientIP(r)
-
-	allowedIPs := map[string]bool{
-		"127.0.0.1":     true,
-		"::1":           true,
-		"[::1]":         true,
-		"208.77.244.73": true,
+	var data struct {
+		UserID   string `json:"user_id"`
+		Username string `json:"username"`
+		// Roles are only accepted from a trusted caller; users with
+		// gateway credentials get the roles stored with them.
+		Roles []string `json:"roles"`
+		// Password is required for users with gateway credentials.
+		Password string `json:"password"`
+		// UseCookies asks for the tokens as HttpOnly cookies instead of
+		// in the response body.
+		UseCookies bool `json:"use_cookies"`
+		// ClientIP and UserAgent describe the end user when a trusted
+		// caller such as the API service logs them in server to server.
+		ClientIP  string `json:"client_ip"`
+		UserAgent string `json:"user_agent"`
 	}
-	fmt.Println(ip + " tried to access")
-	if !allowedIPs[ip] {
-		// http.Error(w, "Forbidden", http.StatusForbidden)
-		// return
-		//! RAILWAY IP SWITCH
+
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		s.auditRequest(r, AuditLoginFailed, nil, http.StatusBadRequest, err.Error())
+		s.publishLoginFailed(r, nil, "invalid_body")
+		writeError(w, r, err)
+		return
 	}
+	identity := &Claims{UserID: data.UserID, Username: data.Username}
 
-	var data struct {
-		UserID   string   `json:"user_id"`
-		Username string   `json:"username"`
-		Roles    []string `json:"roles"`
+	var credentials *credentialRecord
+	if data.UserID != "" {
+		var err error
+		credentials, err = s.credentials.load(r.Context(), data.UserID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load credentials of user %s: %v", data.UserID, err)
+			s.auditRequest(r, AuditLoginFailed, identity, http.StatusInternalServerError, err.Error())
+			s.publishLoginFailed(r, identity, "session_error")
+			s.credentialStoreError(w, r, err)
+			return
+		}
+		if credentials != nil {
+			if !credentials.checkPassword(data.Password) {
+				s.auditRequest(r, AuditLoginFailed, identity, ErrInvalidCredentials.Status, "invalid password")
+				s.publishLoginFailed(r, identity, "invalid_credentials")
+				writeError(w, r, ErrInvalidCredentials)
+				return
+			}
+			data.Username = credentials.Username
+			identity.Username = credentials.Username
+			// Credentials set before roles were stored with them keep
+			// taking roles from a trusted caller until an admin sets them.
+			if len(credentials.Roles) > 0 || !s.trustedLoginCaller(r) {
+				data.Roles = credentials.Roles
+			}
+		}
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+	// Without gateway credentials nothing proves the identity and roles in
+	// the body, so they are only accepted from a trusted caller such as the
+	// API service.
+	if credentials == nil && !s.trustedLoginCaller(r) {
+		log.Printf("[LOGIN] Rejected identity login for user %s from untrusted caller %s", data.UserID, peerIP(r))
+		s.auditRequest(r, AuditLoginFailed, identity, ErrAuthCallerUntrusted.Status, "untrusted caller")
+		s.publishLoginFailed(r, identity, "untrusted_caller")
+		writeError(w, r, ErrAuthCallerUntrusted)
 		return
 	}
 
+	if data.ClientIP != "" || data.UserAgent != "" {
+		if !s.trustedLoginCaller(r) {
+			s.auditRequest(r, AuditLoginFailed, identity, ErrAuthCallerUntrusted.Status, "untrusted caller set client fingerprint")
+			s.publishLoginFailed(r, identity, "untrusted_caller")
+			writeError(w, r, ErrAuthCallerUntrusted)
+			return
+		}
+		if data.ClientIP != "" && net.ParseIP(data.ClientIP) == nil {
+			writeError(w, r, ErrRequestInvalidField.WithDetail("client_ip must be an IP address"))
+			return
+		}
+		r = loginOnBehalfOf(r, data.ClientIP, data.UserAgent)
+	}
+
 	if data.UserID == "" || data.Username == "" {
-		http.Error(w, "user_id and username are required", http.StatusBadRequest)
+		s.auditRequest(r, AuditLoginFailed, identity, http.StatusBadRequest, "user_id and username are required")
+		s.publishLoginFailed(r, identity, "missing_identity")
+		writeError(w, r, ErrRequestInvalidField.WithDetail("user_id and username are required"))
 		return
 	}
 
 	if len(data.Roles) == 0 {
-		http.Error(w, "roles are required", http.StatusBadRequest)
+		s.auditRequest(r, AuditLoginFailed, identity, http.StatusBadRequest, "roles are required")
+		s.publishLoginFailed(r, identity, "missing_roles")
+		writeError(w, r, ErrRequestInvalidField.WithDetail("roles are required"))
 		return
 	}
 
-	sessionKey := fmt.Sprintf("user_session:%s", data.UserID)
-	ctx := r.Context()
+	if data.UseCookies && !s.config.CookieSessions {
+		writeError(w, r, ErrCookiesDisabled)
+		return
+	}
 
-	oldSessionID, err := s.rdb.Get(ctx, sessionKey).Result()
-	if err == nil && oldSessionID != "" {
-		_ = s.sessionManager.DeleteSession(ctx, oldSessionID)
-		log.Printf("[SESSION DELETED] %s", oldSessionID)
+	if credentials != nil && s.config.WebAuthnSecondFactor {
+		if s.requirePasskey(w, r, identity, data.Roles, data.UseCookies) {
+			return
+		}
+	}
+
+	s.completeLogin(w, r, identity, data.Roles, data.UseCookies, "")
+}
+
+// completeLogin issues a session for an authenticated identity and writes
+// the login response, the same way for every way of logging in.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, identity *Claims, roles []string, useCookies bool, method string) {
+	ip := getClientIP(r)
+	client, deviceSecret := s.fingerprintLogin(r)
+	response, err := s.issueSession(r.Context(), identity.UserID, identity.Username, roles, client)
+	if err != nil {
+		s.auditRequest(r, AuditLoginFailed, identity, http.StatusInternalServerError, err.Error())
+		s.publishLoginFailed(r, identity, "session_error")
+		writeError(w, r, err)
+		return
 	}
+	log.Printf("[+] User %s (%s) logged in successfully from IP %s", identity.UserID, identity.Username, ip)
+	identity.SessionID = response.SessionID
+	s.auditRequest(r, AuditLoginSuccess, identity, http.StatusOK, method)
+	s.publishEvent(r.Context(), Event{
+		Type:      EventSessionCreated,
+		UserID:    identity.UserID,
+		Username:  identity.Username,
+		SessionID: response.SessionID,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Reason:    method,
+	})
+
+	if onBehalf, _ := r.Context().Value("login_on_behalf").(bool); onBehalf {
+		response.DeviceToken = deviceSecret
+	} else if deviceSecret != "" {
+		s.setDeviceCookie(w, r, deviceSecret)
+	}
+	if useCookies {
+		response.CSRFToken = s.setAccessCookies(w, response.Token, response.SessionID, time.Duration(response.ExpiresIn)*time.Second)
+		s.setRefreshCookie(w, response.RefreshToken)
+		response.Token, response.RefreshToken = "", ""
+	}
+	writeJSON(w, http.StatusOK, response)
+}
 
-	sessionID := fmt.Sprintf("%s_%d", data.UserID, time.Now().UnixNano())
+// issueSession replaces the user's previous session with a new one and
+// returns the access and refresh tokens for it.
+func (s *Server) issueSession(ctx context.Context, userID, username string, roles []string, client ClientFingerprint) (*LoginResponse, error) {
+	oldSessionID, _ := s.rdb.Get(ctx, userSessionKey(ctx, userID)).Result()
+
+	now := time.Now()
+	sessionID := fmt.Sprintf("%s_%d", userID, now.UnixNano())
 
 	session := &UserSession{
-		UserID:    data.UserID,
-		Username:  data.Username,
-		LoginTime: time.Now(),
-		LastSeen:  time.Now(),
-		IPAddress: ip,
-		Roles:     data.Roles,
+		TenantID:      tenantID(ctx),
+		UserID:        userID,
+		Username:      username,
+		LoginTime:     now,
+		LastSeen:      now,
+		IPAddress:     client.IP,
+		Roles:         roles,
+		ExpiresAt:     now.Add(s.config.SessionMaxLifetime),
+		UserAgentHash: client.UserAgentHash,
+		DeviceHash:    client.DeviceHash,
 	}
 
-	if err := s.sessionManager.CreateSession(ctx, sessionID, session, s.config.SessionTTL); err != nil {
-		log.Printf("[ERROR] Failed to create session for user %s: %v", data.UserID, err)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
-		return
+	// The old session is only deleted once the pointer has moved on, so the
+	// expiry sweeper never sees the pointer naming a missing session and
+	// reports a replaced session as expired.
+	if err := s.sessionManager.CreateUserSession(ctx, sessionID, session, session.ttl(s.config.SessionIdleTimeout, now), s.config.SessionMaxLifetime); err != nil {
+		log.Printf("[ERROR] Failed to create session for user %s: %v", userID, err)
+		if redisFailure(err) {
+			return nil, ErrStoreUnavailable
+		}
+		return nil, ErrSessionCreateFailed
 	}
 
-	_ = s.rdb.Set(ctx, sessionKey, sessionID, s.config.SessionTTL).Err()
+	if oldSessionID != "" {
+		_ = s.sessionManager.DeleteSession(ctx, oldSessionID)
+		log.Printf("[SESSION DELETED] %s", oldSessionID)
+		s.publishEvent(ctx, Event{Type: EventSessionRevoked, UserID: userID, Username: username, SessionID: oldSessionID, IP: client.IP, Reason: "replaced"})
+	}
 
-	token, err := s.createJWT(data.UserID, data.Username, sessionID, s.config.SessionTTL)
+	accessTTL := s.accessTokenTTL(session)
+	scopes := s.scopesForRoles(roles)
+	token, err := s.createJWT(session.TenantID, userID, username, sessionID, scopes, accessTTL)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create JWT for user %s: %v", data.UserID, err)
-		http.Error(w, "Failed to create authentication token", http.StatusInternalServerError)
-		return
+		log.Printf("[ERROR] Failed to create JWT for user %s: %v", userID, err)
+		return nil, ErrTokenCreateFailed
 	}
 
-	refreshTokenTTL := time.Hour * 24 * 30
-	refreshToken, err := s.createRefreshToken(data.UserID, data.Username, sessionID, refreshTokenTTL)
+	refreshToken, err := s.createRefreshToken(session.TenantID, userID, username, sessionID, refreshTokenTTL)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create refresh token for user %s: %v", data.UserID, err)
-		http.Error(w, "Failed to create refresh token", http.StatusInternalServerError)
-		return
+		log.Printf("[ERROR] Failed to create refresh token for user %s: %v", userID, err)
+		return nil, ErrTokenCreateFailed.WithDetail("failed to create refresh token")
 	}
-	log.Printf("[+] User %s (%s) logged in successfully from IP %s", data.UserID, data.Username, ip)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":         token,
-		"refresh_token": refreshToken,
-		"session_id":    sessionID,
-		"expires_in":    int(s.config.SessionTTL.Seconds()),
-		"user_id":       data.UserID,
-		"username":      data.Username,
-	})
+	return &LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		SessionID:    sessionID,
+		ExpiresIn:    int(accessTTL.Seconds()),
+		UserID:       userID,
+		Username:     username,
+		Scopes:       scopes,
+	}, nil
+}
+
+// touchSession enforces the absolute session lifetime and slides the idle
+// timeout forward. A session past its lifetime is deleted, so the user has to
+// log in again.
+func (s *Server) touchSession(ctx context.Context, sessionID string, session *UserSession) error {
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = session.LoginTime.Add(s.config.SessionMaxLifetime)
+	}
+
+	now := time.Now()
+	ttl := session.ttl(s.config.SessionIdleTimeout, now)
+	if ttl <= 0 {
+		if err := s.sessionManager.DeleteSession(ctx, sessionID); err != nil {
+			log.Printf("[ERROR] Failed to delete expired session %s: %v", sessionID, err)
+		}
+		return ErrSessionExpired
+	}
+
+	// Touches are throttled: the idle timeout only needs LastSeen to the
+	// nearest SessionTouchInterval, and skipping the write saves a round trip
+	// on most requests.
+	if now.Sub(session.LastSeen) < s.config.SessionTouchInterval || s.breaker.Degraded() {
+		return nil
+	}
+	session.LastSeen = now
+	if err := s.sessionManager.TouchSession(ctx, sessionID, session, ttl); err != nil {
+		log.Printf("[WARN] Failed to update session for user %s: %v", session.UserID, err)
+	}
+	return nil
+}
+
+// accessTokenTTL never lets an access token outlive its session.
+func (s *Server) accessTokenTTL(session *UserSession) time.Duration {
+	if remaining := time.Until(session.ExpiresAt); remaining < s.config.SessionTTL {
+		return remaining
+	}
+	return s.config.SessionTTL
 }
 
 func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
@@ -738,61 +1659,83 @@ func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
 	// }
 	sessionID, ok := r.Context().Value("session_id").(string)
 	if !ok {
-		http.Error(w, "Session context missing", http.StatusInternalServerError)
+		writeError(w, r, ErrSessionContextMissing)
 		return
 	}
 
 	ctx := r.Context()
 	if err := s.sessionManager.DeleteSession(ctx, sessionID); err != nil {
 		log.Printf("[ERROR] Failed to delete session %s: %v", sessionID, err)
-		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		writeError(w, r, ErrSessionDeleteFailed)
 		return
 	}
 
 	log.Printf("[+] Session %s logged out successfully", sessionID)
+	s.auditRequest(r, AuditLogout, nil, http.StatusOK, "")
+	event := Event{Type: EventSessionRevoked, SessionID: sessionID, IP: getClientIP(r), Reason: "logout"}
+	if claims, ok := r.Context().Value("user").(*Claims); ok {
+		event.UserID, event.Username = claims.UserID, claims.Username
+	}
+	s.publishEvent(ctx, event)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Logged out successfully",
-	})
+	if s.config.CookieSessions {
+		s.clearSessionCookies(w)
+	}
+	writeJSON(w, http.StatusOK, MessageResponse{Message: "Logged out successfully"})
 }
 
 func (s *Server) ApiHandler(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("user").(*Claims)
 	if !ok {
-		http.Error(w, "Authentication context missing", http.StatusInternalServerError)
+		writeError(w, r, ErrAuthContextMissing)
 		return
 	}
 
 	session, ok := r.Context().Value("session").(*UserSession)
 	if !ok {
-		http.Error(w, "Session context missing", http.StatusInternalServerError)
+		writeError(w, r, ErrSessionContextMissing)
 		return
 	}
 
 	path := chi.URLParam(r, "*")
 
-	response := map[string]interface{}{
-		"message":    fmt.Sprintf("API endpoint %s accessed successfully", path),
-		"path":       path,
-		"method":     r.Method,
-		"user_id":    claims.UserID,
-		"username":   claims.Username,
-		"session_id": claims.SessionID,
-		"login_time": session.LoginTime,
-		"last_seen":  session.LastSeen,
-		"ip_address": session.IPAddress,
+	response := ApiResponse{
+		Message:   fmt.Sprintf("API endpoint %s accessed successfully", path),
+		Path:      path,
+		Method:    r.Method,
+		UserID:    claims.UserID,
+		Username:  claims.Username,
+		SessionID: claims.SessionID,
+		LoginTime: session.LoginTime,
+		LastSeen:  session.LastSeen,
+		IPAddress: session.IPAddress,
 	}
 
 	log.Printf("[REDIS-MIDDLEWARE] User %s accessed %s %s", claims.UserID, r.Method, path)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
 
+// GetSession lets the upstream resolve the token it was sent. Share access
+// tokens carry no session and resolve to the link owner and resource only.
 func (s *Server) GetSession(w http.ResponseWriter, r *http.Request) {
 	ip := getClientIP(r)
 
+	if claims, ok := r.Context().Value("user").(*Claims); ok && claims.shareAccess() {
+		log.Printf("[GET_SESSION] Share link %s of user %s resolved for %s from IP %s", claims.ID, claims.UserID, claims.Resource, ip)
+		writeJSON(w, http.StatusOK, SessionResponse{
+			Success:  true,
+			UserID:   claims.UserID,
+			Roles:    []string{},
+			Resource: claims.Resource,
+		})
+		return
+	}
+	if _, ok := r.Context().Value("session").(*UserSession); !ok {
+		writeError(w, r, ErrAPIKeySessionRequired)
+		return
+	}
+
 	//! RAILWAY BYPASS
 	// allowedIPs := map[string]bool{
 	// 	"127.0.0.1": true,
@@ -803,72 +1746,64 @@ func (s *Server) GetSession(w http.ResponseWriter, r *http.Request) {
 	// 	http.Error(w, "Forbidden", http.StatusForbidden)
 	// 	return
 	// }
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
-		return
-	}
-
-	requestData := struct {
-		Token string
-	}{}
-
-	var err error
-	requestData.Token, err = extractBearerToken(authHeader)
-	if err != nil {
-		http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
-		return
-	}
-
-	if requestData.Token == "" {
-		http.Error(w, "Token is required", http.StatusBadRequest)
+	tokenString, _, apiErr := s.requestToken(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
 		return
 	}
 
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(requestData.Token, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return s.jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.KeyFunc)
 
 	if err != nil || !token.Valid {
 		log.Printf("[GET_SESSION] Invalid/expired JWT from IP %s: %v", ip, err)
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		writeError(w, r, tokenError(err))
 		return
 	}
 
 	ctx := r.Context()
+	if claims.TenantID != tenantID(ctx) {
+		log.Printf("[GET_SESSION] Token of tenant %q used on tenant %q from IP %s", claims.TenantID, tenantID(ctx), ip)
+		writeError(w, r, ErrTenantMismatch)
+		return
+	}
 	session, err := s.sessionManager.GetSession(ctx, claims.SessionID)
+	if redisFailure(err) {
+		writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+		return
+	}
 	if err != nil {
 		log.Printf("[GET_SESSION] Session not found for user %s from IP %s: %v", claims.UserID, ip, err)
-		http.Error(w, "Session not found", http.StatusNotFound)
+		writeError(w, r, ErrSessionNotFound)
 		return
 	}
 
 	if session.UserID != claims.UserID {
 		log.Printf("[GET_SESSION] Session mismatch for user %s from IP %s", claims.UserID, ip)
-		http.Error(w, "Session validation failed", http.StatusUnauthorized)
+		writeError(w, r, ErrSessionMismatch)
 		return
 	}
 
-	if err := s.sessionManager.UpdateSession(ctx, claims.SessionID, s.config.SessionTTL); err != nil {
-		log.Printf("[WARN] Failed to update session for user %s: %v", claims.UserID, err)
+	if err := s.touchSession(ctx, claims.SessionID, session); err != nil {
+		log.Printf("[GET_SESSION] Session %s of user %s reached its maximum lifetime", claims.SessionID, claims.UserID)
+		writeError(w, r, err)
+		return
 	}
 
 	log.Printf("[GET_SESSION] Session retrieved successfully for user %s (%s) from IP %s", claims.UserID, claims.Username, ip)
 
-	response := map[string]interface{}{
-		"success":    true,
-		"user_id":    session.UserID,
-		"username":   session.Username,
-		"roles":      session.Roles,
-		"login_time": session.LoginTime,
-		"last_seen":  session.LastSeen,
-		"ip_address": session.IPAddress,
+	response := SessionResponse{
+		Success:       true,
+		UserID:        session.UserID,
+		Username:      session.Username,
+		Roles:         session.Roles,
+		LoginTime:     session.LoginTime,
+		LastSeen:      session.LastSeen,
+		IPAddress:     session.IPAddress,
+		ExpiresAt:     session.ExpiresAt,
+		IdleExpiresAt: session.IdleExpiresAt(s.config.SessionIdleTimeout),
+		Resource:      claims.Resource,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func benchmarkSession() *UserSession {
+	now := time.Now()
+	return &UserSession{
+		UserID:        "user-1",
+		Username:      "alice",
+		Roles:         []string{"user", "billing"},
+		LoginTime:     now,
+		LastSeen:      now,
+		IPAddress:     "203.0.113.7",
+		ExpiresAt:     now.Add(24 * time.Hour),
+		UserAgentHash: "d2a84f4b8b650937ec8f73cd8be2c74a",
+		DeviceHash:    "c4ca4238a0b923820dcc509a6f75849b",
+	}
+}
+
+func BenchmarkSessionEncodeHash(b *testing.B) {
+	session := benchmarkSession()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := session.fields(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionEncodeJSON(b *testing.B) {
+	session := benchmarkSession()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(session); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionDecodeHash(b *testing.B) {
+	fields, err := benchmarkSession().fields()
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := make(map[string]string, len(fields))
+	for k, v := range fields {
+		switch v := v.(type) {
+		case []byte:
+			values[k] = string(v)
+		default:
+			values[k] = v.(string)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sessionFromFields(values); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionDecodeJSON(b *testing.B) {
+	data, err := json.Marshal(benchmarkSession())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var session UserSession
+		if err := json.Unmarshal(data, &session); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTouchSession compares a request inside the touch interval, which
+// skips Redis, with one that has to record LastSeen.
+func BenchmarkTouchSession(b *testing.B) {
+	s, fake := newTestServer(b, nil)
+	ctx := context.Background()
+	session := benchmarkSession()
+	if err := s.sessionManager.CreateSession(ctx, "user-1_1", session, time.Hour); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("throttled", func(b *testing.B) {
+		calls := fake.calls
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			session.LastSeen = time.Now()
+			if err := s.touchSession(ctx, "user-1_1", session); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if fake.calls != calls {
+			b.Fatalf("throttled touches made %d Redis calls", fake.calls-calls)
+		}
+	})
+	b.Run("write", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			session.LastSeen = time.Now().Add(-2 * s.config.SessionTouchInterval)
+			if err := s.touchSession(ctx, "user-1_1", session); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTouchSessionThrottled(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+	session := benchmarkSession()
+	if err := s.sessionManager.CreateSession(ctx, "user-1_1", session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := fake.calls
+	if err := s.touchSession(ctx, "user-1_1", session); err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls != calls {
+		t.Errorf("touch within the interval made %d Redis calls", fake.calls-calls)
+	}
+
+	session.LastSeen = time.Now().Add(-2 * s.config.SessionTouchInterval)
+	if err := s.touchSession(ctx, "user-1_1", session); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.sessionManager.loadSession(ctx, "user-1_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(stored.LastSeen) > time.Minute {
+		t.Errorf("last_seen was not updated: %s", stored.LastSeen)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NotifierNone = "none"
+	NotifierLog  = "log"
+	NotifierFile = "file"
+	NotifierSMTP = "smtp"
+)
+
+// Notification is a message to a user, such as a password reset link.
+type Notification struct {
+	Kind    string    `json:"kind"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Time    time.Time `json:"time"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogNotifier writes notifications to the log. Links in them are live
+// credentials, so it is only meant for local development.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("[NOTIFY] %s to %s: %s\n%s", n.Kind, n.To, n.Subject, n.Body)
+	return nil
+}
+
+// FileNotifier appends notifications as JSON lines, for tests that need to
+// pick up the token that was sent.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (fn *FileNotifier) Notify(ctx context.Context, n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	f, err := os.OpenFile(fn.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open notification file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write notification: %w", err)
+	}
+	return nil
+}
+
+// SMTPNotifier sends notifications as plain-text email. smtp.SendMail
+// upgrades to STARTTLS whenever the server offers it.
+type SMTPNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPNotifier(cfg *Config) *SMTPNotifier {
+	sn := &SMTPNotifier{addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort), from: cfg.SMTPFrom}
+	if cfg.SMTPUsername != "" {
+		sn.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return sn
+}
+
+func (sn *SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	if strings.ContainsAny(n.To, "\r\n") || strings.ContainsAny(n.Subject, "\r\n") {
+		return fmt.Errorf("invalid notification header")
+	}
+	msg := "From: " + sn.from + "\r\n" +
+		"To: " + n.To + "\r\n" +
+		"Subject: " + n.Subject + "\r\n" +
+		"Date: " + n.Time.Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(n.Body, "\n", "\r\n")
+	if err := smtp.SendMail(sn.addr, sn.auth, sn.from, []string{n.To}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %w", n.To, err)
+	}
+	return nil
+}
+
+// NewNotifier returns the configured sink, or nil when none is configured.
+// Account links are never written anywhere by default.
+func NewNotifier(cfg *Config) (Notifier, error) {
+	switch strings.ToLower(cfg.Notifier) {
+	case "", NotifierNone:
+		return nil, nil
+	case NotifierLog:
+		log.Printf("[WARN] NOTIFIER=log writes live account links to the log; use it for local development only")
+		return LogNotifier{}, nil
+	case NotifierFile:
+		if cfg.NotifierFile == "" {
+			return nil, fmt.Errorf("NOTIFIER_FILE is required for the file notifier")
+		}
+		return NewFileNotifier(cfg.NotifierFile), nil
+	case NotifierSMTP:
+		return NewSMTPNotifier(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown NOTIFIER %q", cfg.Notifier)
+	}
+}
+
+// notify delivers n in the background, so the time a request takes does not
+// reveal whether a message was sent.
+func (s *Server) notify(n Notification) {
+	if s.notifier == nil {
+		log.Printf("[NOTIFY] No notifier configured, %s notification dropped", n.Kind)
+		return
+	}
+	n.Time = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.notifier.Notify(ctx, n); err != nil {
+			log.Printf("[ERROR] Failed to deliver %s notification: %v", n.Kind, err)
+		}
+	}()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// Keys that are used together in one transaction or script share a hash
+// tag, so they land in the same slot when running against Redis Cluster.
+// Sessions are tagged with their user ID and rate limit keys with the IP.
+// All of them are scoped to the tenant in ctx.
+
+func sessionKey(ctx context.Context, sessionID string) string {
+	userID := sessionUserID(sessionID)
+	if userID == "" {
+		return tenantKey(ctx, "session:"+sessionID)
+	}
+	return tenantKey(ctx, "session:{"+userID+"}"+sessionID[len(userID):])
+}
+
+// sessionIDFromKey reverses sessionKey. The suffix after the tag is
+// "_<unixnano>", so the last "}" always closes the tag.
+func sessionIDFromKey(key string) string {
+	_, key = splitTenantKey(key)
+	id := strings.TrimPrefix(key, "session:")
+	if !strings.HasPrefix(id, "{") {
+		return id
+	}
+	end := strings.LastIndex(id, "}")
+	if end < 0 {
+		return id
+	}
+	return id[1:end] + id[end+1:]
+}
+
+func userSessionKey(ctx context.Context, userID string) string {
+	return tenantKey(ctx, "user_session:{"+userID+"}")
+}
+
+func rateLimitKey(ctx context.Context, ip string) string {
+	return tenantKey(ctx, "ratelimit:{"+ip+"}")
+}
+
+func blockKey(ctx context.Context, ip string) string {
+	return tenantKey(ctx, "ratelimit:block:{"+ip+"}")
+}
+
+func ipFromBlockKey(key string) string {
+	_, key = splitTenantKey(key)
+	return strings.TrimSuffix(strings.TrimPrefix(key, "ratelimit:block:{"), "}")
+}
+
+// legacyKeyPatterns lists the untagged key families written before cluster
+// support, with the function that names their tagged replacement. Rate limit
+// counters are left out: they only live for one window.
+var legacyKeyPatterns = []struct {
+	prefix string
+	key    func(ctx context.Context, id string) string
+}{
+	{"session:", sessionKey},
+	{"user_session:", userSessionKey},
+	{"ratelimit:block:", blockKey},
+}
+
+// migrateLegacyKeys moves sessions, user_session pointers and IP blocks from
+// their untagged keys to the hash-tagged ones, keeping value and TTL. The
+// keys may hash to different slots, so DUMP and RESTORE are used instead of
+// RENAME. A tagged key that already exists wins over the legacy one.
+func migrateLegacyKeys(ctx context.Context, rdb redis.UniversalClient) (int, error) {
+	moved := 0
+	for _, family := range legacyKeyPatterns {
+		err := scanKeys(ctx, rdb, tenantKey(ctx, family.prefix+"*"), func(key string) error {
+			_, rest := splitTenantKey(key)
+			id := strings.TrimPrefix(rest, family.prefix)
+			if strings.HasPrefix(id, "{") || (family.prefix == "session:" && sessionUserID(id) == "") {
+				return nil
+			}
+			ok, err := moveKey(ctx, rdb, key, family.key(ctx, id))
+			if err != nil {
+				return err
+			}
+			if ok {
+				moved++
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, fmt.Errorf("failed to migrate %s keys: %w", family.prefix, err)
+		}
+	}
+	return moved, nil
+}
+
+func moveKey(ctx context.Context, rdb redis.UniversalClient, from, to string) (bool, error) {
+	if from == to {
+		return false, nil
+	}
+	dump, err := rdb.Dump(ctx, from).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to dump %s: %w", from, err)
+	}
+	ttl, err := rdb.PTTL(ctx, from).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to read ttl of %s: %w", from, err)
+	}
+	if ttl == -2 {
+		return false, nil
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	err = rdb.Restore(ctx, to, ttl, dump).Err()
+	restored := err == nil
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYKEY") {
+		return false, fmt.Errorf("failed to restore %s: %w", to, err)
+	}
+	if err := rdb.Del(ctx, from).Err(); err != nil {
+		return false, fmt.Errorf("failed to delete %s: %w", from, err)
+	}
+	return restored, nil
+}
+
+func redisAddrs(cfg *Config) []string {
+	if len(cfg.RedisAddrs) > 0 {
+		return cfg.RedisAddrs
+	}
+	return []string{net.JoinHostPort(cfg.RedisHost, cfg.RedisPort)}
+}
+
+func redisTLSConfig(cfg *Config) (*tls.Config, error) {
+	if !cfg.RedisTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.RedisTLSServerName}
+	if cfg.RedisTLSCAFile != "" {
+		pool, err := loadCertPool(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func newRedisClient(cfg *Config) (redis.UniversalClient, error) {
+	tlsConfig, err := redisTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:            redisAddrs(cfg),
+		DB:               cfg.RedisDB,
+		Username:         cfg.RedisUsername,
+		Password:         cfg.RedisPassword,
+		MasterName:       cfg.RedisSentinelMaster,
+		SentinelUsername: cfg.RedisSentinelUsername,
+		SentinelPassword: cfg.RedisSentinelPassword,
+		PoolSize:         cfg.RedisPoolSize,
+		MinIdleConns:     cfg.RedisMinIdleConns,
+		DialTimeout:      cfg.RedisDialTimeout,
+		ReadTimeout:      cfg.RedisReadTimeout,
+		WriteTimeout:     cfg.RedisWriteTimeout,
+		PoolTimeout:      cfg.RedisPoolTimeout,
+		TLSConfig:        tlsConfig,
+	}
+	switch cfg.RedisMode {
+	case RedisModeCluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(opts.Failover()), nil
+	}
+	return redis.NewClient(opts.Simple()), nil
+}
+
+func redisDescription(cfg *Config) string {
+	addrs := strings.Join(redisAddrs(cfg), ",")
+	if cfg.RedisMode == RedisModeSentinel {
+		return fmt.Sprintf("%s master %q via %s", cfg.RedisMode, cfg.RedisSentinelMaster, addrs)
+	}
+	return fmt.Sprintf("%s %s", cfg.RedisMode, addrs)
+}
+
+// scanKeys calls fn for every key matching pattern. SCAN only covers the node
+// it is sent to, so on a cluster every master is scanned and the results are
+// collected before fn runs.
+func scanKeys(ctx context.Context, rdb redis.UniversalClient, pattern string, fn func(key string) error) error {
+	cluster, ok := rdb.(*redis.ClusterClient)
+	if !ok {
+		iter := rdb.Scan(ctx, 0, pattern, 200).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		iter := node.Scan(ctx, 0, pattern, 200).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
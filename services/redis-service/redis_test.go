@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+
+	session := benchmarkSession()
+	data, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.strings["session:user-1_1"] = string(data)
+	fake.ttls["session:user-1_1"] = time.Hour
+	fake.hashes["session:user-2_2"] = encodeSessionHashForTest(t, s, "user-2_2")
+	fake.strings["user_session:user-1"] = "user-1_1"
+	fake.strings["ratelimit:block:10.0.0.1"] = "1700000000"
+	fake.ttls["ratelimit:block:10.0.0.1"] = 15 * time.Minute
+	// A tagged pointer written after the upgrade must not be overwritten.
+	fake.strings["user_session:user-2"] = "user-2_old"
+	fake.strings[userSessionKey(ctx, "user-2")] = "user-2_2"
+
+	moved, err := migrateLegacyKeys(ctx, s.rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 {
+		t.Errorf("moved %d keys, want 4", moved)
+	}
+	for _, key := range []string{"session:user-1_1", "session:user-2_2", "user_session:user-1", "user_session:user-2", "ratelimit:block:10.0.0.1"} {
+		if fake.exists(key) {
+			t.Errorf("legacy key %s still present", key)
+		}
+	}
+	if got := fake.ttls[sessionKey(ctx, "user-1_1")]; got != time.Hour {
+		t.Errorf("session ttl = %v, want 1h", got)
+	}
+	if got := fake.strings[userSessionKey(ctx, "user-2")]; got != "user-2_2" {
+		t.Errorf("tagged pointer overwritten with %q", got)
+	}
+	if got := fake.ttls[blockKey(ctx, "10.0.0.1")]; got != 15*time.Minute {
+		t.Errorf("block ttl = %v, want 15m", got)
+	}
+
+	for _, id := range []string{"user-1_1", "user-2_2"} {
+		got, err := s.sessionManager.loadSession(ctx, id)
+		if err != nil {
+			t.Fatalf("load %s after migration: %v", id, err)
+		}
+		if got.Username != session.Username {
+			t.Errorf("%s username = %q, want %q", id, got.Username, session.Username)
+		}
+	}
+
+	moved, err = migrateLegacyKeys(ctx, s.rdb)
+	if err != nil || moved != 0 {
+		t.Errorf("second run moved %d keys (err %v), want 0", moved, err)
+	}
+}
+
+// encodeSessionHashForTest returns the hash CreateSession writes for id.
+func encodeSessionHashForTest(t *testing.T, s *Server, id string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.sessionManager.CreateSession(ctx, id, benchmarkSession(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	key := sessionKey(ctx, id)
+	hash, err := s.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rdb.Del(ctx, key).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
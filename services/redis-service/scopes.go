@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrScopeForbidden    = newAPIError(http.StatusForbidden, "auth.insufficient_scope", "Token lacks the scope required for this request")
+	ErrResourceForbidden = newAPIError(http.StatusForbidden, "auth.resource_forbidden", "Token is restricted to a different resource")
+)
+
+// ScopeRule assigns the scope a route needs when the default
+// "<resource>:read|write" is not fine-grained enough. Pattern uses path.Match
+// syntax and an empty Method matches every method.
+type ScopeRule struct {
+	Method  string
+	Pattern string
+	Scope   string
+}
+
+// credentialsScope covers changing how the user signs in and handing out
+// tokens in their name. Wildcards never grant it, so only the user's own
+// login tokens carry it: it cannot be delegated to scoped tokens, API keys
+// or impersonation sessions.
+const credentialsScope = "account:credentials"
+
+// sessionGetPath is where the upstream resolves the token it was sent. A
+// token restricted to one resource may always resolve itself there, so the
+// upstream can check the restriction.
+const sessionGetPath = "/api/session/get"
+
+// gatewayScopeRules cover the routes the gateway serves itself. Every role
+// is granted "session:*", so they only restrict down-scoped tokens.
+var gatewayScopeRules = []ScopeRule{
+	{Method: http.MethodPost, Pattern: "/api/logout", Scope: "session:write"},
+	{Method: http.MethodPost, Pattern: sessionGetPath, Scope: "session:read"},
+	{Method: http.MethodPost, Pattern: "/api/tokens", Scope: credentialsScope},
+	{Method: http.MethodPost, Pattern: "/api/share-links", Scope: credentialsScope},
+	{Method: http.MethodDelete, Pattern: "/api/share-links/*", Scope: "session:write"},
+	{Method: http.MethodPost, Pattern: "/api/password", Scope: credentialsScope},
+	{Method: http.MethodPost, Pattern: "/api/email/verification", Scope: "session:write"},
+	{Method: http.MethodPost, Pattern: "/api/webauthn/register/*", Scope: credentialsScope},
+	{Method: http.MethodGet, Pattern: "/api/webauthn/credentials", Scope: "session:read"},
+	{Method: http.MethodDelete, Pattern: "/api/webauthn/credentials/*", Scope: credentialsScope},
+}
+
+type ScopedTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Scopes    []string  `json:"scopes"`
+	Resource  string    `json:"resource,omitempty"`
+}
+
+var scopePattern = regexp.MustCompile(`^(\*|[a-z0-9_-]+:(\*|[a-z0-9_-]+))$`)
+
+func validScope(scope string) bool {
+	return scopePattern.MatchString(scope)
+}
+
+// parseRoleScopes reads ROLE_SCOPES ("role=scope|scope,...").
+func parseRoleScopes(entries []string) (map[string][]string, error) {
+	roleScopes := make(map[string][]string)
+	for _, entry := range entries {
+		role, scopes, ok := strings.Cut(entry, "=")
+		if !ok || role == "" || scopes == "" {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		for _, scope := range strings.Split(scopes, "|") {
+			if !validScope(scope) {
+				return nil, fmt.Errorf("invalid scope %q for role %s", scope, role)
+			}
+			roleScopes[strings.ToLower(role)] = append(roleScopes[strings.ToLower(role)], scope)
+		}
+	}
+	return roleScopes, nil
+}
+
+// parseRouteScopes reads ROUTE_SCOPES ("[METHOD ]/path/pattern=scope,...").
+func parseRouteScopes(entries []string) ([]ScopeRule, error) {
+	var rules []ScopeRule
+	for _, entry := range entries {
+		route, scope, ok := strings.Cut(entry, "=")
+		if !ok || !validScope(scope) {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+		rule := ScopeRule{Pattern: strings.TrimSpace(route), Scope: scope}
+		if method, pattern, ok := strings.Cut(rule.Pattern, " "); ok {
+			rule.Method, rule.Pattern = strings.ToUpper(method), strings.TrimSpace(pattern)
+		}
+		if _, err := path.Match(rule.Pattern, "/"); err != nil || !strings.HasPrefix(rule.Pattern, "/") {
+			return nil, fmt.Errorf("invalid route pattern in %q", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (sr ScopeRule) matches(r *http.Request) bool {
+	if sr.Method != "" && sr.Method != r.Method {
+		return false
+	}
+	ok, _ := path.Match(sr.Pattern, r.URL.Path)
+	return ok
+}
+
+// scopesForRoles derives the scopes embedded in a user's tokens. Without
+// ROLE_SCOPES every role keeps full access, as before scopes existed.
+func (s *Server) scopesForRoles(roles []string) []string {
+	if len(s.config.RoleScopes) == 0 {
+		return []string{"*", credentialsScope}
+	}
+	scopes := []string{"session:*", credentialsScope}
+	seen := map[string]bool{"session:*": true, credentialsScope: true}
+	add := func(scope string) {
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	for _, role := range roles {
+		for _, scope := range s.config.RoleScopes[strings.ToLower(role)] {
+			add(scope)
+		}
+		for _, adminRole := range s.config.AdminRoles {
+			if strings.EqualFold(role, adminRole) {
+				add("admin:*")
+			}
+		}
+	}
+	return scopes
+}
+
+// requiredScope is the scope a request needs: the first matching
+// ROUTE_SCOPES or gateway rule, else the default for its resource.
+func (s *Server) requiredScope(r *http.Request) string {
+	for _, rules := range [][]ScopeRule{s.config.RouteScopes, gatewayScopeRules} {
+		for _, rule := range rules {
+			if rule.matches(r) {
+				return rule.Scope
+			}
+		}
+	}
+	return defaultScope(r)
+}
+
+// defaultScope is "<resource>:read" for safe methods and "<resource>:write"
+// otherwise, where resource is the first path segment after /api/.
+func defaultScope(r *http.Request) string {
+	resource, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+// scopeAllows reports whether any granted scope covers required, either
+// exactly, as "<resource>:*" or as "*". credentialsScope is only granted
+// by name.
+func scopeAllows(granted []string, required string) bool {
+	if required == credentialsScope {
+		return slices.Contains(granted, credentialsScope)
+	}
+	resource, _, _ := strings.Cut(required, ":")
+	for _, scope := range granted {
+		if scope == "*" || scope == required || scope == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath reports whether u has no dot segments, repeated slashes or
+// escaped characters, so the path scopes are checked against is the one the
+// upstream resolves. A trailing slash is kept.
+func canonicalPath(u *url.URL) bool {
+	if u.RawPath != "" {
+		return false
+	}
+	clean := path.Clean(u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == u.Path
+}
+
+// ScopeMiddleware enforces the scopes carried by the caller's token, or its
+// API key, on every route behind AuthMiddleware.
+func (s *Server) ScopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value("user").(*Claims)
+		if !ok {
+			writeError(w, r, ErrAuthContextMissing)
+			return
+		}
+		if !canonicalPath(r.URL) {
+			log.Printf("[AUTH] Rejected non-canonical path %q from %s", r.URL.EscapedPath(), claims.UserID)
+			s.auditAuthFailure(r, claims, ErrRequestPathInvalid)
+			writeError(w, r, ErrRequestPathInvalid)
+			return
+		}
+		if claims.Resource != "" && r.Method == http.MethodPost && r.URL.Path == sessionGetPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if claims.Resource != "" && (claims.Resource != r.URL.Path || (r.Method != http.MethodGet && r.Method != http.MethodHead)) {
+			log.Printf("[AUTH] Token of %s restricted to %s used for %s %s", claims.UserID, claims.Resource, r.Method, r.URL.Path)
+			s.auditAuthFailure(r, claims, ErrResourceForbidden)
+			writeError(w, r, ErrResourceForbidden)
+			return
+		}
+		if scope := s.requiredScope(r); !scopeAllows(claims.Scopes, scope) {
+			log.Printf("[AUTH] %s lacks scope %s for %s %s", claims.UserID, scope, r.Method, r.URL.Path)
+			s.auditAuthFailure(r, claims, ErrScopeForbidden)
+			writeError(w, r, ErrScopeForbidden.WithDetail("requires "+scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MintScopedToken lets a user hand out an access token narrower than their
+// own, for an integration or a single resource such as an invoice PDF. The
+// token is tied to the user's session and ends with it.
+func (s *Server) MintScopedToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	session, ok := r.Context().Value("session").(*UserSession)
+	if !ok {
+		writeError(w, r, ErrSessionContextMissing)
+		return
+	}
+
+	var data struct {
+		Scopes     []string `json:"scopes"`
+		Resource   string   `json:"resource"`
+		TTLSeconds int      `json:"ttl_seconds"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if data.Resource != "" {
+		if !strings.HasPrefix(data.Resource, "/api/") || path.Clean(data.Resource) != data.Resource {
+			writeError(w, r, ErrRequestInvalidField.WithDetail("resource must be a clean path under /api/"))
+			return
+		}
+		if len(data.Scopes) == 0 {
+			data.Scopes = []string{s.requiredScope(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: data.Resource}})}
+		}
+	}
+	if len(data.Scopes) == 0 {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("scopes or resource is required"))
+		return
+	}
+	for _, scope := range data.Scopes {
+		if !validScope(scope) {
+			writeError(w, r, ErrRequestInvalidField.WithDetail(fmt.Sprintf("invalid scope %q", scope)))
+			return
+		}
+		if scope == credentialsScope || !scopeAllows(claims.Scopes, scope) {
+			writeError(w, r, ErrScopeForbidden.WithDetail("cannot grant "+scope))
+			return
+		}
+	}
+
+	ttl := time.Hour
+	if data.TTLSeconds > 0 {
+		ttl = time.Duration(data.TTLSeconds) * time.Second
+	}
+	if ttl > s.config.ScopedTokenMaxTTL {
+		ttl = s.config.ScopedTokenMaxTTL
+	}
+	if remaining := time.Until(session.ExpiresAt); remaining < ttl {
+		ttl = remaining
+	}
+
+	now := time.Now()
+	scoped := &Claims{
+		TenantID:  claims.TenantID,
+		UserID:    claims.UserID,
+		Username:  claims.Username,
+		SessionID: claims.SessionID,
+		Scopes:    data.Scopes,
+		Resource:  data.Resource,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	token, err := s.keys.Sign(scoped)
+	if err != nil {
+		log.Printf("[ERROR] Failed to sign scoped token for user %s: %v", claims.UserID, err)
+		writeError(w, r, ErrTokenCreateFailed)
+		return
+	}
+
+	detail := "scopes " + strings.Join(data.Scopes, " ")
+	if data.Resource != "" {
+		detail += " for " + data.Resource
+	}
+	log.Printf("[TOKEN] User %s minted a scoped token (%s) valid for %s", claims.UserID, detail, ttl)
+	s.auditRequest(r, AuditScopedToken, claims, http.StatusCreated, detail)
+
+	writeJSON(w, http.StatusCreated, ScopedTokenResponse{
+		Token:     token,
+		ExpiresAt: now.Add(ttl),
+		Scopes:    data.Scopes,
+		Resource:  data.Resource,
+	})
+}
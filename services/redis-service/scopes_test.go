@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsScopeNotDelegable(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+
+	if w := serveRequest(s, http.MethodPost, "/api/tokens", login.Token, `{"scopes":["account:credentials"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("minting %s: got status %d, want 403", credentialsScope, w.Code)
+	}
+
+	w := serveRequest(s, http.MethodPost, "/api/tokens", login.Token, `{"scopes":["*"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("minting a wildcard token: got status %d: %s", w.Code, w.Body)
+	}
+	var scoped ScopedTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&scoped); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/api/password", "/api/tokens", "/api/share-links", "/api/webauthn/register/begin"} {
+		if w := serveRequest(s, http.MethodPost, path, scoped.Token, `{}`); w.Code != http.StatusForbidden {
+			t.Errorf("%s with a wildcard scoped token: got status %d, want 403", path, w.Code)
+		}
+	}
+	if w := serveRequest(s, http.MethodPost, sessionGetPath, scoped.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("session lookup with a wildcard scoped token: got status %d", w.Code)
+	}
+}
+
+func TestNonCanonicalPathsRejected(t *testing.T) {
+	s := newAPIKeyServer(t)
+	login := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+	w := serveRequest(s, http.MethodPost, "/api/tokens", login.Token, `{"scopes":["invoices:read"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("minting an invoices token: got status %d: %s", w.Code, w.Body)
+	}
+	var scoped ScopedTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&scoped); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{
+		"/api/invoices/../users/u2",
+		"/api/invoices/%2e%2e/users/u2",
+		"/api/invoices/%2E%2E/users/u2",
+		"/api/invoices/./x",
+		"/api/invoices//x",
+		"/api/invoices/a%2Fb",
+	} {
+		w := serveRequest(s, http.MethodGet, target, scoped.Token, "")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "request.path_invalid") {
+			t.Errorf("%s: got status %d: %s", target, w.Code, w.Body)
+		}
+	}
+	for _, target := range []string{"/api/invoices/i1", "/api/invoices/"} {
+		if w := serveRequest(s, http.MethodGet, target, scoped.Token, ""); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d: %s", target, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sessionInvalidateChannel = "sessions:invalidate"
+	sessionInvalidateAll     = "*"
+	sessionCacheMaxEntries   = 10000
+)
+
+// sessionCache is a short-lived in-process copy of recently read sessions.
+// Revocations are broadcast over pub/sub so every gateway instance drops its
+// copy immediately; the TTL only bounds staleness of LastSeen and roles.
+// Entries are kept for the longer stale window so authentication can keep
+// working from the last validated copy while Redis is unavailable.
+type sessionCache struct {
+	ttl        time.Duration
+	stale      time.Duration
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List
+	staleReads atomic.Uint64
+}
+
+type sessionCacheEntry struct {
+	sessionID string
+	session   UserSession
+	stored    time.Time
+}
+
+func newSessionCache(ttl, stale time.Duration) *sessionCache {
+	if ttl <= 0 && stale <= 0 {
+		return nil
+	}
+	return &sessionCache{ttl: ttl, stale: stale, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *sessionCache) lookup(sessionID string, maxAge time.Duration) (*UserSession, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[sessionID]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*sessionCacheEntry)
+	age := time.Since(entry.stored)
+	if age >= max(c.ttl, c.stale) {
+		c.order.Remove(el)
+		delete(c.entries, sessionID)
+		return nil, false
+	}
+	if age >= maxAge {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	session := entry.session
+	return &session, true
+}
+
+func (c *sessionCache) get(sessionID string) (*UserSession, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.lookup(sessionID, c.ttl)
+}
+
+// getStale returns the last validated copy of a session within the stale
+// window. It is only for use when Redis cannot be reached.
+func (c *sessionCache) getStale(sessionID string) (*UserSession, bool) {
+	if c == nil {
+		return nil, false
+	}
+	session, ok := c.lookup(sessionID, c.stale)
+	if ok {
+		c.staleReads.Add(1)
+	}
+	return session, ok
+}
+
+func (c *sessionCache) put(sessionID string, session *UserSession) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[sessionID]; ok {
+		el.Value = &sessionCacheEntry{sessionID: sessionID, session: *session, stored: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[sessionID] = c.order.PushFront(&sessionCacheEntry{sessionID: sessionID, session: *session, stored: time.Now()})
+	if c.order.Len() > sessionCacheMaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionCacheEntry).sessionID)
+	}
+}
+
+func (c *sessionCache) delete(sessionID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sessionID == sessionInvalidateAll {
+		c.entries = make(map[string]*list.Element)
+		c.order.Init()
+		return
+	}
+	if el, ok := c.entries[sessionID]; ok {
+		c.order.Remove(el)
+		delete(c.entries, sessionID)
+	}
+}
+
+func (c *sessionCache) staleReadCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.staleReads.Load()
+}
+
+// invalidate drops a session from this instance's cache and tells the other
+// instances to do the same. Cache entries are keyed by the tenant-scoped
+// session ID.
+func (sm *SessionManager) invalidate(ctx context.Context, sessionID string) {
+	if sm.cache == nil {
+		return
+	}
+	if sessionID != sessionInvalidateAll {
+		sessionID = tenantKey(ctx, sessionID)
+	}
+	sm.cache.delete(sessionID)
+	if err := sm.rdb.Publish(ctx, sessionInvalidateChannel, sessionID).Err(); err != nil {
+		log.Printf("[WARN] Failed to broadcast session invalidation for %s: %v", sessionID, err)
+	}
+}
+
+func (sm *SessionManager) WatchInvalidations(ctx context.Context) {
+	if sm.cache == nil {
+		return
+	}
+	pubsub := sm.rdb.Subscribe(ctx, sessionInvalidateChannel)
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			sm.cache.delete(msg.Payload)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// BenchmarkGetSession compares a cache hit with reading the session hash and
+// a legacy JSON session from Redis.
+func BenchmarkGetSession(b *testing.B) {
+	ctx := context.Background()
+	session := benchmarkSession()
+
+	b.Run("cache_hit", func(b *testing.B) {
+		s, fake := newTestServer(b, nil)
+		if err := s.sessionManager.CreateSession(ctx, "user-1_1", session, time.Hour); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := s.sessionManager.GetSession(ctx, "user-1_1"); err != nil {
+			b.Fatal(err)
+		}
+		calls := fake.calls
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.sessionManager.GetSession(ctx, "user-1_1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if fake.calls != calls {
+			b.Fatalf("cache hits made %d Redis calls", fake.calls-calls)
+		}
+	})
+	b.Run("hash", func(b *testing.B) {
+		s, _ := newTestServer(b, nil)
+		if err := s.sessionManager.CreateSession(ctx, "user-1_1", session, time.Hour); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.sessionManager.loadSession(ctx, "user-1_1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("legacy_json", func(b *testing.B) {
+		s, fake := newTestServer(b, nil)
+		data, err := json.Marshal(session)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fake.strings[sessionKey(ctx, "user-1_1")] = string(data)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.sessionManager.loadSession(ctx, "user-1_1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSessionCacheHit(t *testing.T) {
+	s, fake := newTestServer(t, nil)
+	ctx := context.Background()
+	if err := s.sessionManager.CreateSession(ctx, "user-1_1", benchmarkSession(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sessionManager.GetSession(ctx, "user-1_1"); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.calls
+	session, err := s.sessionManager.GetSession(ctx, "user-1_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls != calls {
+		t.Errorf("cached read made %d Redis calls", fake.calls-calls)
+	}
+	if session.Username != "alice" {
+		t.Errorf("got username %q", session.Username)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	shareLinkAudience   = "share"
+	shareLinkDefaultTTL = 24 * time.Hour
+	// Share access tokens stand in for the visitor's credentials on the
+	// proxied request, long enough for the upstream to resolve them once.
+	shareAccessAudience = "share-access"
+	shareAccessTTL      = time.Minute
+)
+
+var (
+	ErrShareLinkInvalid    = newAPIError(http.StatusNotFound, "share.invalid", "Share link is invalid, revoked or expired")
+	ErrShareLinkExhausted  = newAPIError(http.StatusGone, "share.exhausted", "Share link has reached its maximum number of uses")
+	ErrShareLinkNotFound   = newAPIError(http.StatusNotFound, "share.not_found", "Share link not found")
+	ErrSharePathNotAllowed = newAPIError(http.StatusForbidden, "share.path_not_allowed", "Resource cannot be shared")
+)
+
+// useShareLinkScript counts one use of a link. It returns -1 if the link was
+// revoked or has expired, 0 if it is used up and 1 otherwise.
+var useShareLinkScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local max = tonumber(redis.call("HGET", KEYS[1], "max_uses"))
+local uses = tonumber(redis.call("HGET", KEYS[1], "uses"))
+if max > 0 and uses >= max then
+	return 0
+end
+redis.call("HINCRBY", KEYS[1], "uses", 1)
+return 1
+`)
+
+// ShareClaims are carried by a share link token. The signature binds the
+// link to one path and GET; the Redis record only adds use counting and
+// revocation.
+type ShareClaims struct {
+	TenantID string `json:"tenant_id,omitempty"`
+	UserID   string `json:"user_id"`
+	Path     string `json:"path"`
+	jwt.RegisteredClaims
+}
+
+type ShareLink struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses,omitempty"`
+}
+
+func shareLinkKey(ctx context.Context, id string) string {
+	return tenantKey(ctx, "sharelink:"+id)
+}
+
+func (s *Server) shareablePath(p string) bool {
+	if !strings.HasPrefix(p, "/api/") || path.Clean(p) != p {
+		return false
+	}
+	for _, pattern := range s.config.ShareLinkPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) shareLinkURL(r *http.Request, token string) string {
+	base := s.config.ShareLinkBaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + "/noauth/share/" + token
+}
+
+// CreateShareLink mints a link to one resource for people without a Finura
+// account. The caller must be allowed to read the resource themselves.
+func (s *Server) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+
+	var data struct {
+		Path             string `json:"path"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		MaxUses          int    `json:"max_uses"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !s.shareablePath(data.Path) {
+		writeError(w, r, ErrSharePathNotAllowed.WithDetail(data.Path))
+		return
+	}
+	target := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: data.Path}}
+	if scope := s.requiredScope(target); !scopeAllows(claims.Scopes, scope) {
+		writeError(w, r, ErrScopeForbidden.WithDetail("requires "+scope))
+		return
+	}
+	if data.ExpiresInSeconds < 0 || data.MaxUses < 0 {
+		writeError(w, r, ErrRequestInvalidField.WithDetail("expires_in_seconds and max_uses must not be negative"))
+		return
+	}
+
+	ttl := shareLinkDefaultTTL
+	if data.ExpiresInSeconds > 0 {
+		ttl = time.Duration(data.ExpiresInSeconds) * time.Second
+	}
+	if ttl > s.config.ShareLinkMaxTTL {
+		ttl = s.config.ShareLinkMaxTTL
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		writeError(w, r, ErrInternal)
+		return
+	}
+	ctx := r.Context()
+	now := time.Now()
+	link := ShareLink{ID: id, Path: data.Path, ExpiresAt: now.Add(ttl), MaxUses: data.MaxUses}
+
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, shareLinkKey(ctx, id), map[string]interface{}{
+		"user_id":    claims.UserID,
+		"path":       link.Path,
+		"max_uses":   link.MaxUses,
+		"uses":       0,
+		"created_at": now.Format(time.RFC3339Nano),
+	})
+	pipe.Expire(ctx, shareLinkKey(ctx, id), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[ERROR] Failed to store share link for user %s: %v", claims.UserID, err)
+		if redisFailure(err) {
+			writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+			return
+		}
+		writeError(w, r, ErrInternal)
+		return
+	}
+
+	token, err := s.keys.Sign(&ShareClaims{
+		TenantID: tenantID(ctx),
+		UserID:   claims.UserID,
+		Path:     link.Path,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Audience:  jwt.ClaimStrings{shareLinkAudience},
+			ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to sign share link for user %s: %v", claims.UserID, err)
+		writeError(w, r, ErrTokenCreateFailed)
+		return
+	}
+	link.URL = s.shareLinkURL(r, token)
+
+	log.Printf("[SHARE] User %s shared %s as link %s until %s", claims.UserID, link.Path, id, link.ExpiresAt.Format(time.RFC3339))
+	s.auditRequest(r, AuditShareLinkCreated, claims, http.StatusCreated, fmt.Sprintf("link %s to %s, max uses %d", id, link.Path, link.MaxUses))
+
+	writeJSON(w, http.StatusCreated, link)
+}
+
+// RevokeShareLink deletes a link created by the caller.
+func (s *Server) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	id := chi.URLParam(r, "linkID")
+	ctx := r.Context()
+
+	owner, err := s.rdb.HGet(ctx, shareLinkKey(ctx, id), "user_id").Result()
+	if err == redis.Nil || (err == nil && owner != claims.UserID) {
+		writeError(w, r, ErrShareLinkNotFound)
+		return
+	}
+	if err == nil {
+		err = s.rdb.Del(ctx, shareLinkKey(ctx, id)).Err()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke share link %s: %v", id, err)
+		writeError(w, r, ErrInternal)
+		return
+	}
+
+	log.Printf("[SHARE] User %s revoked link %s", claims.UserID, id)
+	s.auditRequest(r, AuditShareLinkRevoked, claims, http.StatusOK, "link "+id)
+	writeJSON(w, http.StatusOK, RevokeResponse{Revoked: 1})
+}
+
+// shareAccess reports whether c is a share access token minted by
+// ServeShareLink rather than a user's own token.
+func (c *Claims) shareAccess() bool {
+	return slices.Contains(c.Audience, shareAccessAudience)
+}
+
+// shareAccessToken mints the token forwarded upstream for one use of a share
+// link. It names the link owner and is restricted to the shared resource.
+func (s *Server) shareAccessToken(link *ShareClaims) (string, error) {
+	target := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: link.Path}}
+	now := time.Now()
+	return s.keys.Sign(&Claims{
+		TenantID: link.TenantID,
+		UserID:   link.UserID,
+		Scopes:   []string{s.requiredScope(target)},
+		Resource: link.Path,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        link.ID,
+			Audience:  jwt.ClaimStrings{shareAccessAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(shareAccessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// authenticateShareAccess accepts a share access token on /api/session/get
+// only, where the upstream resolves it, and only while its link exists.
+func (s *Server) authenticateShareAccess(w http.ResponseWriter, r *http.Request, next http.Handler, claims *Claims) {
+	ip := getClientIP(r)
+	ctx := r.Context()
+	if r.URL.Path != sessionGetPath || claims.ID == "" || claims.Resource == "" {
+		log.Printf("[AUTH] Share access token of link %s used for %s %s from IP %s", claims.ID, r.Method, r.URL.Path, ip)
+		s.auditAuthFailure(r, claims, ErrResourceForbidden)
+		writeError(w, r, ErrResourceForbidden)
+		return
+	}
+	n, err := s.rdb.Exists(ctx, shareLinkKey(ctx, claims.ID)).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to look up share link %s: %v", claims.ID, err)
+		if redisFailure(err) {
+			writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+			return
+		}
+		writeError(w, r, ErrInternal)
+		return
+	}
+	if n == 0 {
+		log.Printf("[AUTH] Share access token of revoked link %s from IP %s", claims.ID, ip)
+		s.auditAuthFailure(r, claims, ErrShareLinkInvalid)
+		writeError(w, r, ErrShareLinkInvalid)
+		return
+	}
+	next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "user", claims)))
+}
+
+// ServeShareLink validates a share link and proxies GET of its single
+// resource to the upstream. The visitor's credentials are never forwarded;
+// the upstream gets a share access token for the link owner instead, which
+// it resolves through /api/session/get like any other token.
+func (s *Server) ServeShareLink(upstream http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := getClientIP(r)
+		ctx := r.Context()
+
+		claims := &ShareClaims{}
+		token, err := jwt.ParseWithClaims(chi.URLParam(r, "token"), claims, s.keys.KeyFunc, jwt.WithAudience(shareLinkAudience))
+		if err != nil || !token.Valid || claims.ID == "" || claims.TenantID != tenantID(ctx) || !s.shareablePath(claims.Path) {
+			log.Printf("[SHARE] Invalid share link from IP %s: %v", ip, err)
+			writeError(w, r, ErrShareLinkInvalid)
+			return
+		}
+
+		result, err := useShareLinkScript.Run(ctx, s.rdb, []string{shareLinkKey(ctx, claims.ID)}).Int()
+		if err != nil {
+			log.Printf("[ERROR] Failed to count use of share link %s: %v", claims.ID, err)
+			if redisFailure(err) {
+				writeRetryableError(w, r, ErrStoreUnavailable, s.breaker.RetryAfter().Seconds())
+				return
+			}
+			writeError(w, r, ErrInternal)
+			return
+		}
+		switch result {
+		case -1:
+			writeError(w, r, ErrShareLinkInvalid)
+			return
+		case 0:
+			writeError(w, r, ErrShareLinkExhausted)
+			return
+		}
+
+		access, err := s.shareAccessToken(claims)
+		if err != nil {
+			log.Printf("[ERROR] Failed to sign share access token for link %s: %v", claims.ID, err)
+			writeError(w, r, ErrTokenCreateFailed)
+			return
+		}
+
+		log.Printf("[SHARE] Link %s of user %s used from IP %s for %s", claims.ID, claims.UserID, ip, claims.Path)
+		s.auditRequest(r, AuditShareLinkUsed, &Claims{TenantID: claims.TenantID, UserID: claims.UserID}, http.StatusOK, "link "+claims.ID+" for "+claims.Path)
+
+		// The upstream proxy takes the path below /api from the route's
+		// wildcard, so present the shared path as if routed there.
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("*", strings.TrimPrefix(claims.Path, "/api/"))
+		req := r.Clone(context.WithValue(ctx, chi.RouteCtxKey, rctx))
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = claims.Path, "", ""
+		req.Header.Set("Authorization", "Bearer "+access)
+		req.Header.Del("Cookie")
+		req.Header.Del(apiKeyHeader)
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		upstream.ServeHTTP(w, req)
+	}
+}
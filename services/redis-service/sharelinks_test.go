@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// shareUpstream mimics the Node API: it resolves the bearer token through
+// /api/session/get and serves the invoice only if the token is not
+// restricted to a different resource.
+func shareUpstream(t *testing.T, gateway *string, forwarded *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		*forwarded = token
+		req, _ := http.NewRequest(http.MethodPost, *gateway+sessionGetPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("session lookup: %v", err)
+			http.Error(w, "lookup failed", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		var session SessionResponse
+		if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&session) != nil {
+			http.Error(w, "invalid session", http.StatusUnauthorized)
+			return
+		}
+		if session.Resource != "" && session.Resource != r.URL.Path {
+			http.Error(w, "token restricted to another resource", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "invoice of "+session.UserID+" at "+r.URL.Path)
+	}))
+}
+
+func TestShareLinkEndToEnd(t *testing.T) {
+	var gatewayURL, forwarded string
+	upstream := shareUpstream(t, &gatewayURL, &forwarded)
+	defer upstream.Close()
+
+	s, _ := newTestServer(t, map[string]string{"PROXY_TARGET_URL": upstream.URL})
+	gateway := httptest.NewServer(s.Routes())
+	defer gateway.Close()
+	gatewayURL = gateway.URL
+
+	login, err := http.Post(gateway.URL+"/noauth/login", "application/json", strings.NewReader(`{"user_id":"u1","username":"alice","roles":["member"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session LoginResponse
+	if err := json.NewDecoder(login.Body).Decode(&session); err != nil || session.Token == "" {
+		t.Fatalf("login failed with status %d: %v", login.StatusCode, err)
+	}
+	login.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/api/share-links", strings.NewReader(`{"path":"/api/invoices/inv-1/pdf","max_uses":2}`))
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var link ShareLink
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create share link: status %d: %v", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+
+	get := func(url, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(link.URL, "visitor-token")
+	if status != http.StatusOK || body != "invoice of u1 at /api/invoices/inv-1/pdf" {
+		t.Fatalf("share link: got %d %q", status, body)
+	}
+	if forwarded == "visitor-token" || forwarded == session.Token {
+		t.Fatal("visitor credentials were forwarded upstream")
+	}
+
+	// The forwarded token only resolves itself; it is no way into the API.
+	if status, _ := get(gateway.URL+"/api/invoices/inv-1/pdf", forwarded); status != http.StatusForbidden {
+		t.Errorf("share access token used on the API: got %d, want 403", status)
+	}
+	if status, _ := get(gateway.URL+"/api/invoices", forwarded); status != http.StatusForbidden {
+		t.Errorf("share access token used on another path: got %d, want 403", status)
+	}
+
+	if status, _ := get(link.URL, ""); status != http.StatusOK {
+		t.Errorf("second use: got %d", status)
+	}
+	if status, _ := get(link.URL, ""); status != http.StatusGone {
+		t.Errorf("use beyond max_uses: got %d, want 410", status)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, gateway.URL+"/api/share-links/"+link.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	lookup, _ := http.NewRequest(http.MethodPost, gateway.URL+sessionGetPath, nil)
+	lookup.Header.Set("Authorization", "Bearer "+forwarded)
+	resp, err = http.DefaultClient.Do(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("share access token still resolves after the link was revoked")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	TenantModeOff    = "off"
+	TenantModeHost   = "host"
+	TenantModeHeader = "header"
+
+	tenantKeyPrefix = "t:"
+)
+
+var (
+	ErrTenantUnknown  = newAPIError(http.StatusNotFound, "tenant.unknown", "Unknown tenant")
+	ErrTenantMismatch = newAPIError(http.StatusUnauthorized, "auth.tenant_mismatch", "Token was issued for a different tenant")
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is one company hosted on the gateway. Empty Upstream and zero
+// RateLimit fall back to the global settings.
+type Tenant struct {
+	ID        string
+	Hosts     []string
+	Upstream  string
+	RateLimit int
+}
+
+// parseTenants reads TENANTS ("id=host|host,..."), TENANT_UPSTREAMS
+// ("id=url,...") and TENANT_RATE_LIMITS ("id=requests,...").
+func parseTenants(defs, upstreams, limits []string) ([]Tenant, error) {
+	var tenants []Tenant
+	index := make(map[string]int)
+	for _, def := range defs {
+		id, hosts, _ := strings.Cut(def, "=")
+		if !tenantIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid tenant id %q", id)
+		}
+		if _, ok := index[id]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", id)
+		}
+		tenant := Tenant{ID: id}
+		if hosts != "" {
+			for _, host := range strings.Split(hosts, "|") {
+				tenant.Hosts = append(tenant.Hosts, strings.ToLower(host))
+			}
+		}
+		index[id] = len(tenants)
+		tenants = append(tenants, tenant)
+	}
+
+	lookup := func(entry, setting string) (*Tenant, string, error) {
+		id, value, ok := strings.Cut(entry, "=")
+		i, known := index[id]
+		if !ok || !known {
+			return nil, "", fmt.Errorf("%s: unknown tenant in %q", setting, entry)
+		}
+		return &tenants[i], value, nil
+	}
+	for _, entry := range upstreams {
+		tenant, upstream, err := lookup(entry, "TENANT_UPSTREAMS")
+		if err != nil {
+			return nil, err
+		}
+		tenant.Upstream = upstream
+	}
+	for _, entry := range limits {
+		tenant, limit, err := lookup(entry, "TENANT_RATE_LIMITS")
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("TENANT_RATE_LIMITS: invalid limit in %q", entry)
+		}
+		tenant.RateLimit = n
+	}
+	return tenants, nil
+}
+
+// TenantRegistry resolves the tenant a request belongs to.
+type TenantRegistry struct {
+	mode       string
+	header     string
+	baseDomain string
+	byID       map[string]*Tenant
+	byHost     map[string]*Tenant
+}
+
+func NewTenantRegistry(cfg *Config) *TenantRegistry {
+	tr := &TenantRegistry{
+		mode:       cfg.TenantMode,
+		header:     cfg.TenantHeader,
+		baseDomain: strings.ToLower(strings.TrimPrefix(cfg.TenantBaseDomain, ".")),
+		byID:       make(map[string]*Tenant),
+		byHost:     make(map[string]*Tenant),
+	}
+	for i := range cfg.Tenants {
+		tenant := &cfg.Tenants[i]
+		tr.byID[tenant.ID] = tenant
+		for _, host := range tenant.Hosts {
+			tr.byHost[host] = tenant
+		}
+	}
+	return tr
+}
+
+func (tr *TenantRegistry) Enabled() bool {
+	return tr.mode != TenantModeOff
+}
+
+func (tr *TenantRegistry) Lookup(id string) (*Tenant, bool) {
+	tenant, ok := tr.byID[id]
+	return tenant, ok
+}
+
+func (tr *TenantRegistry) All() []*Tenant {
+	tenants := make([]*Tenant, 0, len(tr.byID))
+	for _, tenant := range tr.byID {
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// Resolve maps the request to a tenant by exact host, then by subdomain of
+// TENANT_BASE_DOMAIN, or by header. Header mode trusts the client value and
+// must only be used behind a proxy that sets it.
+func (tr *TenantRegistry) Resolve(r *http.Request) (*Tenant, bool) {
+	if tr.mode == TenantModeHeader {
+		return tr.Lookup(r.Header.Get(tr.header))
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if tenant, ok := tr.byHost[host]; ok {
+		return tenant, true
+	}
+	if tr.baseDomain != "" {
+		if sub, ok := strings.CutSuffix(host, "."+tr.baseDomain); ok && !strings.Contains(sub, ".") {
+			return tr.Lookup(sub)
+		}
+	}
+	return nil, false
+}
+
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, "tenant", tenant)
+}
+
+func tenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value("tenant").(*Tenant)
+	return tenant
+}
+
+// tenantID is empty when multi-tenancy is off.
+func tenantID(ctx context.Context) string {
+	if tenant := tenantFromContext(ctx); tenant != nil {
+		return tenant.ID
+	}
+	return ""
+}
+
+// tenantKey scopes a Redis key or SCAN pattern to the request's tenant.
+// Without a tenant keys are unprefixed, as before multi-tenancy.
+func tenantKey(ctx context.Context, key string) string {
+	if id := tenantID(ctx); id != "" {
+		return tenantKeyPrefix + id + ":" + key
+	}
+	return key
+}
+
+// splitTenantKey reverses tenantKey for keys found by SCAN or keyspace
+// notifications.
+func splitTenantKey(key string) (string, string) {
+	rest, ok := strings.CutPrefix(key, tenantKeyPrefix)
+	if !ok {
+		return "", key
+	}
+	id, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", key
+	}
+	return id, rest
+}
+
+// tenantContexts returns one context per tenant for background work that
+// has to cover every keyspace, or ctx itself when multi-tenancy is off.
+func (s *Server) tenantContexts(ctx context.Context) []context.Context {
+	if !s.tenants.Enabled() {
+		return []context.Context{ctx}
+	}
+	var contexts []context.Context
+	for _, tenant := range s.tenants.All() {
+		contexts = append(contexts, withTenant(ctx, tenant))
+	}
+	return contexts
+}
+
+func (s *Server) TenantMiddleware(next http.Handler) http.Handler {
+	if !s.tenants.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := s.tenants.Resolve(r)
+		if !ok {
+			writeError(w, r, ErrTenantUnknown)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+func (s *Server) rateLimitFor(ctx context.Context) int {
+	if tenant := tenantFromContext(ctx); tenant != nil && tenant.RateLimit > 0 {
+		return tenant.RateLimit
+	}
+	return s.settings().MaxRequestsPerMinute
+}
+
+// upstreamProxy forwards to the tenant's upstream, or the global one.
+func (s *Server) upstreamProxy() http.Handler {
+	fallback := newReverseProxy(s.config.ProxyTargetURL, s.headers)
+	proxies := make(map[string]http.Handler)
+	for _, tenant := range s.tenants.All() {
+		if tenant.Upstream != "" {
+			proxies[tenant.ID] = newReverseProxy(tenant.Upstream, s.headers)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proxy, ok := proxies[tenantID(r.Context())]; ok {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTenantServer hosts tenants acme and globex by host name in front of an
+// upstream that answers every request.
+func newTenantServer(t *testing.T) *Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+	s, _ := newTestServer(t, map[string]string{
+		"TENANT_MODE":      TenantModeHost,
+		"TENANTS":          "acme=acme.test,globex=globex.test",
+		"PROXY_TARGET_URL": upstream.URL,
+	})
+	return s
+}
+
+func tenantRequest(s *Server, method, target, remote string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = remote
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.Routes().ServeHTTP(w, r)
+	return w
+}
+
+func tenantContext(t *testing.T, s *Server, id string) context.Context {
+	tenant, ok := s.tenants.Lookup(id)
+	if !ok {
+		t.Fatalf("unknown tenant %s", id)
+	}
+	return withTenant(context.Background(), tenant)
+}
+
+func TestTenantResolution(t *testing.T) {
+	s := newTenantServer(t)
+	w := tenantRequest(s, http.MethodPost, "http://unknown.test/noauth/login", "127.0.0.1:5000", nil, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "tenant.unknown") {
+		t.Errorf("unknown host: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTenantTokensAndSessionsIsolated(t *testing.T) {
+	s := newTenantServer(t)
+	w := tenantRequest(s, http.MethodPost, "http://acme.test/noauth/login", "127.0.0.1:5000", nil, `{"user_id":"u1","username":"alice","roles":["member"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: got status %d: %s", w.Code, w.Body)
+	}
+	var login LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	if w := tenantRequest(s, http.MethodGet, "http://acme.test/api/invoices", "127.0.0.1:5000", bearer(login.Token), ""); w.Code != http.StatusOK {
+		t.Fatalf("token on its own tenant: got status %d: %s", w.Code, w.Body)
+	}
+	w = tenantRequest(s, http.MethodGet, "http://globex.test/api/invoices", "127.0.0.1:5000", bearer(login.Token), "")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.tenant_mismatch") {
+		t.Errorf("token on another tenant: got status %d: %s", w.Code, w.Body)
+	}
+
+	// Even a token correctly issued for globex cannot name a session that
+	// only exists in acme's keyspace.
+	forged, err := s.createJWT("globex", "u1", "alice", login.SessionID, []string{"*"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = tenantRequest(s, http.MethodGet, "http://globex.test/api/invoices", "127.0.0.1:5000", bearer(forged), "")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "session.invalid") {
+		t.Errorf("acme session through a globex token: got status %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := s.sessionManager.GetSession(tenantContext(t, s, "globex"), login.SessionID); err == nil {
+		t.Error("acme session readable from globex")
+	}
+	if _, err := s.sessionManager.GetSession(tenantContext(t, s, "acme"), login.SessionID); err != nil {
+		t.Errorf("acme session not readable from acme: %v", err)
+	}
+}
+
+func TestTenantAPIKeysIsolated(t *testing.T) {
+	s := newTenantServer(t)
+	key, err := s.apiKeys.Create(tenantContext(t, s, "acme"), &APIKey{Name: "billing", Scopes: []string{"invoices:read"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{apiKeyHeader: key}
+
+	if w := tenantRequest(s, http.MethodGet, "http://acme.test/api/invoices", "127.0.0.1:5000", headers, ""); w.Code != http.StatusOK {
+		t.Fatalf("key on its own tenant: got status %d: %s", w.Code, w.Body)
+	}
+	w := tenantRequest(s, http.MethodGet, "http://globex.test/api/invoices", "127.0.0.1:5000", headers, "")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "auth.api_key_invalid") {
+		t.Errorf("key on another tenant: got status %d: %s", w.Code, w.Body)
+	}
+
+	id, secret, _ := strings.Cut(key, ".")
+	body := `{"grant_type":"client_credentials","client_id":"` + id + `","client_secret":"` + secret + `"}`
+	w = tenantRequest(s, http.MethodPost, "http://globex.test/noauth/token", "127.0.0.1:5000", nil, body)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("client credentials on another tenant: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTenantBlocksIsolated(t *testing.T) {
+	s := newTenantServer(t)
+	if err := s.rateLimiter.BlockIP(tenantContext(t, s, "acme"), "203.0.113.7", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	w := tenantRequest(s, http.MethodGet, "http://acme.test/noauth/missing", "203.0.113.7:5000", nil, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("blocked IP on its tenant: got status %d: %s", w.Code, w.Body)
+	}
+	if w := tenantRequest(s, http.MethodGet, "http://globex.test/noauth/missing", "203.0.113.7:5000", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("IP blocked in acme on globex: got status %d: %s", w.Code, w.Body)
+	}
+	blocks, err := s.rateLimiter.ListBlocks(tenantContext(t, s, "globex"))
+	if err != nil || len(blocks) != 0 {
+		t.Errorf("globex lists acme's blocks: %v, err %v", blocks, err)
+	}
+}
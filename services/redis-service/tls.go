@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const certReloadInterval = 10 * time.Second
+
+func (cfg *Config) tlsEnabled() bool {
+	return len(cfg.ACMEDomains) > 0 || cfg.TLSCertFile != ""
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS_MIN_VERSION %q", v)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseClientAuth(v string) (tls.ClientAuthType, error) {
+	switch v {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify_if_given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown TLS_CLIENT_AUTH %q", v)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate from disk and picks up renewed files
+// without a restart. A failed reload keeps the previous certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.modified()
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := cr.modified()
+			cr.mu.RLock()
+			unchanged := err == nil && !modTime.After(cr.modTime)
+			cr.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+			if err := cr.reload(); err != nil {
+				log.Printf("[TLS ERROR] Certificate reload failed, keeping previous certificate: %v", err)
+				continue
+			}
+			log.Printf("[TLS] Reloaded certificate from %s", cr.certFile)
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// acmeOrderTransport fills in the Location header that servers finalizing
+// orders asynchronously, such as Pebble, leave out of the finalize response.
+// The acme client polls the order at that location until the certificate is
+// issued, and fails on an empty URL without it.
+type acmeOrderTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	orders map[string]string // finalize URL to order URL
+}
+
+func (t *acmeOrderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || res.StatusCode >= http.StatusMultipleChoices {
+		return res, err
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		t.mu.Lock()
+		if order, ok := t.orders[req.URL.String()]; ok {
+			res.Header.Set("Location", order)
+		}
+		t.mu.Unlock()
+		return res, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME response: %w", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		t.mu.Lock()
+		t.orders[order.Finalize] = location
+		t.mu.Unlock()
+	}
+	return res, nil
+}
+
+func newACMEManager(cfg *Config) (*autocert.Manager, error) {
+	transport := http.DefaultTransport
+	if cfg.ACMECAFile != "" {
+		// Lets the client talk to a private directory such as Pebble.
+		pool, err := loadCertPool(cfg.ACMECAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	httpClient := &http.Client{Transport: &acmeOrderTransport{base: transport, orders: make(map[string]string)}}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+		Client:     &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL, HTTPClient: httpClient},
+	}, nil
+}
+
+// tlsSetup builds the listener TLS config. The returned handler serves the
+// plain HTTP redirect listener, answering ACME HTTP-01 challenges when ACME
+// is in use.
+func (s *Server) tlsSetup(ctx context.Context) (*tls.Config, http.Handler, error) {
+	cfg := s.config
+	tlsConfig := &tls.Config{
+		MinVersion:   cfg.TLSMinVersion,
+		CipherSuites: cfg.TLSCipherSuites,
+	}
+	var redirect http.Handler = http.HandlerFunc(s.redirectToHTTPS)
+
+	if len(cfg.ACMEDomains) > 0 {
+		manager, err := newACMEManager(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		redirect = manager.HTTPHandler(redirect)
+		log.Printf("[TLS] Using ACME certificates for %s from %s", strings.Join(cfg.ACMEDomains, ", "), cfg.ACMEDirectoryURL)
+	} else {
+		reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		go reloader.Watch(ctx)
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = cfg.TLSClientAuth
+	}
+	return tlsConfig, redirect, nil
+}
+
+// certificateIdentity maps a verified client certificate to the machine
+// identity configured for it in TLS_CLIENT_IDENTITIES ("name=scope|scope"),
+// matching the subject common name or a DNS or URI SAN. Certificates that
+// were not verified or are not mapped carry no identity.
+func (s *Server) certificateIdentity(r *http.Request) *Claims {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	identities := s.settings().TLSClientIdentities
+	for _, name := range names {
+		if scopes, ok := identities[strings.ToLower(name)]; ok && name != "" {
+			return &Claims{
+				TenantID: tenantID(r.Context()),
+				UserID:   "cert:" + name,
+				Username: name,
+				Scopes:   scopes,
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.config.AccessPort != "443" {
+		host = net.JoinHostPort(host, s.config.AccessPort)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
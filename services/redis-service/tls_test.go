@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, commonName string, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	ca := testCertificate(t, "test-ca")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, map[string]string{
+		"TLS_CLIENT_CA_FILE":    caFile,
+		"TLS_CLIENT_IDENTITIES": "billing-worker=invoices:read|events:write,reports.internal=reports:read",
+	})
+
+	var got *Claims
+	handler := s.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = r.Context().Value("user").(*Claims)
+	}))
+	request := func(cert *x509.Certificate, verified bool) int {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "/api/invoices", nil)
+		state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			state.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		r.TLS = state
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(context.Background()))
+		return w.Code
+	}
+
+	if code := request(testCertificate(t, "billing-worker"), true); code != http.StatusOK || got == nil {
+		t.Fatalf("mapped certificate: got status %d", code)
+	}
+	if got.UserID != "cert:billing-worker" || len(got.Scopes) != 2 || got.Scopes[0] != "invoices:read" {
+		t.Errorf("got identity %+v", got)
+	}
+
+	if code := request(testCertificate(t, "other", "reports.internal"), true); code != http.StatusOK || got == nil || got.Username != "reports.internal" {
+		t.Errorf("certificate mapped by SAN: got status %d, identity %+v", code, got)
+	}
+	if code := request(testCertificate(t, "billing-worker"), false); code != http.StatusUnauthorized {
+		t.Errorf("unverified certificate: got status %d, want 401", code)
+	}
+	if code := request(testCertificate(t, "unknown"), true); code != http.StatusUnauthorized {
+		t.Errorf("unmapped certificate: got status %d, want 401", code)
+	}
+}
+
+// TestACMEPebble obtains a certificate from a local Pebble ACME server. It
+// only runs when PEBBLE_DIRECTORY_URL is set, for example:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	PEBBLE_DIRECTORY_URL=https://localhost:14000/dir \
+//	PEBBLE_CA_FILE=test/certs/pebble.minica.pem go test -run ACMEPebble
+//
+// Without PEBBLE_VA_ALWAYS_VALID, PEBBLE_DOMAIN must resolve to this host so
+// Pebble can reach the HTTP-01 handler on PEBBLE_HTTP_PORT.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL not set")
+	}
+	domain := os.Getenv("PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "gateway.pebble.test"
+	}
+	httpPort := os.Getenv("PEBBLE_HTTP_PORT")
+	if httpPort == "" {
+		httpPort = "5002"
+	}
+	cacheDir := t.TempDir()
+	s, _ := newTestServer(t, map[string]string{
+		"ACME_DOMAINS":       domain,
+		"ACME_DIRECTORY_URL": directory,
+		"ACME_CA_FILE":       os.Getenv("PEBBLE_CA_FILE"),
+		"ACME_CACHE_DIR":     cacheDir,
+		"ACME_EMAIL":         "ops@example.com",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tlsConfig, redirect, err := s.tlsSetup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", ":"+httpPort)
+	if err != nil {
+		t.Fatalf("listen for HTTP-01 challenges: %v", err)
+	}
+	challenges := &http.Server{Handler: redirect}
+	go challenges.Serve(listener)
+	defer challenges.Close()
+
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatalf("obtain certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(leaf.DNSNames, domain) {
+		t.Errorf("certificate is for %v, want %s", leaf.DNSNames, domain)
+	}
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		t.Error("certificate is self-signed")
+	}
+	if time.Until(leaf.NotAfter) < 24*time.Hour {
+		t.Errorf("certificate expires at %s", leaf.NotAfter)
+	}
+
+	if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.pebble.test"}); err == nil {
+		t.Error("certificate issued for a domain outside ACME_DOMAINS")
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil || len(entries) == 0 {
+		t.Errorf("certificate was not cached in ACME_CACHE_DIR: %v", err)
+	}
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ceremonyRegister     = "register"
+	ceremonyLogin        = "login"
+	ceremonySecondFactor = "second_factor"
+
+	authDataUserPresent    = 0x01
+	authDataUserVerified   = 0x04
+	authDataBackupEligible = 0x08
+	authDataBackedUp       = 0x10
+	authDataAttested       = 0x40
+
+	passkeyNameMaxLength = 64
+)
+
+var (
+	ErrWebAuthnChallengeInvalid = newAPIError(http.StatusBadRequest, "webauthn.challenge_invalid", "Challenge is invalid, already used or expired")
+	ErrWebAuthnResponseInvalid  = newAPIError(http.StatusBadRequest, "webauthn.response_invalid", "Authenticator response could not be verified")
+	ErrPasskeyInvalid           = newAPIError(http.StatusUnauthorized, "auth.passkey_invalid", "Passkey could not be verified")
+	ErrPasskeyExists            = newAPIError(http.StatusConflict, "webauthn.already_registered", "Passkey is already registered")
+	ErrPasskeyNotFound          = newAPIError(http.StatusNotFound, "webauthn.not_found", "Passkey not found")
+	ErrPasskeyNoRoles           = newAPIError(http.StatusForbidden, "auth.passkey_no_roles", "No roles are stored for this user, log in with a password")
+	ErrPasskeyNoCredentials     = newAPIError(http.StatusConflict, "webauthn.credentials_required", "Passkeys need gateway credentials for this user")
+)
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	ID             string     `json:"id"`
+	Name           string     `json:"name"`
+	UserID         string     `json:"user_id"`
+	Username       string     `json:"username"`
+	Algorithm      int64      `json:"alg"`
+	SignCount      uint32     `json:"sign_count"`
+	AAGUID         string     `json:"aaguid"`
+	BackupEligible bool       `json:"backup_eligible"`
+	BackedUp       bool       `json:"backed_up"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+type passkeyRecord struct {
+	Passkey
+	// PublicKey is the COSE encoded key from the attestation.
+	PublicKey []byte `json:"public_key"`
+}
+
+// webauthnChallenge is the state of a ceremony between its begin and
+// finish requests. A second factor challenge carries the rest of the
+// password login it completes.
+type webauthnChallenge struct {
+	Ceremony   string   `json:"ceremony"`
+	UserID     string   `json:"user_id,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	UseCookies bool     `json:"use_cookies,omitempty"`
+}
+
+type PasskeyStore struct {
+	rdb redis.UniversalClient
+}
+
+func NewPasskeyStore(rdb redis.UniversalClient) *PasskeyStore {
+	return &PasskeyStore{rdb: rdb}
+}
+
+func passkeysKey(ctx context.Context, userID string) string {
+	return tenantKey(ctx, "passkeys:{"+userID+"}")
+}
+
+func passkeyOwnerKey(ctx context.Context, credentialID string) string {
+	return tenantKey(ctx, "passkey:"+credentialID)
+}
+
+func webauthnChallengeKey(ctx context.Context, challenge string) string {
+	return tenantKey(ctx, "webauthn_challenge:"+challenge)
+}
+
+func (ps *PasskeyStore) list(ctx context.Context, userID string) ([]*passkeyRecord, error) {
+	fields, err := ps.rdb.HGetAll(ctx, passkeysKey(ctx, userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+	records := make([]*passkeyRecord, 0, len(fields))
+	for _, data := range fields {
+		var record passkeyRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal passkey: %w", err)
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+// Get returns the passkey with credential ID id, or nil.
+func (ps *PasskeyStore) Get(ctx context.Context, id string) (*passkeyRecord, error) {
+	userID, err := ps.rdb.Get(ctx, passkeyOwnerKey(ctx, id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to look up passkey: %w", err)
+	}
+	data, err := ps.rdb.HGet(ctx, passkeysKey(ctx, userID), id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get passkey: %w", err)
+	}
+	var record passkeyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal passkey: %w", err)
+	}
+	return &record, nil
+}
+
+func (ps *PasskeyStore) Save(ctx context.Context, record *passkeyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal passkey: %w", err)
+	}
+	pipe := ps.rdb.TxPipeline()
+	pipe.HSet(ctx, passkeysKey(ctx, record.UserID), record.ID, data)
+	pipe.Set(ctx, passkeyOwnerKey(ctx, record.ID), record.UserID, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store passkey: %w", err)
+	}
+	return nil
+}
+
+func (ps *PasskeyStore) Delete(ctx context.Context, userID, id string) (bool, error) {
+	deleted, err := ps.rdb.HDel(ctx, passkeysKey(ctx, userID), id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+	if err := ps.rdb.Del(ctx, passkeyOwnerKey(ctx, id)).Err(); err != nil {
+		return false, fmt.Errorf("failed to delete passkey owner: %w", err)
+	}
+	return true, nil
+}
+
+// newChallenge stores state for a ceremony and returns the challenge the
+// authenticator has to sign.
+func (ps *PasskeyStore) newChallenge(ctx context.Context, state *webauthnChallenge, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal challenge: %w", err)
+	}
+	if err := ps.rdb.Set(ctx, webauthnChallengeKey(ctx, challenge), data, ttl).Err(); err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// consumeChallenge deletes challenge and returns its state, or nil if it
+// does not exist, so every challenge is answered at most once.
+func (ps *PasskeyStore) consumeChallenge(ctx context.Context, challenge string) (*webauthnChallenge, error) {
+	if challenge == "" {
+		return nil, nil
+	}
+	data, err := ps.rdb.GetDel(ctx, webauthnChallengeKey(ctx, challenge)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	var state webauthnChallenge
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge: %w", err)
+	}
+	return &state, nil
+}
+
+// The option and credential types follow the JSON forms of the WebAuthn
+// Level 3 API, with binary values as unpadded base64url.
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type credentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+type credentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type WebAuthnOptionsResponse struct {
+	// PasskeyRequired is set when a password login needs a passkey to
+	// complete.
+	PasskeyRequired bool        `json:"passkey_required,omitempty"`
+	PublicKey       interface{} `json:"public_key"`
+}
+
+type publicKeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	raw          []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// credentialID returns the credential ID in its canonical encoding.
+func (c *publicKeyCredential) credentialID() (string, error) {
+	id := c.RawID
+	if id == "" {
+		id = c.ID
+	}
+	raw, err := decodeBase64URL(id)
+	if err != nil || len(raw) == 0 || c.Type != "public-key" {
+		return "", errors.New("invalid credential id")
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (s *Server) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(s.config.WebAuthnRPID))
+	if subtle.ConstantTimeCompare(raw[:32], rpIDHash[:]) != 1 {
+		return nil, errors.New("relying party ID mismatch")
+	}
+	ad := &authenticatorData{raw: raw, flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	if ad.flags&authDataUserPresent == 0 {
+		return nil, errors.New("user not present")
+	}
+	if ad.flags&authDataAttested != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		ad.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return nil, errors.New("invalid credential id length")
+		}
+		ad.credentialID, rest = rest[:idLen], rest[idLen:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+	}
+	return ad, nil
+}
+
+// verifyClientData checks the collected client data of a ceremony and
+// consumes the challenge it answers.
+func (s *Server) verifyClientData(ctx context.Context, raw []byte, ceremonyType string) (*webauthnChallenge, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, ErrWebAuthnResponseInvalid.WithDetail("invalid client data")
+	}
+	state, err := s.passkeys.consumeChallenge(ctx, cd.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrWebAuthnChallengeInvalid
+	}
+	if cd.Type != ceremonyType || cd.CrossOrigin {
+		return nil, ErrWebAuthnResponseInvalid.WithDetail("unexpected ceremony type")
+	}
+	for _, origin := range s.config.WebAuthnOrigins {
+		if strings.TrimSuffix(origin, "/") == cd.Origin {
+			return state, nil
+		}
+	}
+	return nil, ErrWebAuthnResponseInvalid.WithDetail("origin " + cd.Origin + " is not allowed")
+}
+
+func (s *Server) webauthnError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		writeError(w, r, apiErr)
+		return
+	}
+	log.Printf("[ERROR] WebAuthn: %v", err)
+	s.credentialStoreError(w, r, err)
+}
+
+func (s *Server) requestOptions(challenge string, passkeys []*passkeyRecord, userVerification string) *credentialRequestOptions {
+	options := &credentialRequestOptions{
+		Challenge:        challenge,
+		RPID:             s.config.WebAuthnRPID,
+		Timeout:          s.config.WebAuthnChallengeTTL.Milliseconds(),
+		UserVerification: userVerification,
+	}
+	for _, passkey := range passkeys {
+		options.AllowCredentials = append(options.AllowCredentials, credentialDescriptor{Type: "public-key", ID: passkey.ID})
+	}
+	return options
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create
+// to add a passkey to the caller's account.
+func (s *Server) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	ctx := r.Context()
+	// Passkey logins take the username and roles from the stored
+	// credentials, and only password logins ask for a second factor, so a
+	// passkey of a user without credentials could never be used.
+	credentials, err := s.credentials.load(ctx, claims.UserID)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if credentials == nil {
+		writeError(w, r, ErrPasskeyNoCredentials)
+		return
+	}
+	existing, err := s.passkeys.list(ctx, claims.UserID)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	challenge, err := s.passkeys.newChallenge(ctx, &webauthnChallenge{Ceremony: ceremonyRegister, UserID: claims.UserID, Username: claims.Username}, s.config.WebAuthnChallengeTTL)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+
+	options := &credentialCreationOptions{Challenge: challenge, Timeout: s.config.WebAuthnChallengeTTL.Milliseconds(), Attestation: "none"}
+	options.RP.ID, options.RP.Name = s.config.WebAuthnRPID, s.config.WebAuthnRPName
+	options.User.ID = base64.RawURLEncoding.EncodeToString([]byte(claims.UserID))
+	options.User.Name, options.User.DisplayName = claims.Username, claims.Username
+	for _, alg := range []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, credentialParameter{Type: "public-key", Alg: alg})
+	}
+	options.ExcludeCredentials = []credentialDescriptor{}
+	for _, passkey := range existing {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, credentialDescriptor{Type: "public-key", ID: passkey.ID})
+	}
+	// Passkeys must be discoverable so they can log in without a user ID.
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.RequireResidentKey = true
+	options.AuthenticatorSelection.UserVerification = "required"
+
+	writeJSON(w, http.StatusOK, WebAuthnOptionsResponse{PublicKey: options})
+}
+
+// FinishPasskeyRegistration verifies the new credential and stores it.
+// Attestation is not requested, so attestation statements are ignored.
+func (s *Server) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	var data struct {
+		Name       string              `json:"name"`
+		Credential publicKeyCredential `json:"credential"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(data.Name) > passkeyNameMaxLength {
+		writeError(w, r, ErrRequestInvalidField.WithDetail(fmt.Sprintf("name must be at most %d characters", passkeyNameMaxLength)))
+		return
+	}
+	id, err := data.Credential.credentialID()
+	if err != nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail(err.Error()))
+		return
+	}
+	rawClientData, err := decodeBase64URL(data.Credential.Response.ClientDataJSON)
+	if err != nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail("invalid clientDataJSON"))
+		return
+	}
+
+	ctx := r.Context()
+	state, err := s.verifyClientData(ctx, rawClientData, "webauthn.create")
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if state.Ceremony != ceremonyRegister || state.UserID != claims.UserID {
+		writeError(w, r, ErrWebAuthnChallengeInvalid)
+		return
+	}
+
+	rawAttestation, err := decodeBase64URL(data.Credential.Response.AttestationObject)
+	if err != nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail("invalid attestationObject"))
+		return
+	}
+	item, _, err := decodeCBOR(rawAttestation)
+	attestation, _ := item.(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if err != nil || rawAuthData == nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail("invalid attestationObject"))
+		return
+	}
+	authData, err := s.parseAuthenticatorData(rawAuthData)
+	if err != nil || authData.credentialID == nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail(fmt.Sprintf("invalid authenticator data: %v", err)))
+		return
+	}
+	if authData.flags&authDataUserVerified == 0 {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail("user verification is required"))
+		return
+	}
+	if base64.RawURLEncoding.EncodeToString(authData.credentialID) != id {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail("credential id mismatch"))
+		return
+	}
+	key, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		writeError(w, r, ErrWebAuthnResponseInvalid.WithDetail(err.Error()))
+		return
+	}
+
+	existing, err := s.passkeys.Get(ctx, id)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if existing != nil {
+		writeError(w, r, ErrPasskeyExists)
+		return
+	}
+
+	if data.Name == "" {
+		data.Name = "Passkey"
+	}
+	record := &passkeyRecord{
+		Passkey: Passkey{
+			ID:             id,
+			Name:           data.Name,
+			UserID:         claims.UserID,
+			Username:       claims.Username,
+			Algorithm:      key.Algorithm,
+			SignCount:      authData.signCount,
+			AAGUID:         hex.EncodeToString(authData.aaguid),
+			BackupEligible: authData.flags&authDataBackupEligible != 0,
+			BackedUp:       authData.flags&authDataBackedUp != 0,
+			CreatedAt:      time.Now(),
+		},
+		PublicKey: authData.publicKey,
+	}
+	if err := s.passkeys.Save(ctx, record); err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+
+	log.Printf("[WEBAUTHN] User %s registered passkey %s (%s)", claims.UserID, id, record.Name)
+	s.auditRequest(r, AuditPasskeyRegistered, claims, http.StatusCreated, "passkey "+id)
+	writeJSON(w, http.StatusCreated, record.Passkey)
+}
+
+func (s *Server) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	records, err := s.passkeys.list(r.Context(), claims.UserID)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	passkeys := make([]Passkey, 0, len(records))
+	for _, record := range records {
+		passkeys = append(passkeys, record.Passkey)
+	}
+	writeJSON(w, http.StatusOK, passkeys)
+}
+
+func (s *Server) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		writeError(w, r, ErrAuthContextMissing)
+		return
+	}
+	id := chi.URLParam(r, "credentialID")
+	deleted, err := s.passkeys.Delete(r.Context(), claims.UserID, id)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if !deleted {
+		writeError(w, r, ErrPasskeyNotFound)
+		return
+	}
+	log.Printf("[WEBAUTHN] User %s removed passkey %s", claims.UserID, id)
+	s.auditRequest(r, AuditPasskeyRemoved, claims, http.StatusOK, "passkey "+id)
+	writeJSON(w, http.StatusOK, RevokeResponse{Revoked: 1})
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get to
+// log in with a passkey alone. No user is named, so the response says
+// nothing about which accounts exist.
+func (s *Server) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := s.passkeys.newChallenge(r.Context(), &webauthnChallenge{Ceremony: ceremonyLogin}, s.config.WebAuthnChallengeTTL)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, WebAuthnOptionsResponse{PublicKey: s.requestOptions(challenge, nil, "required")})
+}
+
+// requirePasskey answers a password login of a user with passkeys with a
+// challenge for one of them, and reports whether it did. The session is
+// issued by FinishPasskeyLogin.
+func (s *Server) requirePasskey(w http.ResponseWriter, r *http.Request, identity *Claims, roles []string, useCookies bool) bool {
+	ctx := r.Context()
+	passkeys, err := s.passkeys.list(ctx, identity.UserID)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return true
+	}
+	if len(passkeys) == 0 {
+		return false
+	}
+	challenge, err := s.passkeys.newChallenge(ctx, &webauthnChallenge{
+		Ceremony:   ceremonySecondFactor,
+		UserID:     identity.UserID,
+		Username:   identity.Username,
+		Roles:      roles,
+		UseCookies: useCookies,
+	}, s.config.WebAuthnChallengeTTL)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return true
+	}
+	log.Printf("[WEBAUTHN] Password of user %s accepted, waiting for passkey", identity.UserID)
+	writeJSON(w, http.StatusAccepted, WebAuthnOptionsResponse{PasskeyRequired: true, PublicKey: s.requestOptions(challenge, passkeys, "preferred")})
+	return true
+}
+
+// FinishPasskeyLogin verifies a passkey assertion, either as the only
+// factor or after a password, and responds exactly like Login. Roles come
+// from the server: the credentials of the user, or for a second factor the
+// password login it completes.
+func (s *Server) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Credential publicKeyCredential `json:"credential"`
+		// UseCookies is as for Login; a second factor login keeps the
+		// choice made with the password.
+		UseCookies bool `json:"use_cookies"`
+	}
+	if err := s.decodeJSONBody(w, r, &data); err != nil {
+		s.auditRequest(r, AuditLoginFailed, nil, http.StatusBadRequest, err.Error())
+		s.publishLoginFailed(r, nil, "invalid_body")
+		writeError(w, r, err)
+		return
+	}
+	fail := func(identity *Claims, reason string) {
+		s.auditRequest(r, AuditLoginFailed, identity, ErrPasskeyInvalid.Status, "passkey: "+reason)
+		s.publishLoginFailed(r, identity, "passkey_invalid")
+		writeError(w, r, ErrPasskeyInvalid)
+	}
+
+	id, err := data.Credential.credentialID()
+	if err != nil {
+		fail(nil, err.Error())
+		return
+	}
+	rawClientData, err := decodeBase64URL(data.Credential.Response.ClientDataJSON)
+	if err != nil {
+		fail(nil, "invalid clientDataJSON")
+		return
+	}
+
+	ctx := r.Context()
+	state, err := s.verifyClientData(ctx, rawClientData, "webauthn.get")
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if state.Ceremony != ceremonyLogin && state.Ceremony != ceremonySecondFactor {
+		writeError(w, r, ErrWebAuthnChallengeInvalid)
+		return
+	}
+
+	record, err := s.passkeys.Get(ctx, id)
+	if err != nil {
+		s.webauthnError(w, r, err)
+		return
+	}
+	if record == nil {
+		fail(nil, "unknown credential "+id)
+		return
+	}
+	identity := &Claims{UserID: record.UserID, Username: record.Username}
+	if state.Ceremony == ceremonySecondFactor && state.UserID != record.UserID {
+		fail(identity, "passkey of another user")
+		return
+	}
+	if data.Credential.Response.UserHandle != "" {
+		if handle, err := decodeBase64URL(data.Credential.Response.UserHandle); err != nil || string(handle) != record.UserID {
+			fail(identity, "user handle mismatch")
+			return
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(data.Credential.Response.AuthenticatorData)
+	if err != nil {
+		fail(identity, "invalid authenticatorData")
+		return
+	}
+	authData, err := s.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		fail(identity, err.Error())
+		return
+	}
+	if state.Ceremony == ceremonyLogin && authData.flags&authDataUserVerified == 0 {
+		fail(identity, "user verification is required")
+		return
+	}
+	key, err := parseCOSEKey(record.PublicKey)
+	if err != nil {
+		log.Printf("[ERROR] Stored passkey %s is unusable: %v", id, err)
+		fail(identity, "unusable public key")
+		return
+	}
+	signature, err := decodeBase64URL(data.Credential.Response.Signature)
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err != nil || !key.verify(append(bytes.Clone(rawAuthData), clientDataHash[:]...), signature) {
+		fail(identity, "invalid signature")
+		return
+	}
+	// A counter that does not move forward means the authenticator may
+	// have been cloned. Authenticators that do not count report 0.
+	if (authData.signCount != 0 || record.SignCount != 0) && authData.signCount <= record.SignCount {
+		log.Printf("[WEBAUTHN] Sign count of passkey %s went from %d to %d, possible clone", id, record.SignCount, authData.signCount)
+		fail(identity, "sign count did not increase")
+		return
+	}
+
+	now := time.Now()
+	record.SignCount, record.LastUsedAt = authData.signCount, &now
+	record.BackedUp = authData.flags&authDataBackedUp != 0
+	if err := s.passkeys.Save(ctx, record); err != nil {
+		log.Printf("[ERROR] Failed to update passkey %s: %v", id, err)
+	}
+
+	var roles []string
+	useCookies := data.UseCookies
+	if state.Ceremony == ceremonySecondFactor {
+		identity.Username, roles, useCookies = state.Username, state.Roles, state.UseCookies
+	} else {
+		credentials, err := s.credentials.load(ctx, record.UserID)
+		if err != nil {
+			s.webauthnError(w, r, err)
+			return
+		}
+		if credentials != nil {
+			identity.Username, roles = credentials.Username, credentials.Roles
+		}
+	}
+	if len(roles) == 0 {
+		s.auditRequest(r, AuditLoginFailed, identity, ErrPasskeyNoRoles.Status, "no stored roles")
+		s.publishLoginFailed(r, identity, "missing_roles")
+		writeError(w, r, ErrPasskeyNoRoles)
+		return
+	}
+	if useCookies && !s.config.CookieSessions {
+		writeError(w, r, ErrCookiesDisabled)
+		return
+	}
+
+	s.completeLogin(w, r, identity, roles, useCookies, "passkey")
+}
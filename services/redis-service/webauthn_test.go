@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "http://localhost:3000"
+
+// cborPair is one entry of a CBOR map, kept in order so encodings are
+// deterministic.
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+// appendCBOR encodes the subset of CBOR that authenticators produce.
+func appendCBOR(buf []byte, v interface{}) []byte {
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			buf = append(buf, major<<5|byte(n))
+		case n <= 0xff:
+			buf = append(buf, major<<5|24, byte(n))
+		case n <= 0xffff:
+			buf = append(buf, major<<5|25)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+		default:
+			buf = append(buf, major<<5|26)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			head(1, uint64(-1-v))
+		} else {
+			head(0, uint64(v))
+		}
+	case []byte:
+		head(2, uint64(len(v)))
+		buf = append(buf, v...)
+	case string:
+		head(3, uint64(len(v)))
+		buf = append(buf, v...)
+	case []cborPair:
+		head(5, uint64(len(v)))
+		for _, pair := range v {
+			buf = appendCBOR(buf, pair.key)
+			buf = appendCBOR(buf, pair.value)
+		}
+	default:
+		panic("appendCBOR: unsupported type")
+	}
+	return buf
+}
+
+// softAuthenticator is a P-256 platform authenticator in software.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   string
+	rpID         string
+	origin       string
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t testing.TB, userID string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id, userHandle: userID, rpID: "localhost", origin: testOrigin}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return appendCBOR(nil, []cborPair{
+		{coseKeyType, coseKtyEC2},
+		{coseAlgorithm, coseAlgES256},
+		{coseCurve, coseCurveP256},
+		{coseX, x},
+		{coseY, y},
+	})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(authDataUserPresent | authDataUserVerified)
+	if attested {
+		flags |= authDataAttested
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+func (a *softAuthenticator) attestationObject() []byte {
+	return appendCBOR(nil, []cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(true)},
+	})
+}
+
+// create answers navigator.credentials.create.
+func (a *softAuthenticator) create(challenge string) map[string]interface{} {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(a.attestationObject()),
+		},
+	}
+}
+
+// get answers navigator.credentials.get, counting the signature.
+func (a *softAuthenticator) get(t testing.TB, challenge string) map[string]interface{} {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString([]byte(a.userHandle)),
+		},
+	}
+}
+
+func jsonBody(t testing.TB, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// challengeOf returns the challenge of a begin or passkey-required response.
+func challengeOf(t testing.TB, code int, body []byte) string {
+	t.Helper()
+	var response struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"public_key"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.PublicKey.Challenge == "" {
+		t.Fatalf("no challenge in %d response %s: %v", code, body, err)
+	}
+	return response.PublicKey.Challenge
+}
+
+func registerPasskey(t *testing.T, s *Server, token string, a *softAuthenticator) int {
+	t.Helper()
+	w := serveRequest(s, http.MethodPost, "/api/webauthn/register/begin", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("register begin: got status %d: %s", w.Code, w.Body)
+	}
+	challenge := challengeOf(t, w.Code, w.Body.Bytes())
+	w = serveRequest(s, http.MethodPost, "/api/webauthn/register/finish", token, jsonBody(t, map[string]interface{}{
+		"name":       "Laptop",
+		"credential": a.create(challenge),
+	}))
+	return w.Code
+}
+
+func beginPasskeyLogin(t *testing.T, s *Server) string {
+	t.Helper()
+	w := serveRequest(s, http.MethodPost, "/noauth/webauthn/login/begin", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login begin: got status %d: %s", w.Code, w.Body)
+	}
+	return challengeOf(t, w.Code, w.Body.Bytes())
+}
+
+func finishPasskeyLogin(t *testing.T, s *Server, credential map[string]interface{}) (int, LoginResponse) {
+	t.Helper()
+	// Roles in the body are ignored; they are sent to prove it.
+	w := serveRequest(s, http.MethodPost, "/noauth/webauthn/login/finish", "", jsonBody(t, map[string]interface{}{
+		"credential": credential,
+		"roles":      []string{"administrator"},
+	}))
+	var response LoginResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, response
+}
+
+// newPasskeyUser gives u1 a password and roles and returns a login token
+// for them, from before any passkey exists.
+func newPasskeyUser(t *testing.T) (*Server, string) {
+	t.Helper()
+	s, _ := newTestServer(t, map[string]string{"ADMIN_API_KEY": testAdminKey})
+	setCredentials(t, s, "u1", `{"username":"alice","password":"correct horse battery","roles":["member"]}`)
+	return s, loginToken(t, s, `{"user_id":"u1","password":"correct horse battery"}`).Token
+}
+
+func TestWebAuthnPrimaryLogin(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	passkeys, err := s.passkeys.list(context.Background(), "u1")
+	if err != nil || len(passkeys) != 1 {
+		t.Fatalf("stored passkeys %v (%v), want one", passkeys, err)
+	}
+
+	code, response := finishPasskeyLogin(t, s, a.get(t, beginPasskeyLogin(t, s)))
+	if code != http.StatusOK {
+		t.Fatalf("passkey login: got status %d", code)
+	}
+	session, err := s.sessionManager.GetSession(context.Background(), response.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserID != "u1" || session.Username != "alice" || !slices.Equal(session.Roles, []string{"member"}) {
+		t.Errorf("session %s/%s with roles %v, want u1/alice with the stored roles", session.UserID, session.Username, session.Roles)
+	}
+}
+
+func TestWebAuthnSecondFactorLogin(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+
+	w := postLogin(s, "203.0.113.7:5000", nil, `{"user_id":"u1","password":"correct horse battery"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("password login with a passkey: got status %d, want 202: %s", w.Code, w.Body)
+	}
+	challenge := challengeOf(t, w.Code, w.Body.Bytes())
+
+	other := newSoftAuthenticator(t, "u2")
+	if code, _ := finishPasskeyLogin(t, s, other.get(t, challenge)); code == http.StatusOK {
+		t.Fatal("unregistered authenticator completed the second factor")
+	}
+
+	w = postLogin(s, "203.0.113.7:5000", nil, `{"user_id":"u1","password":"correct horse battery"}`)
+	code, response := finishPasskeyLogin(t, s, a.get(t, challengeOf(t, w.Code, w.Body.Bytes())))
+	if code != http.StatusOK {
+		t.Fatalf("second factor: got status %d", code)
+	}
+	session, err := s.sessionManager.GetSession(context.Background(), response.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(session.Roles, []string{"member"}) {
+		t.Errorf("session roles %v, want the stored roles", session.Roles)
+	}
+}
+
+func TestWebAuthnRejectsBadOrigin(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	a.origin = "https://evil.example"
+	if code := registerPasskey(t, s, token, a); code != http.StatusBadRequest {
+		t.Fatalf("registration from another origin: got status %d, want 400", code)
+	}
+
+	a.origin = testOrigin
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	a.origin = "https://evil.example"
+	if code, _ := finishPasskeyLogin(t, s, a.get(t, beginPasskeyLogin(t, s))); code != http.StatusBadRequest {
+		t.Fatalf("login from another origin: got status %d, want 400", code)
+	}
+}
+
+func TestWebAuthnRejectsBadRPIDHash(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	a.rpID = "evil.example"
+	if code := registerPasskey(t, s, token, a); code != http.StatusBadRequest {
+		t.Fatalf("registration for another RP ID: got status %d, want 400", code)
+	}
+
+	a.rpID = "localhost"
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	a.rpID = "evil.example"
+	if code, _ := finishPasskeyLogin(t, s, a.get(t, beginPasskeyLogin(t, s))); code != http.StatusUnauthorized {
+		t.Fatalf("login for another RP ID: got status %d, want 401", code)
+	}
+}
+
+func TestWebAuthnChallengeSingleUse(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+
+	assertion := a.get(t, beginPasskeyLogin(t, s))
+	code, login := finishPasskeyLogin(t, s, assertion)
+	if code != http.StatusOK {
+		t.Fatalf("first use: got status %d", code)
+	}
+	if code, _ := finishPasskeyLogin(t, s, assertion); code != http.StatusBadRequest {
+		t.Fatalf("replayed assertion: got status %d, want 400", code)
+	}
+
+	// A registration challenge cannot be answered with a login.
+	w := serveRequest(s, http.MethodPost, "/api/webauthn/register/begin", login.Token, "")
+	if code, _ := finishPasskeyLogin(t, s, a.get(t, challengeOf(t, w.Code, w.Body.Bytes()))); code == http.StatusOK {
+		t.Fatal("login completed with a registration challenge")
+	}
+}
+
+func TestWebAuthnRejectsCounterRegression(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	a.signCount = 10
+	if code, _ := finishPasskeyLogin(t, s, a.get(t, beginPasskeyLogin(t, s))); code != http.StatusOK {
+		t.Fatalf("login: got status %d", code)
+	}
+
+	clone := *a
+	clone.signCount = 5
+	if code, _ := finishPasskeyLogin(t, s, clone.get(t, beginPasskeyLogin(t, s))); code != http.StatusUnauthorized {
+		t.Fatalf("lower sign count: got status %d, want 401", code)
+	}
+	clone.signCount = 10
+	if code, _ := finishPasskeyLogin(t, s, clone.get(t, beginPasskeyLogin(t, s))); code != http.StatusUnauthorized {
+		t.Fatalf("repeated sign count: got status %d, want 401", code)
+	}
+}
+
+func TestWebAuthnRegistrationNeedsCredentials(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	// Logged in by the trusted API service, without gateway credentials.
+	token := loginToken(t, s, `{"user_id":"u1","username":"alice","roles":["administrator"]}`).Token
+	w := serveRequest(s, http.MethodPost, "/api/webauthn/register/begin", token, "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "webauthn.credentials_required") {
+		t.Fatalf("register without credentials: got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestWebAuthnPrimaryLoginNeedsStoredRoles(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	// The credentials are removed after the passkey was registered.
+	if err := s.rdb.Del(context.Background(), credentialKey(context.Background(), "u1")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := finishPasskeyLogin(t, s, a.get(t, beginPasskeyLogin(t, s))); code != http.StatusForbidden {
+		t.Fatalf("passkey login without stored roles: got status %d, want 403", code)
+	}
+}
+
+func TestWebAuthnRejectsScopedTokens(t *testing.T) {
+	s, token := newPasskeyUser(t)
+	a := newSoftAuthenticator(t, "u1")
+	if code := registerPasskey(t, s, token, a); code != http.StatusCreated {
+		t.Fatalf("register: got status %d", code)
+	}
+	w := serveRequest(s, http.MethodPost, "/api/tokens", token, `{"scopes":["*"]}`)
+	var scoped ScopedTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&scoped); err != nil || scoped.Token == "" {
+		t.Fatalf("mint scoped token: got status %d: %v", w.Code, err)
+	}
+
+	if w := serveRequest(s, http.MethodPost, "/api/webauthn/register/begin", scoped.Token, ""); w.Code != http.StatusForbidden {
+		t.Errorf("register with a scoped token: got status %d, want 403", w.Code)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	if w := serveRequest(s, http.MethodDelete, "/api/webauthn/credentials/"+id, scoped.Token, ""); w.Code != http.StatusForbidden {
+		t.Errorf("delete with a scoped token: got status %d, want 403", w.Code)
+	}
+	if w := serveRequest(s, http.MethodDelete, "/api/webauthn/credentials/"+id, token, ""); w.Code != http.StatusOK {
+		t.Errorf("delete with the login token: got status %d: %s", w.Code, w.Body)
+	}
+}
@@ -18,7 +18,7 @@ echo "Frontend build completed"
 echo "Starting services..."
 echo "Starting Redis service..."
 cd /app/services/redis-service
-go run main.go &
+go run . &
 REDIS_SERVICE_PID=$!
 echo "Redis service started with PID $REDIS_SERVICE_PID"
 sleep 5